@@ -2,28 +2,44 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"os"
 
 	"github.com/gossion/migration-producer/cmd/subcommands"
+	"github.com/gossion/migration-producer/pkg/redact"
 	flags "github.com/jessevdk/go-flags"
 )
 
 type MigratorCommand struct {
-	Migrate subcommands.DBMigrateCommand `command:"migrate-db" description:"Migrate database from one database to another"`
+	Migrate  subcommands.DBMigrateCommand    `command:"migrate-db" description:"Migrate database from one database to another"`
+	Export   subcommands.DBExportCommand     `command:"export-db" description:"Export a database into an artifact of a blobstore"`
+	Import   subcommands.DBImportCommand     `command:"import-db" description:"Import an artifact of a blobstore into a database"`
+	Validate subcommands.DBValidateCommand   `command:"validate-db" description:"Compare a database with its source database or artifact"`
+	Diff     subcommands.DBDiffSchemaCommand `command:"diff-schema" description:"Compare the schema of a database with its source database"`
+	History  subcommands.DBHistoryCommand    `command:"history" description:"List the recorded migration jobs, the most recent first"`
+	Show     subcommands.DBShowCommand       `command:"show" description:"Show a recorded migration job"`
+	Serve    subcommands.ServeCommand        `command:"serve" description:"Serve a REST API to submit and monitor migrations"`
+
+	Logging subcommands.LoggingFlags `group:"Logging Options"`
 }
 
 var Migrator MigratorCommand
 
 func main() {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
-
 	parser := flags.NewParser(&Migrator, flags.HelpFlag)
 	parser.NamespaceDelimiter = "-"
+	parser.CommandHandler = func(command flags.Commander, args []string) error {
+		if err := Migrator.Logging.Setup(); err != nil {
+			return err
+		}
+		if command == nil {
+			return nil
+		}
+		return command.Execute(args)
+	}
 
 	_, err := parser.Parse()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		fmt.Fprintf(os.Stderr, "error: %s\n", redact.String(err.Error()))
 		os.Exit(1)
 	}
 }
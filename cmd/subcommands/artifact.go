@@ -0,0 +1,93 @@
+package subcommands
+
+import (
+	"fmt"
+
+	"github.com/gossion/migration-producer/pkg/datatype"
+	"github.com/gossion/migration-producer/pkg/migrator"
+)
+
+type DBExportCommand struct {
+	SourceDSN string `long:"source-dsn" env:"SOURCE_DSN" required:"true"`
+	Method    string `long:"method" default:"fulldump" choice:"fulldump" choice:"schema-only" choice:"data-only" choice:"parallel" description:"Export the schema and rows, the schema only, the rows only, or the tables concurrently"`
+	Blobstore string `long:"blobstore" env:"BLOBSTORE" required:"true" description:"Store the artifact in the blobstore, a directory or an URL like s3://bucket/prefix"`
+	Lock      bool   `long:"lock" description:"Lock the source while exporting, so the row counts of the manifest match the dump"`
+
+	ExportFlags
+	EncryptionFlags
+	RetryFlags
+	HistoryFlags
+	MetricsFlags
+}
+
+func (c *DBExportCommand) Execute([]string) error {
+	src, err := datatype.ParseDSN(c.SourceDSN, datatype.CredentialSources...)
+	if err != nil {
+		return err
+	}
+	store, err := datatype.ParseBlobstore(c.Blobstore)
+	if err != nil {
+		return err
+	}
+
+	dm := migrator.NewDatabaseMigrator(src, datatype.Database{})
+	dm.Method = c.Method
+	dm.Validate = c.Lock
+	dm.Blobstore = store
+	dm.Options = c.ExportFlags.options()
+	if dm.Options.Encryption, err = c.EncryptionFlags.encryption(); err != nil {
+		return err
+	}
+	dm.Options.Retry = c.RetryFlags.policy()
+
+	err = c.HistoryFlags.record("export-db", dm, func() error {
+		m, err := dm.Export()
+		if err != nil {
+			return err
+		}
+		fmt.Println(m.ID)
+		return nil
+	})
+	return c.MetricsFlags.push("export-db", err)
+}
+
+type DBImportCommand struct {
+	DestinationDSN string `long:"dest-dsn" env:"DEST_DSN" required:"true"`
+	Blobstore      string `long:"blobstore" env:"BLOBSTORE" required:"true" description:"Pull the artifact from the blobstore, a directory or an URL like s3://bucket/prefix"`
+	Artifact       string `long:"artifact" required:"true" description:"ID of the artifact to import"`
+	Validate       bool   `long:"validate" description:"Compare the row counts of the destination with the artifact manifest"`
+	Parallelism    int    `long:"parallelism" default:"4" description:"Number of tables imported concurrently from a parallel dump"`
+
+	EncryptionFlags
+	RetryFlags
+	HistoryFlags
+	MetricsFlags
+	RenameTables map[string]string `long:"rename-table" description:"Rename a table in the destination, as source:destination, can be repeated"`
+}
+
+func (c *DBImportCommand) Execute([]string) error {
+	dest, err := datatype.ParseDSN(c.DestinationDSN, datatype.CredentialSources...)
+	if err != nil {
+		return err
+	}
+	store, err := datatype.ParseBlobstore(c.Blobstore)
+	if err != nil {
+		return err
+	}
+
+	dm := migrator.NewDatabaseMigrator(datatype.Database{}, dest)
+	dm.Validate = c.Validate
+	dm.Blobstore = store
+	dm.Options.Parallelism = c.Parallelism
+	if dm.Options.Encryption, err = c.EncryptionFlags.encryption(); err != nil {
+		return err
+	}
+	dm.Options.RenameTables = c.RenameTables
+	dm.Options.Retry = c.RetryFlags.policy()
+
+	err = c.HistoryFlags.record("import-db", dm, func() error {
+		_, err := dm.Import(c.Artifact)
+		return err
+	})
+	return c.MetricsFlags.push("import-db", err)
+}
@@ -0,0 +1,166 @@
+package subcommands
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gossion/migration-producer/pkg/datatype"
+	"github.com/gossion/migration-producer/pkg/history"
+	"github.com/gossion/migration-producer/pkg/logging"
+	"github.com/gossion/migration-producer/pkg/migrator"
+	"github.com/gossion/migration-producer/pkg/redact"
+)
+
+// HistoryFlags locate the job history the runs are recorded in
+type HistoryFlags struct {
+	HistoryDir string `long:"history-dir" env:"MIGRATOR_HISTORY_DIR" description:"Directory of the job history, defaults to ~/.migrator/history"`
+	NoHistory  bool   `long:"no-history" description:"Do not record the run in the job history"`
+}
+
+// record runs a command of the migrator, recording it in the job history and
+// logging with the job ID. A history which can not be written does not fail
+// the run.
+func (f HistoryFlags) record(command string, dm *migrator.DatabaseMigrator, run func() error) error {
+	if f.NoHistory {
+		return run()
+	}
+	store, err := history.Open(f.HistoryDir)
+	if err != nil {
+		logging.Default().Warnf("Failed to open job history, the run is not recorded: %s", err)
+		return run()
+	}
+	job, err := history.NewJob(command)
+	if err != nil {
+		return err
+	}
+	log := logging.Default().With("job", job.ID)
+	dm.Log = log
+	job.Source = redactDatabase(dm.Source)
+	job.Destination = redactDatabase(dm.Destination)
+	job.Method = dm.Method
+	if err := store.Save(job); err != nil {
+		log.Warnf("Failed to record job %s: %s", job.ID, err)
+	}
+
+	runErr := run()
+
+	job.FinishedAt = time.Now().UTC()
+	job.Status = history.Succeeded
+	if runErr != nil {
+		job.Status = history.Failed
+		job.Error = redact.String(runErr.Error())
+	}
+	res := dm.Result
+	for _, phase := range res.Phases {
+		job.Phases = append(job.Phases, history.Phase{Name: phase.Name, Duration: phase.Duration})
+	}
+	job.Validation = res.Validation()
+	if res.Dump != nil {
+		job.Bytes = res.Dump.Size
+	}
+	if m := res.Artifact; m != nil {
+		job.Artifact = m.ID
+		if job.Source == "" {
+			job.Source = m.Source
+		}
+		job.Method = m.Method
+	}
+	if job.Destination == "" && dm.Blobstore.Configured() {
+		if store, err := dm.Blobstore.ToURL(); err == nil {
+			job.Destination = store.String()
+		}
+	}
+
+	if err := store.Save(job); err != nil {
+		log.Warnf("Failed to record job %s: %s", job.ID, err)
+	} else {
+		log.Infof("Recorded job %s", job.ID)
+	}
+	return runErr
+}
+
+// redactDatabase returns the DSN of a database without its password, or an
+// empty string if it is not set
+func redactDatabase(db datatype.Database) string {
+	if db.Protocal == "" {
+		return ""
+	}
+	u, err := db.ToURL()
+	if err != nil {
+		return ""
+	}
+	return redact.URL(u)
+}
+
+type DBHistoryCommand struct {
+	HistoryDir string `long:"history-dir" env:"MIGRATOR_HISTORY_DIR" description:"Directory of the job history, defaults to ~/.migrator/history"`
+	Limit      int    `long:"limit" default:"20" description:"Number of jobs listed, 0 lists all of them"`
+}
+
+func (c *DBHistoryCommand) Execute([]string) error {
+	store, err := history.Open(c.HistoryDir)
+	if err != nil {
+		return err
+	}
+	jobs, err := store.List()
+	if err != nil {
+		return err
+	}
+	if c.Limit > 0 && len(jobs) > c.Limit {
+		jobs = jobs[:c.Limit]
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tCOMMAND\tMETHOD\tSTARTED\tDURATION\tSTATUS\tVALIDATION\tSOURCE\tDESTINATION")
+	for _, job := range jobs {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", job.ID, job.Command, job.Method,
+			job.StartedAt.Local().Format("2006-01-02 15:04:05"), job.Duration().Round(time.Second),
+			job.Status, job.Validation, job.Source, job.Destination)
+	}
+	return w.Flush()
+}
+
+type DBShowCommand struct {
+	HistoryDir string `long:"history-dir" env:"MIGRATOR_HISTORY_DIR" description:"Directory of the job history, defaults to ~/.migrator/history"`
+	Args       struct {
+		ID string `positional-arg-name:"id" description:"ID of the job"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+func (c *DBShowCommand) Execute([]string) error {
+	store, err := history.Open(c.HistoryDir)
+	if err != nil {
+		return err
+	}
+	job, err := store.Get(c.Args.ID)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "ID:\t%s\n", job.ID)
+	fmt.Fprintf(w, "Command:\t%s\n", job.Command)
+	fmt.Fprintf(w, "Method:\t%s\n", job.Method)
+	fmt.Fprintf(w, "Source:\t%s\n", job.Source)
+	fmt.Fprintf(w, "Destination:\t%s\n", job.Destination)
+	if job.Artifact != "" {
+		fmt.Fprintf(w, "Artifact:\t%s\n", job.Artifact)
+	}
+	fmt.Fprintf(w, "Status:\t%s\n", job.Status)
+	fmt.Fprintf(w, "Started:\t%s\n", job.StartedAt.Local().Format(time.RFC3339))
+	if !job.FinishedAt.IsZero() {
+		fmt.Fprintf(w, "Finished:\t%s\n", job.FinishedAt.Local().Format(time.RFC3339))
+	}
+	fmt.Fprintf(w, "Duration:\t%s\n", job.Duration().Round(time.Millisecond))
+	for _, phase := range job.Phases {
+		fmt.Fprintf(w, "  %s:\t%s\n", phase.Name, phase.Duration.Round(time.Millisecond))
+	}
+	fmt.Fprintf(w, "Bytes:\t%d\n", job.Bytes)
+	fmt.Fprintf(w, "Validation:\t%s\n", job.Validation)
+	if job.Error != "" {
+		fmt.Fprintf(w, "Error:\t%s\n", job.Error)
+	}
+	return w.Flush()
+}
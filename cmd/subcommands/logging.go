@@ -0,0 +1,32 @@
+package subcommands
+
+import (
+	"log"
+	"os"
+
+	"github.com/gossion/migration-producer/pkg/logging"
+)
+
+// LoggingFlags select the format and the level of the log, for all commands
+type LoggingFlags struct {
+	LogFormat string `long:"log-format" env:"MIGRATOR_LOG_FORMAT" default:"text" choice:"text" choice:"json" description:"Write the log as text or as a JSON object per line"`
+	LogLevel  string `long:"log-level" env:"MIGRATOR_LOG_LEVEL" default:"info" choice:"debug" choice:"info" choice:"warn" choice:"error" description:"Minimum level of the log entries"`
+}
+
+// Setup replaces the default logger, the standard logger of the libraries
+// writes to it too
+func (f LoggingFlags) Setup() error {
+	level, err := logging.ParseLevel(f.LogLevel)
+	if err != nil {
+		return err
+	}
+	l, err := logging.New(os.Stderr, f.LogFormat, level)
+	if err != nil {
+		return err
+	}
+	logging.SetDefault(l)
+
+	log.SetFlags(0)
+	log.SetOutput(l.Writer())
+	return nil
+}
@@ -0,0 +1,32 @@
+package subcommands
+
+import (
+	"github.com/gossion/migration-producer/pkg/history"
+	"github.com/gossion/migration-producer/pkg/logging"
+	"github.com/gossion/migration-producer/pkg/metrics"
+)
+
+// MetricsFlags push the metrics of a run to a Pushgateway
+type MetricsFlags struct {
+	PushGateway string `long:"push-gateway" env:"MIGRATOR_PUSH_GATEWAY" description:"Push the metrics of the run to the Pushgateway at the URL, e.g. http://localhost:9091"`
+}
+
+// push counts a database run in the metrics and pushes them if a gateway is
+// set, as the job named after the command. A failed push does not fail the
+// run.
+func (f MetricsFlags) push(command string, err error) error {
+	status := history.Succeeded
+	if err != nil {
+		status = history.Failed
+	}
+	metrics.Jobs.Inc("db", status)
+
+	if f.PushGateway != "" {
+		if pushErr := metrics.Default.Push(f.PushGateway, command); pushErr != nil {
+			logging.Default().Warnf("Failed to push metrics: %s", pushErr)
+		} else {
+			logging.Default().Infof("Pushed metrics to %s", f.PushGateway)
+		}
+	}
+	return err
+}
@@ -1,41 +1,121 @@
 package subcommands
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/gossion/migration-producer/pkg/database"
 	"github.com/gossion/migration-producer/pkg/datatype"
 	"github.com/gossion/migration-producer/pkg/migrator"
 )
 
 type DBMigrateCommand struct {
-	SourceDSN      string `long:"source-dsn" env:"SOURCE_DSN"`
-	DestinationDSN string `long:"dest-dsn" env:"DEST_DSN"`
+	SourceDSN      string `long:"source-dsn" env:"SOURCE_DSN" required:"true"`
+	DestinationDSN string `long:"dest-dsn" env:"DEST_DSN" required:"true"`
+	Method         string `long:"method" default:"fulldump" choice:"fulldump" choice:"schema-only" choice:"data-only" choice:"cross-engine" choice:"parallel" description:"Migrate the schema and rows, the schema only, the rows only, between different database engines, or the tables concurrently"`
+	Validate       bool   `long:"validate" description:"Lock the source while exporting and compare the row counts of the source and destination"`
+	Blobstore      string `long:"blobstore" env:"BLOBSTORE" description:"Also store the exported dump as an artifact in the blobstore, a directory or an URL like s3://bucket/prefix"`
+
+	ExportFlags
+	EncryptionFlags
+	RetryFlags
+	HistoryFlags
+	MetricsFlags
+	RenameTables map[string]string `long:"rename-table" description:"Rename a table in the destination, as source:destination, can be repeated"`
 }
 
 func (c *DBMigrateCommand) Execute([]string) error {
+	src, err := datatype.ParseDSN(c.SourceDSN, datatype.CredentialSources...)
+	if err != nil {
+		return err
+	}
+	dest, err := datatype.ParseDSN(c.DestinationDSN, datatype.CredentialSources...)
+	if err != nil {
+		return err
+	}
 
-	//src, err := datatype.ParseDSN(c.SourceDSN)
-	//dest, err := datatype.ParseDSN(c.DestinationDSN)
-
-	// test
-	src := datatype.Database{
-		Username: "g2",
-		Password: "g2",
-		Protocal: "mysql",
-		Host:     "127.0.0.1",
-		Database: "ops",
+	dm := migrator.NewDatabaseMigrator(src, dest)
+	dm.Method = c.Method
+	dm.Validate = c.Validate
+	dm.Options = c.ExportFlags.options()
+	if dm.Options.Encryption, err = c.EncryptionFlags.encryption(); err != nil {
+		return err
 	}
+	dm.Options.RenameTables = c.RenameTables
+	dm.Options.Retry = c.RetryFlags.policy()
+	if c.Blobstore != "" {
+		store, err := datatype.ParseBlobstore(c.Blobstore)
+		if err != nil {
+			return err
+		}
+		dm.Blobstore = store
+	}
+	err = c.HistoryFlags.record("migrate-db", dm, dm.Migrate)
+	return c.MetricsFlags.push("migrate-db", err)
+}
+
+// ExportFlags select and encode what is exported
+type ExportFlags struct {
+	Parallelism int    `long:"parallelism" default:"4" description:"Number of tables exported or imported concurrently by the parallel method"`
+	Compression string `long:"compression" default:"none" choice:"none" choice:"gzip" choice:"zstd" description:"Compress the exported dump"`
 
-	dest := datatype.Database{
-		Username: "g2",
-		Password: "g2",
-		Protocal: "mysql",
-		Host:     "127.0.0.1",
-		Database: "ops2",
+	IncludeTables []string          `long:"include-table" description:"Only migrate tables matching the glob pattern, can be repeated"`
+	ExcludeTables []string          `long:"exclude-table" description:"Skip tables matching the glob pattern, can be repeated"`
+	Where         map[string]string `long:"where" description:"Only migrate rows of a table matching a predicate, as table:predicate, can be repeated"`
+
+	Charset   string `long:"charset" description:"Convert the tables and text columns to the character set, e.g. utf8mb4, failing if any data would be lossy"`
+	Collation string `long:"collation" description:"Collation of the converted columns, defaults to the unicode collation of the character set"`
+
+	Masks   map[string]string `long:"mask" description:"Mask the values of a column, as table.column:rule, the rule is hash, null, email, format or constant:value, can be repeated"`
+	MaskKey string            `long:"mask-key" env:"MASK_KEY" description:"Secret of the hashes of masked values, the same key masks the same values alike, required by the hash, email and format rules"`
+}
+
+func (f ExportFlags) options() database.Options {
+	return database.Options{
+		IncludeTables: f.IncludeTables,
+		ExcludeTables: f.ExcludeTables,
+		Where:         f.Where,
+		Parallelism:   f.Parallelism,
+		Compression:   f.Compression,
+		Charset:       f.Charset,
+		Collation:     f.Collation,
+		Masks:         f.Masks,
+		MaskKey:       f.MaskKey,
 	}
+}
 
-	dm := migrator.NewDatabaseMigrator(src, dest)
-	err := dm.Migrate()
+// EncryptionFlags set the key encrypting exported dumps and decrypting
+// imported ones. The passphrase is never a flag, the arguments of a process
+// are visible to every user of the machine.
+type EncryptionFlags struct {
+	EncryptionKeyFile        string `long:"encryption-key-file" env:"ENCRYPTION_KEY_FILE" description:"Encrypt exported dumps and decrypt imported ones with AES-256-GCM, the file holds a 256 bit key, raw or encoded in hex or base64"`
+	EncryptionPassphraseFile string `long:"encryption-passphrase-file" env:"ENCRYPTION_PASSPHRASE_FILE" description:"Encrypt exported dumps and decrypt imported ones with AES-256-GCM, with a key derived from the passphrase of the file, or of the ENCRYPTION_PASSPHRASE environment variable"`
+}
+
+// passphraseEnv is the environment variable of the encryption passphrase
+const passphraseEnv = "ENCRYPTION_PASSPHRASE"
+
+func (f EncryptionFlags) encryption() (database.Encryption, error) {
+	e := database.Encryption{
+		KeyFile:    f.EncryptionKeyFile,
+		Passphrase: os.Getenv(passphraseEnv),
+	}
+	if f.EncryptionPassphraseFile == "" {
+		return e, nil
+	}
+	if e.Passphrase != "" {
+		return e, fmt.Errorf("%s and --encryption-passphrase-file are mutually exclusive", passphraseEnv)
+	}
+	data, err := ioutil.ReadFile(f.EncryptionPassphraseFile)
 	if err != nil {
-		return err
+		return e, err
+	}
+	// editors end files with a newline
+	e.Passphrase = strings.TrimRight(string(data), "\r\n")
+	if e.Passphrase == "" {
+		return e, fmt.Errorf("encryption passphrase file %s is empty", f.EncryptionPassphraseFile)
 	}
-	return nil
+	return e, nil
 }
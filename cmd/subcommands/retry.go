@@ -0,0 +1,23 @@
+package subcommands
+
+import (
+	"time"
+
+	"github.com/gossion/migration-producer/pkg/retry"
+)
+
+// RetryFlags set the retries of the idempotent operations failing on transient
+// errors, e.g. pings, row counts and blob copies
+type RetryFlags struct {
+	RetryAttempts int           `long:"retry-attempts" env:"MIGRATOR_RETRY_ATTEMPTS" default:"3" description:"Attempts of the operations failing on transient errors, e.g. lost connections or deadlocks, 1 disables the retries"`
+	RetryDelay    time.Duration `long:"retry-delay" env:"MIGRATOR_RETRY_DELAY" default:"1s" description:"Backoff before the first retry, doubled after each retry and randomized"`
+	RetryMaxDelay time.Duration `long:"retry-max-delay" env:"MIGRATOR_RETRY_MAX_DELAY" default:"30s" description:"Maximum backoff between retries"`
+}
+
+func (f RetryFlags) policy() retry.Policy {
+	return retry.Policy{
+		Attempts: f.RetryAttempts,
+		Delay:    f.RetryDelay,
+		MaxDelay: f.RetryMaxDelay,
+	}
+}
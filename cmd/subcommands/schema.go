@@ -0,0 +1,51 @@
+package subcommands
+
+import (
+	"fmt"
+
+	"github.com/gossion/migration-producer/pkg/database"
+	"github.com/gossion/migration-producer/pkg/datatype"
+	"github.com/gossion/migration-producer/pkg/migrator"
+)
+
+type DBDiffSchemaCommand struct {
+	SourceDSN      string `long:"source-dsn" env:"SOURCE_DSN" required:"true"`
+	DestinationDSN string `long:"dest-dsn" env:"DEST_DSN" required:"true"`
+
+	IncludeTables []string          `long:"include-table" description:"Only compare tables matching the glob pattern, can be repeated"`
+	ExcludeTables []string          `long:"exclude-table" description:"Skip tables matching the glob pattern, can be repeated"`
+	RenameTables  map[string]string `long:"rename-table" description:"Table renamed in the destination, as source:destination, can be repeated"`
+	Charset       string            `long:"charset" description:"Character set the migration converted the tables and text columns to, the source is compared as converted"`
+	Collation     string            `long:"collation" description:"Collation of the columns converted by the migration"`
+
+	RetryFlags
+}
+
+func (c *DBDiffSchemaCommand) Execute([]string) error {
+	src, err := datatype.ParseDSN(c.SourceDSN, datatype.CredentialSources...)
+	if err != nil {
+		return err
+	}
+	dest, err := datatype.ParseDSN(c.DestinationDSN, datatype.CredentialSources...)
+	if err != nil {
+		return err
+	}
+
+	diff, err := migrator.DiffSchemas(src, dest, database.Options{
+		IncludeTables: c.IncludeTables,
+		ExcludeTables: c.ExcludeTables,
+		RenameTables:  c.RenameTables,
+		Charset:       c.Charset,
+		Collation:     c.Collation,
+		Retry:         c.RetryFlags.policy(),
+	})
+	if err != nil {
+		return err
+	}
+	if diff.Empty() {
+		return nil
+	}
+
+	fmt.Println(diff)
+	return fmt.Errorf("%d schema differences", len(diff.Differences))
+}
@@ -0,0 +1,72 @@
+package subcommands
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/gossion/migration-producer/pkg/history"
+	"github.com/gossion/migration-producer/pkg/logging"
+	"github.com/gossion/migration-producer/pkg/server"
+)
+
+type ServeCommand struct {
+	Listen            string   `long:"listen" default:":8080" description:"Address the REST API listens on, a token is required unless it is a loopback address"`
+	Concurrency       int      `long:"concurrency" default:"2" description:"Number of jobs run at once, the others are queued"`
+	Token             string   `long:"token" env:"MIGRATOR_API_TOKEN" description:"Require the token as a bearer token of every request"`
+	MaskKey           string   `long:"mask-key" env:"MASK_KEY" description:"Secret of the hashes of masked values, the same key masks the same values alike, required by the hash, email and format rules"`
+	CredentialSources []string `long:"allow-credential-source" choice:"file" choice:"env" choice:"secret" description:"Allow the DSNs of the requests to read their credentials from files, environment variables or secret providers of the server, may be repeated"`
+
+	EncryptionFlags
+	RetryFlags
+	HistoryFlags
+}
+
+func (c *ServeCommand) Execute([]string) error {
+	// the jobs read local files and run SQL predicates of the requests
+	if c.Token == "" && !loopback(c.Listen) {
+		return fmt.Errorf("refusing to serve the API on %s without a token, set --token or listen on a loopback address, e.g. 127.0.0.1:8080", c.Listen)
+	}
+	encryption, err := c.EncryptionFlags.encryption()
+	if err != nil {
+		return err
+	}
+	if err := encryption.Validate(); err != nil {
+		return err
+	}
+
+	s := server.NewServer(c.Concurrency)
+	s.Token = c.Token
+	s.Encryption = encryption
+	s.MaskKey = c.MaskKey
+	s.CredentialSources = c.CredentialSources
+	s.Retry = c.RetryFlags.policy()
+	if !c.NoHistory {
+		if s.History, err = history.Open(c.HistoryDir); err != nil {
+			logging.Default().Warnf("Failed to open job history, the jobs are not recorded: %s", err)
+		}
+	}
+	s.Start()
+
+	if c.Token == "" {
+		logging.Default().Warnf("No token set, the API is not authenticated for the local users")
+		if len(c.CredentialSources) > 0 {
+			logging.Default().Warnf("Any client can read the credentials of the server from %v", c.CredentialSources)
+		}
+	}
+	logging.Default().Infof("Serving the API on %s, running %d jobs at once", c.Listen, c.Concurrency)
+	return http.ListenAndServe(c.Listen, s)
+}
+
+// loopback reports whether the listen address only accepts local connections
+func loopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
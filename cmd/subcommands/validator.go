@@ -0,0 +1,84 @@
+package subcommands
+
+import (
+	"errors"
+
+	"github.com/gossion/migration-producer/pkg/database"
+	"github.com/gossion/migration-producer/pkg/datatype"
+	"github.com/gossion/migration-producer/pkg/logging"
+	"github.com/gossion/migration-producer/pkg/migrator"
+)
+
+type DBValidateCommand struct {
+	SourceDSN      string `long:"source-dsn" env:"SOURCE_DSN" description:"Source database to compare with, unless an artifact is set"`
+	DestinationDSN string `long:"dest-dsn" env:"DEST_DSN" required:"true"`
+	Method         string `long:"method" default:"fulldump" choice:"fulldump" choice:"schema-only" choice:"data-only" choice:"cross-engine" choice:"parallel" description:"Method of the migration to validate"`
+	Blobstore      string `long:"blobstore" env:"BLOBSTORE" description:"Blobstore of the artifact, a directory or an URL like s3://bucket/prefix"`
+	Artifact       string `long:"artifact" description:"Compare with the manifest of the artifact instead of the source database"`
+	Checksum       bool   `long:"checksum" description:"Also compare the checksums of the rows, the source and destination must be the same engine"`
+	Schema         bool   `long:"schema" description:"Also compare the schemas, the source and destination must be the same engine"`
+
+	IncludeTables []string          `long:"include-table" description:"Only validate tables matching the glob pattern, can be repeated"`
+	ExcludeTables []string          `long:"exclude-table" description:"Skip tables matching the glob pattern, can be repeated"`
+	Where         map[string]string `long:"where" description:"Only count rows of a source table matching a predicate, as table:predicate, can be repeated"`
+	RenameTables  map[string]string `long:"rename-table" description:"Table renamed in the destination, as source:destination, can be repeated"`
+	Masks         map[string]string `long:"mask" description:"Column masked by the migration, as table.column:rule, its values are left out of the checksums, can be repeated"`
+	Charset       string            `long:"charset" description:"Character set the migration converted the tables and text columns to, compared as such with --schema"`
+	Collation     string            `long:"collation" description:"Collation of the columns converted by the migration"`
+
+	RetryFlags
+}
+
+func (c *DBValidateCommand) Execute([]string) error {
+	dest, err := datatype.ParseDSN(c.DestinationDSN, datatype.CredentialSources...)
+	if err != nil {
+		return err
+	}
+
+	v := migrator.NewDatabaseValidator(datatype.Database{}, dest)
+	v.Method = c.Method
+	v.Checksum = c.Checksum
+	v.Schema = c.Schema
+	v.Options = database.Options{
+		IncludeTables: c.IncludeTables,
+		ExcludeTables: c.ExcludeTables,
+		Where:         c.Where,
+		RenameTables:  c.RenameTables,
+		Masks:         c.Masks,
+		Charset:       c.Charset,
+		Collation:     c.Collation,
+		Retry:         c.RetryFlags.policy(),
+	}
+
+	switch {
+	case c.Artifact != "":
+		if c.Blobstore == "" {
+			return errMissingBlobstore
+		}
+		store, err := datatype.ParseBlobstore(c.Blobstore)
+		if err != nil {
+			return err
+		}
+		v.Blobstore = store
+		v.Artifact = c.Artifact
+	case c.SourceDSN != "":
+		src, err := datatype.ParseDSN(c.SourceDSN, datatype.CredentialSources...)
+		if err != nil {
+			return err
+		}
+		v.Source = src
+	default:
+		return errMissingSource
+	}
+
+	if err := v.Validate(); err != nil {
+		return err
+	}
+	logging.Default().Infof("Validated %s %s", dest.Host, dest.Database)
+	return nil
+}
+
+var (
+	errMissingBlobstore = errors.New("the flag `--blobstore' is required with `--artifact'")
+	errMissingSource    = errors.New("one of the flags `--source-dsn' or `--artifact' is required")
+)
@@ -3,3 +3,8 @@ package apis
 type Migrator interface {
 	Migrate() error
 }
+
+// Canceler is implemented by migrators which can be stopped while running
+type Canceler interface {
+	Cancel()
+}
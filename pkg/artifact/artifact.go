@@ -0,0 +1,361 @@
+package artifact
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/gossion/migration-producer/pkg/blobstore"
+	"github.com/gossion/migration-producer/pkg/database"
+	"github.com/gossion/migration-producer/pkg/logging"
+	"github.com/gossion/migration-producer/pkg/metrics"
+	"github.com/gossion/migration-producer/pkg/redact"
+	"github.com/gossion/migration-producer/pkg/retry"
+)
+
+// ManifestFile is the blob describing an artifact, it is stored last so an
+// artifact without it is incomplete
+const ManifestFile = "manifest.json"
+
+// dumpFile is the name of the blob of a dump which is a single file
+const dumpFile = "dump.sql"
+
+// Manifest describes a database dump stored in a blobstore
+type Manifest struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	// Source is the DSN of the exported database, without the password
+	Source        string `json:"source"`
+	Driver        string `json:"driver"`
+	ServerVersion string `json:"server_version"`
+	Database      string `json:"database"`
+	Method        string `json:"method"`
+	// Tables maps the exported tables to their row counts
+	Tables map[string]int `json:"tables"`
+	// ApproximateCounts is set when the rows were counted after the export,
+	// without locking the source, so writes meanwhile may make the counts
+	// differ from the dump
+	ApproximateCounts bool `json:"approximate_counts,omitempty"`
+	// Directory is set when the dump is a directory of files, as exported by
+	// a database.ParallelDriver
+	Directory bool   `json:"directory"`
+	Codec     string `json:"codec"`
+	Encrypted bool   `json:"encrypted"`
+	// Charset and Collation are the conversion of the character sets of the
+	// dump, which is applied to its definitions on import
+	Charset   string `json:"charset,omitempty"`
+	Collation string `json:"collation,omitempty"`
+	Files     []File `json:"files"`
+}
+
+// File is a file of the dump
+type File struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// NewID returns a new artifact ID, sortable by creation time
+func NewID(database string, t time.Time) (string, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%s-%s", database, t.UTC().Format("20060102T150405Z"), hex.EncodeToString(suffix)), nil
+}
+
+// Upload stores the files of the dump under the artifact ID, then the
+// manifest with their checksums
+func Upload(store *url.URL, m *Manifest, dump *database.Dump, log *logging.Logger) error {
+	drv, err := blobstore.GetDriver(store.Scheme)
+	if err != nil {
+		return err
+	}
+	if err := drv.CheckDependency(); err != nil {
+		return err
+	}
+
+	files, err := dumpFiles(dump)
+	if err != nil {
+		return err
+	}
+
+	m.Directory = len(files) != 1 || files[0] != dump.Path
+	m.Codec = dump.Codec
+	m.Encrypted = dump.Encrypted
+	m.Files = nil
+	for _, name := range files {
+		blob := dumpFile
+		if m.Directory {
+			blob = filepath.Base(name)
+		}
+		log.Infof("Uploading %s to %s/%s", name, m.ID, blob)
+
+		file, err := putFile(drv, store, m.ID+"/"+blob, name)
+		countBlob("upload", err)
+		if err != nil {
+			log.Errorf("Failed to upload %s", name)
+			return err
+		}
+		file.Name = blob
+		m.Files = append(m.Files, file)
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return drv.Put(store, m.ID+"/"+ManifestFile, bytes.NewReader(data))
+}
+
+// ReadManifest reads the manifest of an artifact
+func ReadManifest(store *url.URL, id string, log *logging.Logger) (*Manifest, error) {
+	drv, err := blobstore.GetDriver(store.Scheme)
+	if err != nil {
+		return nil, err
+	}
+	if err := drv.CheckDependency(); err != nil {
+		return nil, err
+	}
+
+	r, err := drv.Get(store, id+"/"+ManifestFile)
+	if err != nil {
+		log.Errorf("Failed to get manifest of artifact %s", id)
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(r)
+	if closeErr := r.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Errorf("Failed to get manifest of artifact %s", id)
+		return nil, err
+	}
+
+	m := &Manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	if m.ID != id {
+		return nil, fmt.Errorf("manifest of artifact %s has ID %s", id, m.ID)
+	}
+	return m, nil
+}
+
+// Download fetches the files of an artifact into a temporary location,
+// verifying their checksums, and returns the dump to import
+func Download(store *url.URL, id string, log *logging.Logger) (*Manifest, *database.Dump, error) {
+	m, err := ReadManifest(store, id, log)
+	if err != nil {
+		return nil, nil, err
+	}
+	drv, _ := blobstore.GetDriver(store.Scheme) // checked by ReadManifest
+
+	dir, err := ioutil.TempDir("", "artifact-")
+	if err != nil {
+		log.Errorf("%s", err)
+		return nil, nil, err
+	}
+	log.Infof("Downloading artifact %s to %s", id, dir)
+
+	dump := &database.Dump{Path: dir, Codec: m.Codec, Encrypted: m.Encrypted}
+	for _, file := range m.Files {
+		name := filepath.Join(dir, filepath.Base(file.Name))
+		err := getFile(drv, store, id+"/"+file.Name, name, file)
+		countBlob("download", err)
+		if err != nil {
+			log.Errorf("Failed to download %s of artifact %s", file.Name, id)
+			os.RemoveAll(dir)
+			return nil, nil, err
+		}
+		dump.Size += file.Size
+		if !m.Directory {
+			dump.Path = name
+		}
+	}
+	return m, dump, nil
+}
+
+// Copy copies an artifact to another blobstore, verifying the checksums of
+// its files. The manifest is stored last, so the copy is incomplete until all
+// files are verified. The copies of the files are retried with the policy,
+// except for missing ones.
+func Copy(src, dst *url.URL, id string, policy retry.Policy, log *logging.Logger) (*Manifest, error) {
+	m, err := ReadManifest(src, id, log)
+	if err != nil {
+		return nil, err
+	}
+	srcDrv, _ := blobstore.GetDriver(src.Scheme) // checked by ReadManifest
+	dstDrv, err := blobstore.GetDriver(dst.Scheme)
+	if err != nil {
+		return nil, err
+	}
+	if err := dstDrv.CheckDependency(); err != nil {
+		return nil, err
+	}
+
+	for _, file := range m.Files {
+		key := id + "/" + file.Name
+		log.Infof("Copying %s to %s", key, redact.URL(dst))
+		err := policy.Do(log, "blob_copy", retryableCopy, func() error {
+			err := copyFile(srcDrv, src, dstDrv, dst, key, file)
+			countBlob("copy", err)
+			return err
+		})
+		if err != nil {
+			log.Errorf("Failed to copy %s of artifact %s", file.Name, id)
+			return nil, err
+		}
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	err = policy.Do(log, "blob_copy", retryableCopy, func() error {
+		return dstDrv.Put(dst, id+"/"+ManifestFile, bytes.NewReader(data))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// retryableCopy reports whether a copy may succeed if retried, the copies
+// replace the blobs so only the missing blobs are not retried
+func retryableCopy(err error) bool {
+	return !os.IsNotExist(err)
+}
+
+// copyFile streams a blob to another blobstore, verifying its size and
+// checksum
+func copyFile(srcDrv blobstore.BlobstoreDriver, src *url.URL, dstDrv blobstore.BlobstoreDriver, dst *url.URL, key string, file File) error {
+	r, err := srcDrv.Get(src, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	c := newCounter()
+	if err := dstDrv.Put(dst, key, io.TeeReader(r, c)); err != nil {
+		return err
+	}
+	if err := r.Close(); err != nil {
+		return err
+	}
+
+	if c.size != file.Size || c.sum() != file.SHA256 {
+		return fmt.Errorf("checksum mismatch of %s: %d bytes with sha256 %s, expected %d bytes with sha256 %s",
+			key, c.size, c.sum(), file.Size, file.SHA256)
+	}
+	return nil
+}
+
+// dumpFiles returns the files of a dump, sorted by name
+func dumpFiles(dump *database.Dump) ([]string, error) {
+	info, err := os.Stat(dump.Path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{dump.Path}, nil
+	}
+
+	infos, err := ioutil.ReadDir(dump.Path)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for _, info := range infos {
+		if info.Mode().IsRegular() {
+			files = append(files, filepath.Join(dump.Path, info.Name()))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// putFile uploads a file as a blob, returning its size and checksum
+func putFile(drv blobstore.BlobstoreDriver, store *url.URL, key, name string) (File, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return File{}, err
+	}
+	defer f.Close()
+
+	c := newCounter()
+	if err := drv.Put(store, key, io.TeeReader(f, c)); err != nil {
+		return File{}, err
+	}
+	return File{Size: c.size, SHA256: c.sum()}, nil
+}
+
+// getFile downloads a blob into a new file, verifying its size and checksum
+func getFile(drv blobstore.BlobstoreDriver, store *url.URL, key, name string, file File) error {
+	r, err := drv.Get(store, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	c := newCounter()
+	if _, err := io.Copy(io.MultiWriter(f, c), r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := r.Close(); err != nil {
+		return err
+	}
+
+	if c.size != file.Size || c.sum() != file.SHA256 {
+		return fmt.Errorf("checksum mismatch of %s: %d bytes with sha256 %s, expected %d bytes with sha256 %s",
+			key, c.size, c.sum(), file.Size, file.SHA256)
+	}
+	return nil
+}
+
+// countBlob counts a transferred blob in the metrics
+func countBlob(operation string, err error) {
+	result := "ok"
+	if err != nil {
+		result = "failed"
+	}
+	metrics.BlobObjects.Inc(operation, result)
+}
+
+// counter counts and hashes the bytes written
+type counter struct {
+	hash hash.Hash
+	size int64
+}
+
+func newCounter() *counter {
+	return &counter{hash: sha256.New()}
+}
+
+func (c *counter) Write(p []byte) (int, error) {
+	c.size += int64(len(p))
+	return c.hash.Write(p)
+}
+
+func (c *counter) sum() string {
+	return hex.EncodeToString(c.hash.Sum(nil))
+}
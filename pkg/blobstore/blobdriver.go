@@ -1 +1,45 @@
 package blobstore
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// BlobstoreDriver stores blobs by key under the location of a blobstore URL.
+// Keys are slash separated relative paths.
+type BlobstoreDriver interface {
+	// Check the dependencies, e.g: aws.
+	CheckDependency() error
+	// Put stores the content of the reader as the blob key, replacing it if
+	// it exists
+	Put(u *url.URL, key string, r io.Reader) error
+	// Get opens the blob key, closing it reports errors of the transfer
+	Get(u *url.URL, key string) (io.ReadCloser, error)
+}
+
+var drivers = map[string]BlobstoreDriver{}
+
+// Register driver
+func RegisterDriver(drv BlobstoreDriver, scheme string) {
+	drivers[scheme] = drv
+}
+
+// GetDriver loads a blobstore driver by name
+func GetDriver(name string) (BlobstoreDriver, error) {
+	if val, ok := drivers[name]; ok {
+		return val, nil
+	}
+
+	return nil, fmt.Errorf("unsupported blobstore: %s", name)
+}
+
+// checkKey rejects keys escaping the location of the blobstore
+func checkKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || path.Clean(key) != key || strings.HasPrefix(key, "../") || key == ".." {
+		return fmt.Errorf("invalid blob key: %q", key)
+	}
+	return nil
+}
@@ -1 +1,74 @@
 package blobstore
+
+import (
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/gossion/migration-producer/pkg/logging"
+)
+
+func init() {
+	RegisterDriver(FilesystemDriver{}, "file")
+	RegisterDriver(FilesystemDriver{}, "nfs")
+}
+
+// FilesystemDriver stores blobs as files in a directory, e.g. on a local disk
+// or a NFS mount
+type FilesystemDriver struct {
+}
+
+func (drv FilesystemDriver) CheckDependency() error {
+	return nil
+}
+
+// Put writes the blob to a temporary file renamed into place, so readers
+// never see a partial blob
+func (drv FilesystemDriver) Put(u *url.URL, key string, r io.Reader) error {
+	name, err := blobPath(u, key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		logging.Default().Errorf("%s", err)
+		return err
+	}
+	tmpfile, err := ioutil.TempFile(filepath.Dir(name), ".blob-")
+	if err != nil {
+		logging.Default().Errorf("%s", err)
+		return err
+	}
+	defer os.Remove(tmpfile.Name())
+
+	if _, err := io.Copy(tmpfile, r); err != nil {
+		tmpfile.Close()
+		return err
+	}
+	if err := tmpfile.Sync(); err != nil {
+		tmpfile.Close()
+		return err
+	}
+	if err := tmpfile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpfile.Name(), name)
+}
+
+func (drv FilesystemDriver) Get(u *url.URL, key string) (io.ReadCloser, error) {
+	name, err := blobPath(u, key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(name)
+}
+
+// blobPath returns the file of a blob
+func blobPath(u *url.URL, key string) (string, error) {
+	if err := checkKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.FromSlash(u.Path), filepath.FromSlash(key)), nil
+}
@@ -0,0 +1,75 @@
+package blobstore
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/gossion/migration-producer/pkg/logging"
+	"github.com/gossion/migration-producer/pkg/redact"
+	"github.com/gossion/migration-producer/pkg/utils"
+)
+
+func init() {
+	RegisterDriver(S3Driver{}, "s3")
+}
+
+// S3Driver stores blobs in a S3 bucket through the aws tool, with the bucket as
+// the host and the key prefix as the path of the URL, e.g.
+// s3://bucket/prefix?region=eu-west-1&endpoint=https://minio:9000. The
+// credentials come from the environment of the aws tool.
+type S3Driver struct {
+}
+
+// check if aws exists in env
+func (drv S3Driver) CheckDependency() error {
+	if _, err := exec.LookPath("aws"); err != nil {
+		logging.Default().Errorf("%s", err)
+		return err
+	}
+	return nil
+}
+
+func (drv S3Driver) Put(u *url.URL, key string, r io.Reader) error {
+	object, err := s3Object(u, key)
+	if err != nil {
+		return err
+	}
+	_, err = utils.RunCommandWithStdin("aws", r, s3Args(u, "-", object)...)
+	return err
+}
+
+func (drv S3Driver) Get(u *url.URL, key string) (io.ReadCloser, error) {
+	object, err := s3Object(u, key)
+	if err != nil {
+		return nil, err
+	}
+	return utils.CommandReader("aws", nil, s3Args(u, object, "-")...)
+}
+
+// s3Object returns the URL of the object of a blob
+func s3Object(u *url.URL, key string) (string, error) {
+	if err := checkKey(key); err != nil {
+		return "", err
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("missing bucket in blobstore URL: %s", redact.URL(u))
+	}
+	return fmt.Sprintf("s3://%s/%s", u.Host, path.Join(strings.Trim(u.Path, "/"), key)), nil
+}
+
+// s3Args returns the aws arguments copying from src to dst
+func s3Args(u *url.URL, src, dst string) []string {
+	args := []string{"s3", "cp", "--only-show-errors"}
+	q := u.Query()
+	if region := q.Get("region"); region != "" {
+		args = append(args, "--region", region)
+	}
+	if endpoint := q.Get("endpoint"); endpoint != "" {
+		args = append(args, "--endpoint-url", endpoint)
+	}
+	return append(args, src, dst)
+}
@@ -0,0 +1,130 @@
+package database
+
+import (
+	"io"
+	"strings"
+)
+
+// values of the clause of the next word
+const (
+	noClause = iota
+	charsetClause
+	collationClause
+)
+
+// charsetConverter rewrites the character sets and collations of the table
+// definitions, routines and connection settings of a SQL dump. The client
+// character set of SET NAMES and character_set_client is kept, it is the
+// encoding of the dump itself. String literals and comments are copied as is.
+type charsetConverter struct {
+	sqlStream
+
+	opts Options
+	// last bare word, upper cased
+	lastWord string
+	// clause whose value is the next word
+	clause int
+	// within a SET NAMES statement
+	names bool
+}
+
+// convertCharsetDump copies the dump from src to dst, converting the character
+// sets and collations according to the options.
+func convertCharsetDump(dst io.Writer, src io.Reader, opts Options) error {
+	cc := &charsetConverter{
+		sqlStream: newSQLStream(dst, src),
+		opts:      opts,
+	}
+	if err := cc.run(); err != nil {
+		return err
+	}
+	return cc.w.Flush()
+}
+
+func (cc *charsetConverter) run() error {
+	for {
+		c, err := cc.r.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case c == '`':
+			name, err := cc.readQuoted('`')
+			if err != nil {
+				return err
+			}
+			cc.w.WriteString(quoteIdentifier(name))
+		case c == '\'' || c == '"':
+			cc.w.WriteByte(c)
+			if err := cc.copyString(c); err != nil {
+				return err
+			}
+		case c == '#' || c == '-' && cc.startsComment():
+			cc.w.WriteByte(c)
+			if err := cc.copyLine(); err != nil {
+				return err
+			}
+		case c == '/' && cc.startsBlockComment():
+			cc.w.WriteByte(c)
+			if err := cc.copyBlockComment(); err != nil {
+				return err
+			}
+			// the value of a clause may follow, as after a space
+			continue
+		case isWordStart(c):
+			cc.r.UnreadByte()
+			word, err := cc.readWord()
+			if err != nil {
+				return err
+			}
+			cc.writeWord(word)
+			continue
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '=':
+			// the value of a clause may follow
+			cc.w.WriteByte(c)
+			continue
+		default:
+			cc.w.WriteByte(c)
+			if c == ';' {
+				cc.names = false
+			}
+		}
+		cc.lastWord = ""
+		cc.clause = noClause
+	}
+}
+
+// writeWord writes a bare word, converted if it is the value of a character
+// set or collation clause
+func (cc *charsetConverter) writeWord(word string) {
+	upper := strings.ToUpper(word)
+
+	switch cc.clause {
+	case charsetClause:
+		if upper != "DEFAULT" {
+			word = cc.opts.ConvertCharset(word)
+		}
+	case collationClause:
+		if upper != "DEFAULT" && !cc.names {
+			word = cc.opts.ConvertCollation(word)
+		}
+	}
+	cc.w.WriteString(word)
+
+	switch {
+	case upper == "NAMES":
+		cc.names = true
+		cc.clause = noClause
+	case upper == "CHARSET", upper == "SET" && cc.lastWord == "CHARACTER" && !cc.names, upper == "CHARACTER_SET_CONNECTION":
+		cc.clause = charsetClause
+	case upper == "COLLATE", upper == "COLLATION_CONNECTION":
+		cc.clause = collationClause
+	default:
+		cc.clause = noClause
+	}
+	cc.lastWord = upper
+}
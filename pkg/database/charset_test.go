@@ -0,0 +1,27 @@
+package database
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestConvertCharsetDumpComments(t *testing.T) {
+	in := "/*!40101 SET NAMES utf8 */;\n/*!40101 SET character_set_client = latin1 */;\n" +
+		"/* DEFAULT CHARSET=latin1 */\nCREATE TABLE `t` (\n  `a` varchar(8) CHARACTER SET /* x */ latin1 COLLATE latin1_bin\n" +
+		") ENGINE=InnoDB DEFAULT CHARSET=latin1 /*!50100 COLLATE latin1_swedish_ci */;\n-- CHARSET=latin1\n"
+	want := "/*!40101 SET NAMES utf8 */;\n/*!40101 SET character_set_client = latin1 */;\n" +
+		"/* DEFAULT CHARSET=latin1 */\nCREATE TABLE `t` (\n  `a` varchar(8) CHARACTER SET /* x */ utf8mb4 COLLATE utf8mb4_bin\n" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 /*!50100 COLLATE utf8mb4_unicode_ci */;\n-- CHARSET=latin1\n"
+
+	var out bytes.Buffer
+	if err := convertCharsetDump(&out, strings.NewReader(in), Options{Charset: "utf8mb4"}); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != want {
+		t.Errorf("convertCharsetDump() =\n%s\nwant\n%s", out.String(), want)
+	}
+	if err := convertCharsetDump(&out, strings.NewReader("SELECT 1 /* unterminated"), Options{Charset: "utf8mb4"}); err == nil {
+		t.Errorf("convertCharsetDump() of an unterminated comment succeeded")
+	}
+}
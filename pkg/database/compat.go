@@ -0,0 +1,242 @@
+package database
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Flavors of database servers
+const (
+	MySQL      = "mysql"
+	MariaDB    = "mariadb"
+	PostgreSQL = "postgresql"
+)
+
+// ServerInfo describes the settings of a database server which matter for
+// the compatibility of a migration
+type ServerInfo struct {
+	Version             string
+	Flavor              string
+	SQLMode             string
+	CharacterSet        string
+	Collation           string
+	LowerCaseTableNames int
+	// Engines and Collations are supported by the server
+	Engines    []string
+	Collations []string
+	// Plugins are active on the server
+	Plugins []string
+	// UsedEngines and UsedCollations are used by the tables selected by the
+	// options
+	UsedEngines    []string
+	UsedCollations []string
+	// RequiredPlugins provide the used engines
+	RequiredPlugins []string
+}
+
+// Incompatibility is a difference between servers which breaks the migration
+// when blocking, or may change its result otherwise
+type Incompatibility struct {
+	Blocking bool
+	Message  string
+}
+
+func (i Incompatibility) String() string {
+	return i.Message
+}
+
+// modes of the destination which may reject rows accepted by the source
+var strictModes = []string{"STRICT_TRANS_TABLES", "STRICT_ALL_TABLES", "NO_ZERO_DATE", "NO_ZERO_IN_DATE", "ERROR_FOR_DIVISION_BY_ZERO"}
+
+// CheckServers compares the destination server of a migration with the source
+// one. The engines, collations and plugins of the tables are only checked
+// when the options migrate the schema. Between MySQL and MariaDB, the
+// destination must be recent enough for the source version.
+func CheckServers(src, dst *ServerInfo, opts Options) []Incompatibility {
+	var incompat []Incompatibility
+	block := func(format string, args ...interface{}) {
+		incompat = append(incompat, Incompatibility{Blocking: true, Message: fmt.Sprintf(format, args...)})
+	}
+	warn := func(format string, args ...interface{}) {
+		incompat = append(incompat, Incompatibility{Message: fmt.Sprintf(format, args...)})
+	}
+
+	srcVersion, srcErr := ParseVersion(src.Version)
+	dstVersion, dstErr := ParseVersion(dst.Version)
+	switch {
+	case srcErr != nil || dstErr != nil:
+		warn("Unknown server versions %q and %q", src.Version, dst.Version)
+	case src.Flavor != dst.Flavor:
+		warn("Migrating from %s %s to %s %s", src.Flavor, src.Version, dst.Flavor, dst.Version)
+		if minimum, ok := crossFlavorMinimum(src.Flavor, srcVersion, dst.Flavor); ok && dstVersion.Less(minimum) {
+			block("Destination %s %s can not import the schema of %s %s, it needs %s %s or later",
+				dst.Flavor, dst.Version, src.Flavor, src.Version, dst.Flavor, minimum)
+		}
+	case dstVersion.Major < srcVersion.Major || dstVersion.Major == srcVersion.Major && dstVersion.Minor < srcVersion.Minor:
+		block("Destination %s %s is older than source %s", dst.Flavor, dst.Version, src.Version)
+	case dstVersion.Less(srcVersion):
+		warn("Destination %s %s is older than source %s", dst.Flavor, dst.Version, src.Version)
+	}
+
+	if !opts.NoSchema {
+		// the collations once converted by the options
+		used := make([]string, len(src.UsedCollations))
+		for i, collation := range src.UsedCollations {
+			used[i] = opts.ConvertCollation(collation)
+		}
+		if missing := missingNames(used, dst.Collations); len(missing) > 0 {
+			block("Collations not supported by destination: %s", strings.Join(missing, ", "))
+		}
+		if missing := missingNames(src.UsedEngines, dst.Engines); len(missing) > 0 {
+			block("Storage engines not supported by destination: %s", strings.Join(missing, ", "))
+		}
+		if missing := missingNames(src.RequiredPlugins, dst.Plugins); len(missing) > 0 {
+			block("Plugins not active on destination: %s", strings.Join(missing, ", "))
+		}
+	}
+
+	if src.LowerCaseTableNames != dst.LowerCaseTableNames {
+		warn("lower_case_table_names is %d on source, %d on destination", src.LowerCaseTableNames, dst.LowerCaseTableNames)
+	}
+	if opts.Charset == "" && !strings.EqualFold(src.CharacterSet, dst.CharacterSet) {
+		warn("Default character set is %s on source, %s on destination", src.CharacterSet, dst.CharacterSet)
+	}
+	srcModes := strings.Split(strings.ToUpper(src.SQLMode), ",")
+	dstModes := strings.Split(strings.ToUpper(dst.SQLMode), ",")
+	var stricter []string
+	for _, mode := range strictModes {
+		if contains(dstModes, mode) && !contains(srcModes, mode) {
+			stricter = append(stricter, mode)
+		}
+	}
+	if len(stricter) > 0 {
+		warn("sql_mode of destination adds %s", strings.Join(stricter, ","))
+	}
+
+	return incompat
+}
+
+// crossFlavorMinimums are the oldest destination versions importing the
+// schemas of sources of another flavor, from a source version on, in
+// increasing order of source versions
+var crossFlavorMinimums = []struct {
+	src, dst string
+	from     Version
+	minimum  Version
+}{
+	// the JSON type of MySQL 5.7 is an alias of LONGTEXT from MariaDB 10.2.7
+	{src: MySQL, dst: MariaDB, from: Version{5, 7, 0}, minimum: Version{10, 2, 7}},
+	// MySQL 8.0 names utf8 utf8mb3, an alias from MariaDB 10.6.1
+	{src: MySQL, dst: MariaDB, from: Version{8, 0, 0}, minimum: Version{10, 6, 1}},
+	// expression defaults of MariaDB 10.2 are accepted from MySQL 8.0.13
+	{src: MariaDB, dst: MySQL, from: Version{10, 2, 0}, minimum: Version{8, 0, 13}},
+}
+
+// crossFlavorMinimum returns the oldest destination version of a flavor
+// importing the schema of a source of another flavor, if known
+func crossFlavorMinimum(srcFlavor string, srcVersion Version, dstFlavor string) (Version, bool) {
+	var minimum Version
+	found := false
+	for _, m := range crossFlavorMinimums {
+		if m.src == srcFlavor && m.dst == dstFlavor && !srcVersion.Less(m.from) {
+			minimum, found = m.minimum, true
+		}
+	}
+	return minimum, found
+}
+
+// Version is a server version, e.g. 8.0.36
+type Version struct {
+	Major, Minor, Patch int
+}
+
+var versionPattern = regexp.MustCompile(`^(\d+)(?:\.(\d+))?(?:\.(\d+))?`)
+
+// ParseVersion parses the leading version number of a server version string,
+// e.g. 10.11.6-MariaDB-log or 15.4 (Debian 15.4-1)
+func ParseVersion(s string) (Version, error) {
+	m := versionPattern.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return Version{}, fmt.Errorf("invalid server version: %q", s)
+	}
+	var v Version
+	for i, n := range []*int{&v.Major, &v.Minor, &v.Patch} {
+		if m[i+1] != "" {
+			*n, _ = strconv.Atoi(m[i+1])
+		}
+	}
+	return v, nil
+}
+
+// Less reports whether v is older than o
+func (v Version) Less(o Version) bool {
+	if v.Major != o.Major {
+		return v.Major < o.Major
+	}
+	if v.Minor != o.Minor {
+		return v.Minor < o.Minor
+	}
+	return v.Patch < o.Patch
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// ServerFlavor returns the flavor of a server from the protocal of its driver
+// and its version
+func ServerFlavor(protocal, version string) string {
+	switch {
+	case protocal == "postgres" || protocal == "postgresql":
+		return PostgreSQL
+	case strings.Contains(strings.ToLower(version), "mariadb"):
+		return MariaDB
+	}
+	return MySQL
+}
+
+// protocalAliases maps the aliases of the protocals of the drivers to the
+// protocal of their engine
+var protocalAliases = map[string]string{
+	"postgresql": "postgres",
+}
+
+// SameEngine reports whether two protocals are served by the same engine,
+// e.g. postgres and postgresql
+func SameEngine(a, b string) bool {
+	if alias, ok := protocalAliases[a]; ok {
+		a = alias
+	}
+	if alias, ok := protocalAliases[b]; ok {
+		b = alias
+	}
+	return a == b
+}
+
+// missingNames returns the names not in available, ignoring case, or none when
+// nothing is known to be available
+func missingNames(names, available []string) []string {
+	if len(available) == 0 {
+		return nil
+	}
+	var missing []string
+	for _, name := range names {
+		if !contains(available, name) {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,126 @@
+package database
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		s    string
+		want Version
+		err  bool
+	}{
+		{s: "8.0.36", want: Version{8, 0, 36}},
+		{s: "10.11.6-MariaDB-log", want: Version{10, 11, 6}},
+		{s: "5.7.44-log", want: Version{5, 7, 44}},
+		{s: "15.4 (Debian 15.4-1)", want: Version{15, 4, 0}},
+		{s: " 16 ", want: Version{16, 0, 0}},
+		{s: "MariaDB 10.6", err: true},
+		{s: "", err: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseVersion(tt.s)
+		if tt.err {
+			if err == nil {
+				t.Errorf("ParseVersion(%q) = %s, want an error", tt.s, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseVersion(%q) = %s, %v, want %s", tt.s, got, err, tt.want)
+		}
+	}
+}
+
+func TestMissingNames(t *testing.T) {
+	tests := []struct {
+		names, available, want []string
+	}{
+		{names: []string{"InnoDB", "MyISAM"}, available: []string{"innodb", "myisam"}, want: nil},
+		{names: []string{"utf8mb4_0900_ai_ci", "ROCKSDB", "latin1_swedish_ci"}, available: []string{"latin1_swedish_ci"}, want: []string{"ROCKSDB", "utf8mb4_0900_ai_ci"}},
+		{names: []string{"InnoDB"}, available: nil, want: nil},
+		{names: nil, available: []string{"InnoDB"}, want: nil},
+	}
+	for _, tt := range tests {
+		if got := missingNames(tt.names, tt.available); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("missingNames(%v, %v) = %v, want %v", tt.names, tt.available, got, tt.want)
+		}
+	}
+}
+
+func TestCheckServers(t *testing.T) {
+	server := func(flavor, version string) *ServerInfo {
+		return &ServerInfo{Flavor: flavor, Version: version, CharacterSet: "utf8mb4", SQLMode: "STRICT_TRANS_TABLES"}
+	}
+	tests := []struct {
+		name     string
+		src, dst *ServerInfo
+		opts     Options
+		blocking []string
+		warnings []string
+	}{
+		{name: "same version", src: server(MySQL, "8.0.36"), dst: server(MySQL, "8.0.36")},
+		{name: "newer destination", src: server(MySQL, "5.7.44"), dst: server(MySQL, "8.0.36")},
+		{name: "older minor", src: server(MySQL, "8.0.36"), dst: server(MySQL, "5.7.44"), blocking: []string{"is older than source"}},
+		{name: "older patch", src: server(MySQL, "8.0.36"), dst: server(MySQL, "8.0.30"), warnings: []string{"is older than source"}},
+		{name: "unknown version", src: server(MySQL, "custom"), dst: server(MySQL, "8.0.36"), warnings: []string{"Unknown server versions"}},
+		{
+			name: "MySQL 8.0 to MariaDB 10.3", src: server(MySQL, "8.0.36"), dst: server(MariaDB, "10.3.39-MariaDB"),
+			blocking: []string{"needs mariadb 10.6.1 or later"}, warnings: []string{"Migrating from mysql"},
+		},
+		{name: "MySQL 8.0 to MariaDB 10.11", src: server(MySQL, "8.0.36"), dst: server(MariaDB, "10.11.6-MariaDB"), warnings: []string{"Migrating from mysql"}},
+		{
+			name: "MySQL 5.7 to MariaDB 10.1", src: server(MySQL, "5.7.44"), dst: server(MariaDB, "10.1.48-MariaDB"),
+			blocking: []string{"needs mariadb 10.2.7 or later"}, warnings: []string{"Migrating from mysql"},
+		},
+		{name: "MySQL 5.6 to MariaDB 10.1", src: server(MySQL, "5.6.51"), dst: server(MariaDB, "10.1.48-MariaDB"), warnings: []string{"Migrating from mysql"}},
+		{
+			name: "MariaDB 10.6 to MySQL 5.7", src: server(MariaDB, "10.6.16-MariaDB"), dst: server(MySQL, "5.7.44"),
+			blocking: []string{"needs mysql 8.0.13 or later"}, warnings: []string{"Migrating from mariadb"},
+		},
+		{
+			name: "stricter destination", src: &ServerInfo{Flavor: MySQL, Version: "8.0.36", SQLMode: ""},
+			dst: &ServerInfo{Flavor: MySQL, Version: "8.0.36", SQLMode: "STRICT_TRANS_TABLES,NO_ZERO_DATE"}, warnings: []string{"sql_mode of destination adds STRICT_TRANS_TABLES,NO_ZERO_DATE"},
+		},
+		{
+			name: "missing collation", src: &ServerInfo{Flavor: MySQL, Version: "8.0.36", UsedCollations: []string{"latin1_swedish_ci"}, UsedEngines: []string{"InnoDB"}},
+			dst:      &ServerInfo{Flavor: MySQL, Version: "8.0.36", Collations: []string{"utf8mb4_unicode_ci"}, Engines: []string{"InnoDB"}},
+			blocking: []string{"Collations not supported by destination: latin1_swedish_ci"},
+		},
+		{
+			name: "converted collation", src: &ServerInfo{Flavor: MySQL, Version: "8.0.36", UsedCollations: []string{"latin1_swedish_ci"}},
+			dst: &ServerInfo{Flavor: MySQL, Version: "8.0.36", Collations: []string{"utf8mb4_unicode_ci"}}, opts: Options{Charset: "utf8mb4"},
+		},
+		{
+			name: "collations without schema", src: &ServerInfo{Flavor: MySQL, Version: "8.0.36", UsedCollations: []string{"latin1_swedish_ci"}},
+			dst: &ServerInfo{Flavor: MySQL, Version: "8.0.36", Collations: []string{"utf8mb4_unicode_ci"}}, opts: Options{NoSchema: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var blocking, warnings []string
+			for _, i := range CheckServers(tt.src, tt.dst, tt.opts) {
+				if i.Blocking {
+					blocking = append(blocking, i.Message)
+				} else {
+					warnings = append(warnings, i.Message)
+				}
+			}
+			check := func(kind string, got, want []string) {
+				if len(got) != len(want) {
+					t.Errorf("%s = %q, want %q", kind, got, want)
+					return
+				}
+				for i := range want {
+					if !strings.Contains(got[i], want[i]) {
+						t.Errorf("%s = %q, want %q", kind, got, want)
+					}
+				}
+			}
+			check("blocking", blocking, tt.blocking)
+			check("warnings", warnings, tt.warnings)
+		})
+	}
+}
@@ -0,0 +1,29 @@
+package database
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// Converter migrates a database between two different database engines.
+type Converter interface {
+	// Convert creates the tables selected by the options in the destination,
+	// translating their definitions, and copies the rows.
+	Convert(src *url.URL, dst *url.URL, opts Options) error
+}
+
+var converters = map[string]Converter{}
+
+// RegisterConverter registers a converter between two driver schemes
+func RegisterConverter(conv Converter, from string, to string) {
+	converters[from+"->"+to] = conv
+}
+
+// GetConverter loads a converter between two driver schemes
+func GetConverter(from string, to string) (Converter, error) {
+	if val, ok := converters[from+"->"+to]; ok {
+		return val, nil
+	}
+
+	return nil, fmt.Errorf("unsupported conversion: %s to %s", from, to)
+}
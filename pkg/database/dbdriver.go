@@ -4,6 +4,8 @@ import (
 	"database/sql"
 	"fmt"
 	"net/url"
+
+	"github.com/gossion/migration-producer/pkg/retry"
 )
 
 type DatabaseDriver interface {
@@ -14,16 +16,103 @@ type DatabaseDriver interface {
 	Ping(*url.URL) error
 	// Creates a new database connection
 	Open(*url.URL) (*sql.DB, error)
-	// Dump the current database
-	Export(*url.URL) (string, error)
-	// Restore the database
-	Import(*url.URL, string) error
+	// Version returns the version of the database server
+	Version(*url.URL) (string, error)
+	// Dump the tables of the current database selected by the options
+	Export(*url.URL, Options) (*Dump, error)
+	// Restore the database from a dump file, decompressing it if needed and
+	// renaming the objects according to the options
+	Import(*url.URL, string, Options) error
 	// Lock the databases
 	Lock(*url.URL) error
 	// Unlocak the databases
 	UnLock(*url.URL) error
-	// Get a basic summary of all tables, which can be used for validation.
-	GetSum(*url.URL) (map[string]int, error)
+	// Get a basic summary of the tables selected by the options, which can be
+	// used for validation.
+	GetSum(*url.URL, Options) (map[string]int, error)
+}
+
+// ParallelDriver is implemented by drivers which can export and import the
+// tables of a database concurrently.
+type ParallelDriver interface {
+	// Dump the tables selected by the options into a directory, reading them
+	// concurrently from a consistent snapshot
+	ExportParallel(*url.URL, Options) (*Dump, error)
+	// Restore the database from a directory created by ExportParallel,
+	// loading the tables concurrently
+	ImportParallel(*url.URL, string, Options) error
+}
+
+// ChecksumDriver is implemented by drivers which can checksum the rows of
+// tables, a deeper validation than the row counts of GetSum.
+type ChecksumDriver interface {
+	// Get a checksum of the rows of each table selected by the options,
+	// without their masked columns. The checksums of the same rows only
+	// match on the same engine and version.
+	GetChecksums(*url.URL, Options) (map[string]string, error)
+}
+
+// SchemaDriver is implemented by drivers which can introspect the schema of a
+// database, e.g. to compare it with another one.
+type SchemaDriver interface {
+	// Get the schema of the tables selected by the options, with their views
+	// and triggers, and the routines of the database
+	GetSchema(*url.URL, Options) (*Schema, error)
+}
+
+// ServerInfoDriver is implemented by drivers which can describe the settings of
+// a server, to check the compatibility of a migration.
+type ServerInfoDriver interface {
+	// Get the settings of the server, with the engines and collations used by
+	// the tables selected by the options
+	GetServerInfo(*url.URL, Options) (*ServerInfo, error)
+}
+
+// CharsetDriver is implemented by drivers which can check the data of a
+// database before converting its character sets.
+type CharsetDriver interface {
+	// Get the problems of converting the tables selected by the options to
+	// the character set of the options, e.g. lossy values or keys exceeding
+	// the length limits
+	CheckCharset(*url.URL, Options) ([]string, error)
+}
+
+// LockDriver is implemented by drivers whose locks belong to a session, which
+// must be held until the database is unlocked.
+type LockDriver interface {
+	// Lock the database on a session of its own, logging with the options.
+	// The returned function unlocks it and closes the session.
+	LockSession(*url.URL, Options) (func() error, error)
+}
+
+// Lock locks the database with the driver until the returned function is
+// called, on a session of its own if the driver has sessions
+func Lock(drv DatabaseDriver, u *url.URL, opts Options) (func() error, error) {
+	if ldrv, ok := drv.(LockDriver); ok {
+		return ldrv.LockSession(u, opts)
+	}
+	if err := drv.Lock(u); err != nil {
+		return nil, err
+	}
+	return func() error { return drv.UnLock(u) }, nil
+}
+
+// RetryDriver is implemented by drivers which can tell the transient errors
+// of their operations, e.g. deadlocks or lost connections.
+type RetryDriver interface {
+	// Retryable reports whether an idempotent operation failing with the
+	// error may succeed if retried
+	Retryable(error) bool
+}
+
+// Retryable reports whether an operation of the driver failing with the error
+// may succeed if retried, only the network errors are retried for drivers
+// which can not tell
+func Retryable(drv DatabaseDriver, err error) bool {
+	if rdrv, ok := drv.(RetryDriver); ok {
+		return rdrv.Retryable(err)
+	}
+	return retry.Temporary(err)
 }
 
 var drivers = map[string]DatabaseDriver{}
@@ -0,0 +1,224 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+
+	"github.com/gossion/migration-producer/pkg/utils"
+)
+
+// Compression codecs of dump files
+const (
+	NoCompression = "none"
+	Gzip          = "gzip"
+	Zstd          = "zstd"
+)
+
+// magic bytes at the start of compressed files
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// Dump describes the output of an export
+type Dump struct {
+	// Path is the dump file, or the directory of a parallel dump
+	Path string
+	// Codec compresses the dump files, NoCompression when uncompressed
+	Codec string
+	// Encrypted is set when the dump files are encrypted
+	Encrypted bool
+	// Size is the size of the dump files
+	Size int64
+	// RawSize is the size of the dump files before compression
+	RawSize int64
+}
+
+// Remove deletes the dump file, or the directory of a parallel dump
+func (d *Dump) Remove() error {
+	return os.RemoveAll(d.Path)
+}
+
+// Ratio returns the compression ratio, the raw size divided by the size
+func (d *Dump) Ratio() float64 {
+	if d.Size == 0 {
+		return 0
+	}
+	return float64(d.RawSize) / float64(d.Size)
+}
+
+func (d *Dump) add(f *dumpFile) {
+	d.Size += f.size
+	d.RawSize += f.rawSize
+}
+
+// checkCodec verifies the codec is supported and its tool is available
+func checkCodec(codec string) error {
+	switch codec {
+	case "", NoCompression, Gzip:
+		return nil
+	case Zstd:
+		_, err := exec.LookPath("zstd")
+		return err
+	}
+	return fmt.Errorf("unsupported compression: %s", codec)
+}
+
+// dumpFile writes a dump file through a compressor and an encryptor, counting
+// the bytes
+type dumpFile struct {
+	f       *os.File
+	w       io.WriteCloser
+	enc     io.WriteCloser
+	rawSize int64
+	size    int64
+	closed  bool
+}
+
+// newDumpFile compresses what is written into f with the codec of the options,
+// then encrypts it when the options set a key
+func newDumpFile(f *os.File, opts Options) (*dumpFile, error) {
+	d := &dumpFile{f: f}
+
+	var out io.Writer = f
+	if opts.Encryption.Enabled() {
+		enc, err := newEncryptWriter(f, opts.Encryption)
+		if err != nil {
+			return nil, err
+		}
+		d.enc = enc
+		out = enc
+	}
+
+	switch codec := opts.Codec(); codec {
+	case NoCompression:
+		d.w = nopWriteCloser{out}
+	case Gzip:
+		d.w = gzip.NewWriter(out)
+	case Zstd:
+		w, err := utils.Runner{Log: opts.Log}.CommandWriter("zstd", out, "--quiet", "--stdout")
+		if err != nil {
+			return nil, err
+		}
+		d.w = w
+	default:
+		return nil, fmt.Errorf("unsupported compression: %s", codec)
+	}
+	return d, nil
+}
+
+// createDumpFile creates a new dump file compressed and encrypted as set in the
+// options
+func createDumpFile(name string, opts Options) (*dumpFile, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	d, err := newDumpFile(f, opts)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *dumpFile) Write(p []byte) (int, error) {
+	n, err := d.w.Write(p)
+	d.rawSize += int64(n)
+	return n, err
+}
+
+// Close flushes the compressor and the encryptor and closes the file, closing
+// it again is a no-op
+func (d *dumpFile) Close() error {
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+	if err := d.w.Close(); err != nil {
+		d.f.Close()
+		return err
+	}
+	if d.enc != nil {
+		if err := d.enc.Close(); err != nil {
+			d.f.Close()
+			return err
+		}
+	}
+	info, err := d.f.Stat()
+	if err != nil {
+		d.f.Close()
+		return err
+	}
+	d.size = info.Size()
+	return d.f.Close()
+}
+
+// openDumpFile opens a dump file, decrypting it with the key of enc if it is
+// encrypted, and decompressing it if it starts with the magic bytes of a
+// supported codec
+func openDumpFile(name string, enc Encryption) (io.ReadCloser, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(f)
+	magic, _ := r.Peek(len(encryptionMagic))
+	if string(magic) == encryptionMagic {
+		dr, err := newDecryptReader(r, enc)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		r = bufio.NewReader(dr)
+	}
+
+	magic, _ = r.Peek(len(zstdMagic))
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &dumpReader{Reader: gz, closers: []io.Closer{gz, f}}, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := utils.CommandReader("zstd", r, "--decompress", "--quiet", "--stdout")
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &dumpReader{Reader: zr, closers: []io.Closer{zr, f}}, nil
+	}
+	return &dumpReader{Reader: r, closers: []io.Closer{f}}, nil
+}
+
+// dumpReader reads a dump file, closing the decompressor and the file
+type dumpReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (d *dumpReader) Close() error {
+	var first error
+	for _, c := range d.closers {
+		if err := c.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
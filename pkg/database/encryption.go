@@ -0,0 +1,308 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// Encrypted dump files start with a header, followed by chunks of at most
+// encryptionChunkSize bytes sealed with AES-256-GCM. Each chunk is prefixed
+// with its sealed length, its nonce is the nonce prefix of the header, the
+// chunk counter and a flag marking the last chunk, so chunks cannot be
+// reordered, dropped or truncated without failing the authentication. The
+// header is authenticated as additional data of every chunk.
+//
+// header: magic (6) | key mode (1) | PBKDF2 iterations (4) | salt (16) | nonce prefix (7)
+const (
+	encryptionMagic     = "MPENC\x01"
+	encryptionChunkSize = 64 * 1024
+	encryptionHeaderLen = len(encryptionMagic) + 1 + 4 + 16 + 7
+	pbkdf2Iterations    = 600000
+	// maxPBKDF2Iterations bounds the iterations read from the header, a
+	// crafted dump would derive its key for hours otherwise
+	maxPBKDF2Iterations = 10 * pbkdf2Iterations
+)
+
+// how the key of an encrypted dump is obtained
+const (
+	keyFromFile       = 1
+	keyFromPassphrase = 2
+)
+
+// Encryption configures the authenticated encryption of dump files. Either
+// a key file or a passphrase is set, or none to leave the dumps in plaintext.
+type Encryption struct {
+	// KeyFile holds a 256 bit key, raw or encoded in hex or base64
+	KeyFile string
+	// Passphrase derives the key with PBKDF2-SHA256 and a random salt
+	Passphrase string
+}
+
+// Enabled reports whether dumps are encrypted
+func (e Encryption) Enabled() bool {
+	return e.KeyFile != "" || e.Passphrase != ""
+}
+
+// Validate checks that at most one key source is set and the key file is
+// readable
+func (e Encryption) Validate() error {
+	if e.KeyFile != "" && e.Passphrase != "" {
+		return errors.New("encryption key file and passphrase are mutually exclusive")
+	}
+	if e.KeyFile != "" {
+		_, err := readKeyFile(e.KeyFile)
+		return err
+	}
+	return nil
+}
+
+func (e Encryption) mode() byte {
+	if e.KeyFile != "" {
+		return keyFromFile
+	}
+	return keyFromPassphrase
+}
+
+// key returns the AES key for the key mode of a dump header
+func (e Encryption) key(mode byte, iterations int, salt []byte) ([]byte, error) {
+	switch mode {
+	case keyFromFile:
+		if e.KeyFile == "" {
+			return nil, errors.New("dump is encrypted with a key file, an encryption key file is required")
+		}
+		return readKeyFile(e.KeyFile)
+	case keyFromPassphrase:
+		if e.Passphrase == "" {
+			return nil, errors.New("dump is encrypted with a passphrase, an encryption passphrase is required")
+		}
+		return pbkdf2SHA256([]byte(e.Passphrase), salt, iterations, 32), nil
+	}
+	return nil, fmt.Errorf("unsupported encryption key mode: %d", mode)
+}
+
+// readKeyFile reads a 256 bit key, raw or encoded in hex or base64
+func readKeyFile(name string) ([]byte, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 32 {
+		return data, nil
+	}
+	text := string(bytes.TrimSpace(data))
+	if key, err := hex.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, fmt.Errorf("encryption key file %s does not hold a 256 bit key", name)
+}
+
+// encryptWriter seals what is written in chunks
+type encryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	header  []byte
+	counter uint32
+	buf     []byte
+}
+
+// newEncryptWriter writes the header and returns a writer sealing chunks into
+// w. Close seals the last chunk, it does not close w.
+func newEncryptWriter(w io.Writer, e Encryption) (io.WriteCloser, error) {
+	header := make([]byte, encryptionHeaderLen)
+	copy(header, encryptionMagic)
+	header[len(encryptionMagic)] = e.mode()
+	binary.BigEndian.PutUint32(header[len(encryptionMagic)+1:], pbkdf2Iterations)
+	if _, err := io.ReadFull(rand.Reader, header[len(encryptionMagic)+5:]); err != nil {
+		return nil, err
+	}
+
+	salt := header[len(encryptionMagic)+5 : len(encryptionMagic)+21]
+	key, err := e.key(e.mode(), pbkdf2Iterations, salt)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: aead, header: header}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	e.buf = append(e.buf, p...)
+	// keep a chunk buffered, the last chunk is sealed on close
+	for len(e.buf) > encryptionChunkSize {
+		if err := e.seal(e.buf[:encryptionChunkSize], false); err != nil {
+			return 0, err
+		}
+		e.buf = e.buf[encryptionChunkSize:]
+	}
+	return len(p), nil
+}
+
+func (e *encryptWriter) Close() error {
+	return e.seal(e.buf, true)
+}
+
+func (e *encryptWriter) seal(chunk []byte, last bool) error {
+	nonce := chunkNonce(e.header, e.counter, last)
+	e.counter++
+	sealed := e.aead.Seal(nil, nonce, chunk, e.header)
+
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(sealed)))
+	if _, err := e.w.Write(length[:]); err != nil {
+		return err
+	}
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+// decryptReader opens the chunks of an encrypted dump
+type decryptReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	header  []byte
+	counter uint32
+	buf     []byte
+	done    bool
+}
+
+// newDecryptReader reads the header of an encrypted dump from r and returns a
+// reader of the plaintext
+func newDecryptReader(r *bufio.Reader, e Encryption) (io.Reader, error) {
+	header := make([]byte, encryptionHeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if string(header[:len(encryptionMagic)]) != encryptionMagic {
+		return nil, errors.New("not an encrypted dump")
+	}
+
+	mode := header[len(encryptionMagic)]
+	iterations := binary.BigEndian.Uint32(header[len(encryptionMagic)+1:])
+	if iterations == 0 || iterations > maxPBKDF2Iterations {
+		return nil, fmt.Errorf("encrypted dump has an invalid PBKDF2 iteration count: %d", iterations)
+	}
+	salt := header[len(encryptionMagic)+5 : len(encryptionMagic)+21]
+	key, err := e.key(mode, int(iterations), salt)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{r: r, aead: aead, header: header}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// open reads and opens the next chunk, it is the last one if the stream ends
+// after it
+func (d *decryptReader) open() error {
+	var length [4]byte
+	if _, err := io.ReadFull(d.r, length[:]); err != nil {
+		return unexpectedEOF(err)
+	}
+	n := binary.BigEndian.Uint32(length[:])
+	if n > encryptionChunkSize+uint32(d.aead.Overhead()) {
+		return errors.New("encrypted dump is corrupted")
+	}
+	sealed := make([]byte, n)
+	if _, err := io.ReadFull(d.r, sealed); err != nil {
+		return unexpectedEOF(err)
+	}
+
+	_, err := d.r.Peek(1)
+	last := err == io.EOF
+	chunk, err := d.aead.Open(sealed[:0], chunkNonce(d.header, d.counter, last), sealed, d.header)
+	if err != nil {
+		return errors.New("encrypted dump is corrupted or the key is wrong")
+	}
+	d.counter++
+	d.buf = chunk
+	d.done = last
+	return nil
+}
+
+// chunkNonce returns the nonce of a chunk: the nonce prefix of the header,
+// the chunk counter and the last chunk flag
+func chunkNonce(header []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, header[encryptionHeaderLen-7:])
+	binary.BigEndian.PutUint32(nonce[7:], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// pbkdf2SHA256 derives a key from a password as specified by RFC 8018
+func pbkdf2SHA256(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLen := prf.Size()
+	blocks := (keyLen + hashLen - 1) / hashLen
+
+	var index [4]byte
+	dk := make([]byte, 0, blocks*hashLen)
+	u := make([]byte, hashLen)
+	for block := 1; block <= blocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(index[:], uint32(block))
+		prf.Write(index[:])
+		dk = prf.Sum(dk)
+		t := dk[len(dk)-hashLen:]
+		copy(u, t)
+
+		for n := 2; n <= iterations; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for i := range u {
+				t[i] ^= u[i]
+			}
+		}
+	}
+	return dk[:keyLen]
+}
@@ -0,0 +1,47 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func encrypt(t *testing.T, e Encryption, plaintext []byte) []byte {
+	var buf bytes.Buffer
+	w, err := newEncryptWriter(&buf, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecryptIterations(t *testing.T) {
+	e := Encryption{Passphrase: "correct horse"}
+	sealed := encrypt(t, e, []byte("INSERT INTO orders VALUES (1);\n"))
+
+	r, err := newDecryptReader(bufio.NewReader(bytes.NewReader(sealed)), e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext, err := ioutil.ReadAll(r); err != nil || string(plaintext) != "INSERT INTO orders VALUES (1);\n" {
+		t.Errorf("decrypted %q, %v", plaintext, err)
+	}
+
+	for _, iterations := range []uint32{0, maxPBKDF2Iterations + 1, 1<<32 - 1} {
+		crafted := append([]byte(nil), sealed...)
+		binary.BigEndian.PutUint32(crafted[len(encryptionMagic)+1:], iterations)
+		_, err := newDecryptReader(bufio.NewReader(bytes.NewReader(crafted)), e)
+		if err == nil || !strings.Contains(err.Error(), "iteration count") {
+			t.Errorf("newDecryptReader() with %d iterations = %v, want an error", iterations, err)
+		}
+	}
+}
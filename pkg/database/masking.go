@@ -0,0 +1,301 @@
+package database
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Masking rules of a column
+const (
+	// MaskHash replaces values with their keyed hash, equal values get equal
+	// hashes so joins and foreign keys still match
+	MaskHash = "hash"
+	// MaskNull replaces values with NULL
+	MaskNull = "null"
+	// MaskEmail replaces values with a fake email address derived from their
+	// hash
+	MaskEmail = "email"
+	// MaskFormat replaces the letters and digits of values with other ones
+	// derived from their hash, keeping the case, number of characters and
+	// punctuation
+	MaskFormat = "format"
+	// MaskConstant replaces values with a constant, written constant:value
+	MaskConstant = "constant"
+)
+
+// MaskRule is the masking of a column
+type MaskRule struct {
+	Kind string
+	// Value is the replacement of the constant rule
+	Value string
+}
+
+// ParseMaskRule parses a rule, e.g. hash or constant:REDACTED
+func ParseMaskRule(s string) (MaskRule, error) {
+	kind, value := s, ""
+	i := strings.IndexByte(s, ':')
+	if i >= 0 {
+		kind, value = s[:i], s[i+1:]
+	}
+	rule := MaskRule{Kind: strings.ToLower(strings.TrimSpace(kind)), Value: value}
+	switch rule.Kind {
+	case MaskHash, MaskNull, MaskEmail, MaskFormat:
+		if i >= 0 {
+			return rule, fmt.Errorf("masking rule %s takes no value", rule.Kind)
+		}
+	case MaskConstant:
+		if i < 0 {
+			return rule, errors.New("masking rule constant needs a value, as constant:value")
+		}
+	default:
+		return rule, fmt.Errorf("unknown masking rule: %s", s)
+	}
+	return rule, nil
+}
+
+// Keyed reports whether the rule derives the values from their keyed hash,
+// without a key the hashes of guessable values, e.g. emails, are reversible
+func (r MaskRule) Keyed() bool {
+	return r.Kind == MaskHash || r.Kind == MaskEmail || r.Kind == MaskFormat
+}
+
+// MaskedColumnsOnly returns a copy of the options naming the masked columns
+// without masking them, e.g. to validate a masked migration without its key
+func (o Options) MaskedColumnsOnly() Options {
+	masks := make(map[string]string, len(o.Masks))
+	for column := range o.Masks {
+		masks[column] = MaskNull
+	}
+	o.Masks = masks
+	return o
+}
+
+// splitMaskedColumn splits a masked column, as table.column
+func splitMaskedColumn(s string) (string, string, error) {
+	i := strings.IndexByte(s, '.')
+	if i <= 0 || i == len(s)-1 {
+		return "", "", fmt.Errorf("invalid masked column %q, expected table.column", s)
+	}
+	return s[:i], s[i+1:], nil
+}
+
+// maskedColumns returns the rules of the masked columns of table by column
+// name, a table of the destination when the options are for it. The options
+// are validated beforehand.
+func (o Options) maskedColumns(table string) map[string]MaskRule {
+	if o.destination {
+		table = o.SourceTable(table)
+	}
+	var rules map[string]MaskRule
+	for column, s := range o.Masks {
+		t, c, err := splitMaskedColumn(column)
+		if err != nil || t != table {
+			continue
+		}
+		rule, err := ParseMaskRule(s)
+		if err != nil {
+			continue
+		}
+		if rules == nil {
+			rules = map[string]MaskRule{}
+		}
+		rules[c] = rule
+	}
+	return rules
+}
+
+// checkMasks checks the masking rules against the selected tables of a
+// schema before any row is read
+func checkMasks(tables []Table, opts Options) error {
+	found := map[string]bool{}
+	for _, t := range tables {
+		if _, err := newMasker(t.Name, t.Columns, opts); err != nil {
+			return err
+		}
+		found[t.Name] = true
+	}
+	for column := range opts.Masks {
+		table, _, err := splitMaskedColumn(column)
+		if err != nil {
+			return err
+		}
+		if !found[table] && opts.MatchTable(table) {
+			return fmt.Errorf("masked table %s does not exist", table)
+		}
+	}
+	return nil
+}
+
+// masker masks the values of a row, read in the text protocol
+type masker struct {
+	key     []byte
+	rules   []*MaskRule
+	columns []Column
+}
+
+// newMasker returns the masker of the columns of a table, or nil when none of
+// them is masked
+func newMasker(table string, columns []Column, opts Options) (*masker, error) {
+	rules := opts.maskedColumns(table)
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	m := &masker{key: []byte(opts.MaskKey), rules: make([]*MaskRule, len(columns)), columns: columns}
+	for i, c := range columns {
+		rule, ok := rules[c.Name]
+		if !ok {
+			continue
+		}
+		if rule.Kind == MaskHash && c.CharacterSet == "" && !isBinaryType(c.DataType) {
+			return nil, fmt.Errorf("masking rule hash of %s.%s needs a text or binary column, use format", table, c.Name)
+		}
+		// a truncated address would not be one anymore
+		if n := charLength(c.ColumnType); rule.Kind == MaskEmail && n > 0 && n < int64(len(fakeEmail(nil))) {
+			return nil, fmt.Errorf("masking rule email of %s.%s needs a column of at least %d characters, use hash or format", table, c.Name, len(fakeEmail(nil)))
+		}
+		// numbers are written as is in the dump
+		if _, err := strconv.ParseFloat(rule.Value, 64); rule.Kind == MaskConstant && isNumericType(c.DataType) && err != nil {
+			return nil, fmt.Errorf("masking constant of %s.%s is not a number: %q", table, c.Name, rule.Value)
+		}
+		m.rules[i] = &rule
+		delete(rules, c.Name)
+	}
+	if len(rules) > 0 {
+		var missing []string
+		for column := range rules {
+			missing = append(missing, table+"."+column)
+		}
+		sort.Strings(missing)
+		return nil, fmt.Errorf("masked columns do not exist: %s", strings.Join(missing, ", "))
+	}
+	return m, nil
+}
+
+// mask replaces the values of the masked columns, NULL values are kept
+func (m *masker) mask(values []sql.RawBytes) {
+	for i, rule := range m.rules {
+		if rule == nil || values[i] == nil {
+			continue
+		}
+		switch rule.Kind {
+		case MaskNull:
+			values[i] = nil
+		case MaskConstant:
+			values[i] = sql.RawBytes(rule.Value)
+		case MaskHash:
+			values[i] = m.hash(values[i], m.columns[i])
+		case MaskEmail:
+			sum := m.sum(values[i], 0)
+			values[i] = sql.RawBytes(fakeEmail(sum))
+		case MaskFormat:
+			values[i] = m.format(values[i])
+		}
+	}
+}
+
+// fakeEmail returns the fake address of a hash, always of the same length
+func fakeEmail(sum []byte) string {
+	id := make([]byte, 6)
+	copy(id, sum)
+	return "user" + hex.EncodeToString(id) + "@example.com"
+}
+
+// sum returns the keyed hash of a value, the counter derives more bytes from
+// the same value
+func (m *masker) sum(v []byte, counter uint32) []byte {
+	mac := hmac.New(sha256.New, m.key)
+	mac.Write(v)
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], counter)
+	mac.Write(b[:])
+	return mac.Sum(nil)
+}
+
+// hash returns the hash of a value in hex, or raw for binary columns,
+// truncated to the length of fixed and variable length columns
+func (m *masker) hash(v []byte, c Column) []byte {
+	sum := m.sum(v, 0)
+	h := []byte(hex.EncodeToString(sum))
+	if isBinaryType(c.DataType) {
+		h = sum
+	}
+	if n := charLength(c.ColumnType); n > 0 && int64(len(h)) > n {
+		h = h[:n]
+	}
+	return h
+}
+
+// format replaces every letter and digit of a value with another one of the
+// same class: upper or lower case letters, other letters of the same script
+// for CJK and Hangul, and digits. Other characters and invalid UTF-8 are
+// kept. A replacement is never longer in bytes than the original.
+func (m *masker) format(v []byte) []byte {
+	masked := make([]byte, 0, len(v))
+	var stream []byte
+	var counter uint32
+	var buf [utf8.UTFMax]byte
+	// next returns a number derived from the hash of the value below n
+	next := func(n int) int {
+		if len(stream) < 2 {
+			stream = m.sum(v, counter)
+			counter++
+		}
+		r := int(binary.BigEndian.Uint16(stream))
+		stream = stream[2:]
+		return r % n
+	}
+	for i := 0; i < len(v); {
+		r, size := utf8.DecodeRune(v[i:])
+		if r == utf8.RuneError && size <= 1 {
+			masked = append(masked, v[i])
+			i++
+			continue
+		}
+		i += size
+		switch {
+		case unicode.IsDigit(r):
+			r = rune('0' + next(10))
+		case unicode.IsUpper(r):
+			r = rune('A' + next(26))
+		case unicode.IsLower(r):
+			r = rune('a' + next(26))
+		case unicode.Is(unicode.Han, r):
+			r = rune(0x4E00 + next(0x9FA5-0x4E00+1))
+		case unicode.Is(unicode.Hangul, r) && r >= 0xAC00 && r <= 0xD7A3:
+			r = rune(0xAC00 + next(0xD7A3-0xAC00+1))
+		case unicode.IsLetter(r):
+			// e.g. kana or Arabic, neither upper nor lower case
+			r = rune('a' + next(26))
+		}
+		n := utf8.EncodeRune(buf[:], r)
+		masked = append(masked, buf[:n]...)
+	}
+	return masked
+}
+
+func isBinaryType(dataType string) bool {
+	switch strings.ToLower(dataType) {
+	case "binary", "varbinary", "tinyblob", "blob", "mediumblob", "longblob":
+		return true
+	}
+	return false
+}
+
+func isNumericType(dataType string) bool {
+	switch strings.ToLower(dataType) {
+	case "tinyint", "smallint", "mediumint", "int", "bigint", "decimal", "float", "double", "year":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,221 @@
+package database
+
+import (
+	"database/sql"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode"
+	"unicode/utf8"
+)
+
+func TestParseMaskRule(t *testing.T) {
+	tests := []struct {
+		rule string
+		want MaskRule
+		err  bool
+	}{
+		{rule: "hash", want: MaskRule{Kind: MaskHash}},
+		{rule: " Email ", want: MaskRule{Kind: MaskEmail}},
+		{rule: "null", want: MaskRule{Kind: MaskNull}},
+		{rule: "format", want: MaskRule{Kind: MaskFormat}},
+		{rule: "constant:REDACTED", want: MaskRule{Kind: MaskConstant, Value: "REDACTED"}},
+		{rule: "constant:a:b", want: MaskRule{Kind: MaskConstant, Value: "a:b"}},
+		{rule: "constant:", want: MaskRule{Kind: MaskConstant}},
+		{rule: "constant", err: true},
+		{rule: "hash:x", err: true},
+		{rule: "shuffle", err: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseMaskRule(tt.rule)
+		if tt.err {
+			if err == nil {
+				t.Errorf("ParseMaskRule(%q) = %+v, want an error", tt.rule, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseMaskRule(%q) = %+v, %v, want %+v", tt.rule, got, err, tt.want)
+		}
+	}
+}
+
+func TestValidateMaskKey(t *testing.T) {
+	for _, rule := range []string{"hash", "email", "format"} {
+		opts := Options{Masks: map[string]string{"users.email": rule}}
+		if err := opts.Validate(); err == nil {
+			t.Errorf("Validate() of rule %s without a key succeeded", rule)
+		}
+		opts.MaskKey = "secret"
+		if err := opts.Validate(); err != nil {
+			t.Errorf("Validate() of rule %s = %v", rule, err)
+		}
+		if err := (Options{Masks: opts.Masks}).MaskedColumnsOnly().Validate(); err != nil {
+			t.Errorf("Validate() of the masked columns of rule %s = %v", rule, err)
+		}
+	}
+	for _, rule := range []string{"null", "constant:x"} {
+		opts := Options{Masks: map[string]string{"users.email": rule}}
+		if err := opts.Validate(); err != nil {
+			t.Errorf("Validate() of rule %s without a key = %v", rule, err)
+		}
+	}
+}
+
+var maskedColumns = []Column{
+	{Name: "id", DataType: "int", ColumnType: "int(11)"},
+	{Name: "email", DataType: "varchar", ColumnType: "varchar(255)", CharacterSet: "utf8mb4"},
+	{Name: "name", DataType: "varchar", ColumnType: "varchar(64)", CharacterSet: "utf8mb4"},
+	{Name: "token", DataType: "char", ColumnType: "char(8)", CharacterSet: "ascii"},
+	{Name: "secret", DataType: "varbinary", ColumnType: "varbinary(16)"},
+	{Name: "note", DataType: "text", ColumnType: "text", CharacterSet: "utf8mb4"},
+}
+
+func newTestMasker(t *testing.T, key string, masks map[string]string) *masker {
+	m, err := newMasker("users", maskedColumns, Options{Masks: masks, MaskKey: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func row(values ...string) []sql.RawBytes {
+	raw := make([]sql.RawBytes, len(values))
+	for i, v := range values {
+		if v != "NULL" {
+			raw[i] = sql.RawBytes(v)
+		}
+	}
+	return raw
+}
+
+func TestMask(t *testing.T) {
+	masks := map[string]string{
+		"users.email":  "email",
+		"users.name":   "format",
+		"users.token":  "hash",
+		"users.secret": "null",
+		"users.note":   "constant:REDACTED",
+		"orders.email": "null",
+	}
+	m := newTestMasker(t, "secret", masks)
+	values := row("1", "ada@example.org", "Ada Lovelace-1815", "NULL", "\x00\x01", "notes")
+	m.mask(values)
+
+	if string(values[0]) != "1" {
+		t.Errorf("id = %q, want it unmasked", values[0])
+	}
+	if email := string(values[1]); !strings.HasPrefix(email, "user") || !strings.HasSuffix(email, "@example.com") || len(email) != 28 {
+		t.Errorf("email = %q, want a fake address", email)
+	}
+	if name := string(values[2]); len(name) != len("Ada Lovelace-1815") || name[3] != ' ' || name[12] != '-' || name == "Ada Lovelace-1815" {
+		t.Errorf("name = %q, want the format kept", name)
+	}
+	if values[3] != nil {
+		t.Errorf("token = %q, want NULL kept", values[3])
+	}
+	if values[4] != nil {
+		t.Errorf("secret = %q, want NULL", values[4])
+	}
+	if string(values[5]) != "REDACTED" {
+		t.Errorf("note = %q, want the constant", values[5])
+	}
+}
+
+func TestMaskDeterministic(t *testing.T) {
+	masks := map[string]string{"users.token": "hash", "users.name": "format", "users.email": "email"}
+	mask := func(key, token, name, email string) []sql.RawBytes {
+		values := row("1", email, name, token, "NULL", "NULL")
+		newTestMasker(t, key, masks).mask(values)
+		return values
+	}
+
+	a := mask("k1", "abcdef12", "Grace Hopper", "grace@example.org")
+	b := mask("k1", "abcdef12", "Grace Hopper", "grace@example.org")
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("masked the same values as %q and %q", a, b)
+	}
+	if len(a[3]) != 8 {
+		t.Errorf("hash = %q, want it truncated to char(8)", a[3])
+	}
+
+	c := mask("k2", "abcdef12", "Grace Hopper", "grace@example.org")
+	for i := 1; i <= 3; i++ {
+		if string(a[i]) == string(c[i]) {
+			t.Errorf("column %d masked alike with another key: %q", i, a[i])
+		}
+	}
+	d := mask("k1", "abcdef13", "Grace Hoppes", "grace@example.com")
+	for i := 1; i <= 3; i++ {
+		if string(a[i]) == string(d[i]) {
+			t.Errorf("column %d masked another value alike: %q", i, a[i])
+		}
+	}
+}
+
+func TestMaskFormatUnicode(t *testing.T) {
+	m := newTestMasker(t, "secret", map[string]string{"users.name": "format"})
+	for _, name := range []string{"Zoë Çelik", "Дмитрий Иванов", "李小龍", "김민준", "Ａｂｃ ١٢٣"} {
+		masked := m.format([]byte(name))
+		if !utf8.Valid(masked) {
+			t.Errorf("format(%q) = %q, invalid UTF-8", name, masked)
+			continue
+		}
+		if string(masked) == name || len(masked) > len(name) {
+			t.Errorf("format(%q) = %q, want it masked and not longer in bytes", name, masked)
+		}
+		want, got := []rune(name), []rune(string(masked))
+		if len(got) != len(want) {
+			t.Errorf("format(%q) = %q, want %d characters", name, masked, len(want))
+			continue
+		}
+		for i := range want {
+			if unicode.IsLetter(want[i]) || unicode.IsDigit(want[i]) {
+				if unicode.IsUpper(want[i]) != unicode.IsUpper(got[i]) || unicode.IsDigit(want[i]) != unicode.IsDigit(got[i]) {
+					t.Errorf("format(%q) = %q, changed the class of %q to %q", name, masked, want[i], got[i])
+				}
+				if unicode.Is(unicode.Han, want[i]) != unicode.Is(unicode.Han, got[i]) || unicode.Is(unicode.Hangul, want[i]) != unicode.Is(unicode.Hangul, got[i]) {
+					t.Errorf("format(%q) = %q, changed the script of %q to %q", name, masked, want[i], got[i])
+				}
+			} else if got[i] != want[i] {
+				t.Errorf("format(%q) = %q, changed %q", name, masked, want[i])
+			}
+		}
+	}
+	if masked := m.format([]byte("ab\xffcd")); masked[2] != 0xff {
+		t.Errorf("format() = %q, want invalid UTF-8 kept", masked)
+	}
+}
+
+func TestNewMaskerErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		masks map[string]string
+	}{
+		{"hash of a number", map[string]string{"users.id": "hash"}},
+		{"constant of a number", map[string]string{"users.id": "constant:x"}},
+		{"email of a short column", map[string]string{"users.token": "email"}},
+		{"missing column", map[string]string{"users.phone": "null"}},
+	}
+	for _, tt := range tests {
+		if _, err := newMasker("users", maskedColumns, Options{Masks: tt.masks, MaskKey: "k"}); err == nil {
+			t.Errorf("%s: newMasker() succeeded", tt.name)
+		}
+	}
+	if m, err := newMasker("orders", maskedColumns, Options{Masks: map[string]string{"users.id": "null"}}); m != nil || err != nil {
+		t.Errorf("newMasker() of a table without masks = %v, %v", m, err)
+	}
+}
+
+func TestMaskedColumnsOfDestination(t *testing.T) {
+	opts := Options{
+		Masks:        map[string]string{"users.email": "null"},
+		RenameTables: map[string]string{"users": "customers"},
+	}
+	if rules := opts.ForDestination().maskedColumns("customers"); len(rules) != 1 {
+		t.Errorf("masked columns of the renamed table = %v", rules)
+	}
+	if rules := opts.maskedColumns("customers"); len(rules) != 0 {
+		t.Errorf("masked columns of a source table named like the destination = %v", rules)
+	}
+}
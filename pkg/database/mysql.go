@@ -1,18 +1,23 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
+	"net"
 	"net/url"
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
 
 	_ "github.com/go-sql-driver/mysql" // mysql driver for database/sql
-	"github.com/gossion/migration-producer/pkg/utils"
+	"github.com/gossion/migration-producer/pkg/datatype"
+	"github.com/gossion/migration-producer/pkg/logging"
+	"github.com/gossion/migration-producer/pkg/redact"
 )
 
 func init() {
@@ -23,177 +28,361 @@ func init() {
 type MySQLDriver struct {
 }
 
+// log returns the logger of the options with the driver field
+func (drv MySQLDriver) log(opts Options) *logging.Logger {
+	return opts.Log.With("driver", "mysql")
+}
+
 // check if mysql, mysqldump exist in env
 func (drv MySQLDriver) CheckDependency() error {
 	cmds := []string{"mysql", "mysqldump"}
-	log.Printf("Checking cmd dependency: %s", cmds)
+	log := drv.log(Options{})
+	log.Debugf("Checking cmd dependency: %s", cmds)
 
 	for _, cmd := range cmds {
 		if _, err := exec.LookPath(cmd); err != nil {
-			log.Println(err)
+			log.Errorf("%s", err)
 			return err
 		}
 	}
 	return nil
 }
 
-func (drv MySQLDriver) Ping(u *url.URL) error {
+func (drv MySQLDriver) Ping(u *url.URL) (err error) {
 	db, err := drv.openRootDB(u)
 	if err != nil {
 		return err
 	}
-	defer mustClose(db)
+	defer closeErr(db, &err)
 
 	return db.Ping()
 }
 
 func (drv MySQLDriver) Open(u *url.URL) (*sql.DB, error) {
-	return sql.Open("mysql", normalizeMySQLURL(u))
+	return openMySQL(u)
 }
 
-func (drv MySQLDriver) Export(u *url.URL) (string, error) {
-	tmpfile, err := ioutil.TempFile("", "mysql-")
+func (drv MySQLDriver) Version(u *url.URL) (_ string, err error) {
+	db, err := drv.openRootDB(u)
 	if err != nil {
-		log.Println(err)
 		return "", err
 	}
-	defer tmpfile.Close()
+	defer closeErr(db, &err)
+
+	var version string
+	err = db.QueryRow("SELECT VERSION()").Scan(&version)
+	return version, err
+}
 
-	log.Printf("Will export mysql db to file: %s", tmpfile.Name())
+func (drv MySQLDriver) Export(u *url.URL, opts Options) (_ *Dump, err error) {
+	if err := checkCodec(opts.Compression); err != nil {
+		return nil, err
+	}
+	if len(opts.Masks) > 0 && !opts.NoData {
+		return nil, errors.New("Masking columns is not supported by mysqldump, use the parallel method")
+	}
 
-	args := mysqldumpArgs(u)
-	output, err := utils.RunCommandOutTOFile("mysqldump", tmpfile, args...)
+	runs, err := drv.dumpRuns(u, opts)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	f, err := os.Stat(tmpfile.Name())
+	log := drv.log(opts)
+	tmpfile, err := ioutil.TempFile("", "mysql-")
 	if err != nil {
-		log.Printf("Error stat of exported file: %s", err)
-		return "", err
+		log.Errorf("%s", err)
+		return nil, err
 	}
-	if f.Size() == 0 {
-		log.Printf("Nothing was exported to file: %s", tmpfile.Name())
-		return "", errors.New("Nothing exported")
+	defer tmpfile.Close()
+	// a failed export leaves no partial dump behind
+	defer func() {
+		if err != nil {
+			os.Remove(tmpfile.Name())
+		}
+	}()
+
+	log.Infof("Will export mysql db to file: %s", tmpfile.Name())
+
+	out, err := newDumpFile(tmpfile, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := drv.dump(u, opts, runs, out); err != nil {
+		out.Close()
+		return nil, err
+	}
+	if err := out.Close(); err != nil {
+		log.Errorf("Error closing exported file: %s", err)
+		return nil, err
 	}
 
-	log.Printf("mysqldump output: %s", output)
-	return tmpfile.Name(), nil
+	if out.rawSize == 0 {
+		log.Errorf("Nothing was exported to file: %s", tmpfile.Name())
+		return nil, errors.New("Nothing exported")
+	}
+
+	dump := &Dump{Path: tmpfile.Name(), Codec: opts.Codec(), Encrypted: opts.Encryption.Enabled()}
+	dump.add(out)
+	return dump, nil
 }
 
-func (drv MySQLDriver) Import(u *url.URL, filename string) error {
+func (drv MySQLDriver) Import(u *url.URL, filename string, opts Options) error {
 	if err := drv.CreateDbIfNotExists(u); err != nil {
-		log.Println(err)
+		drv.log(opts).Errorf("%s", err)
 		return err
 	}
 
-	log.Printf("Will import mysql db from file: %s", filename)
+	return drv.importFile(u, filename, opts)
+}
 
-	f, err := os.Open(filename)
-	if err != nil {
-		log.Println("Failed to open file", filename)
-		return err
-	}
-	args := mysqlArgs(u)
-	_, err = utils.RunCommandWithStdin("mysql", f, args...)
+// locks are the unlock functions of the databases locked by Lock, by URL
+var (
+	locksMu sync.Mutex
+	locks   = map[string]func() error{}
+)
+
+// Lock locks the database until UnLock, on a connection held meanwhile
+func (drv MySQLDriver) Lock(u *url.URL) error {
+	unlock, err := drv.LockSession(u, Options{})
 	if err != nil {
 		return err
 	}
-
+	locksMu.Lock()
+	defer locksMu.Unlock()
+	locks[u.String()] = unlock
 	return nil
 }
 
-func (drv MySQLDriver) Lock(u *url.URL) error {
+func (drv MySQLDriver) UnLock(u *url.URL) error {
+	locksMu.Lock()
+	unlock, ok := locks[u.String()]
+	delete(locks, u.String())
+	locksMu.Unlock()
+	if !ok {
+		return fmt.Errorf("db %s is not locked", redact.URL(u))
+	}
+	return unlock()
+}
+
+// LockSession runs FLUSH TABLES WITH READ LOCK on a connection of its own.
+// The lock belongs to the session, the returned function unlocks it on the
+// same connection and closes it.
+func (drv MySQLDriver) LockSession(u *url.URL, opts Options) (func() error, error) {
+	log := drv.log(opts)
 	db, err := drv.Open(u)
 	if err != nil {
-		log.Printf("Failed to open db %s", u)
-		return err
+		log.Errorf("Failed to open db %s", redact.URL(u))
+		return nil, err
 	}
-
-	if _, err := db.Exec("FLUSH TABLES WITH READ LOCK"); err != nil {
-		log.Printf("Failed to lock db %s", u)
-		return err
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		log.Errorf("Failed to connect to db %s", redact.URL(u))
+		db.Close()
+		return nil, err
 	}
-	log.Println("LOCKED DATABASE:", u)
 
-	return nil
+	if _, err := conn.ExecContext(ctx, "FLUSH TABLES WITH READ LOCK"); err != nil {
+		log.Errorf("Failed to lock db %s", redact.URL(u))
+		conn.Close()
+		db.Close()
+		return nil, err
+	}
+	log.Infof("LOCKED DATABASE: %s", redact.URL(u))
+
+	return func() (err error) {
+		// closing the session releases the lock if UNLOCK TABLES fails
+		defer closeErr(db, &err)
+		defer closeErr(conn, &err)
+		if _, err := conn.ExecContext(ctx, "UNLOCK TABLES"); err != nil {
+			log.Errorf("Failed to unlock db %s", redact.URL(u))
+			return err
+		}
+		log.Infof("UNLOCKED DATABASE: %s", redact.URL(u))
+		return nil
+	}, nil
 }
 
-func (drv MySQLDriver) UnLock(u *url.URL) error {
+func (drv MySQLDriver) GetSum(u *url.URL, opts Options) (_ map[string]int, err error) {
+	sum := make(map[string]int)
+
+	name := databaseName(u)
+	log := drv.log(opts)
+
 	db, err := drv.Open(u)
 	if err != nil {
-		log.Printf("Failed to open db %s", u)
-		return err
+		log.Errorf("Failed to open db %s", name)
+		return nil, err
+	}
+	defer closeErr(db, &err)
+
+	var tables []string
+	if opts.SkipViews {
+		tables, err = queryStrings(db, `SELECT TABLE_NAME FROM information_schema.TABLES
+			WHERE TABLE_SCHEMA = DATABASE() AND TABLE_TYPE = 'BASE TABLE' ORDER BY TABLE_NAME`)
+	} else {
+		tables, err = queryTables(db)
 	}
+	if err != nil {
+		return nil, err
+	}
+	tables, _ = opts.FilterTables(tables)
 
-	if _, err := db.Exec("UNLOCK TABLES"); err != nil {
-		log.Printf("Failed to unlock db %s", u)
-		return err
+	for _, table := range tables {
+		var count int
+		query := fmt.Sprintf("SELECT COUNT(*) FROM %s", quoteIdentifier(table))
+		if where := opts.RowFilter(table); where != "" {
+			query = fmt.Sprintf("%s WHERE %s", query, where)
+		}
+		if err := db.QueryRow(query).Scan(&count); err != nil {
+			return nil, err
+		}
+		sum[table] = count
 	}
-	log.Println("UNLOCKED DATABASE:", u)
 
-	return nil
+	log.Infof("Row counts: %v", sum)
+
+	return sum, nil
 }
 
-func (drv MySQLDriver) GetSum(u *url.URL) (map[string]int, error) {
-	sum := make(map[string]int)
+func (drv MySQLDriver) GetChecksums(u *url.URL, opts Options) (_ map[string]string, err error) {
+	if len(opts.Where) > 0 {
+		return nil, errors.New("Row filters are not supported by CHECKSUM TABLE")
+	}
 
 	name := databaseName(u)
+	log := drv.log(opts)
 
 	db, err := drv.Open(u)
 	if err != nil {
-		log.Printf("Failed to open db %s", name)
+		log.Errorf("Failed to open db %s", name)
 		return nil, err
 	}
+	defer closeErr(db, &err)
 
-	tables := []string{}
-	res, err := db.Query("SHOW TABLES")
+	tables, err := queryTables(db)
 	if err != nil {
 		return nil, err
 	}
-	for res.Next() {
-		var table string
-		res.Scan(&table)
-		tables = append(tables, table)
-	}
+	tables, _ = opts.FilterTables(tables)
 
+	checksums := make(map[string]string)
 	for _, table := range tables {
-		var count int
-		query := fmt.Sprintf("SELECT COUNT(*) FROM %s", table)
-		row := db.QueryRow(query)
-		if err != nil {
+		if masked := opts.maskedColumns(table); len(masked) > 0 {
+			checksum, err := columnsChecksum(db, name, table, masked)
+			if err != nil {
+				return nil, err
+			}
+			log.With("table", table).Infof("Checksum of table %s without its masked columns", table)
+			checksums[table] = checksum
+			continue
+		}
+		var checksumTable string
+		var checksum sql.NullString
+		if err := db.QueryRow("CHECKSUM TABLE " + quoteIdentifier(table)).Scan(&checksumTable, &checksum); err != nil {
 			return nil, err
 		}
-		row.Scan(&count)
-		sum[table] = count
+		// views have no checksum
+		if !checksum.Valid {
+			log.With("table", table).Infof("No checksum of table %s, skipped", table)
+			continue
+		}
+		checksums[table] = checksum.String
 	}
 
-	log.Println(sum)
+	log.Infof("Checksums: %v", checksums)
 
-	return sum, nil
+	return checksums, nil
 }
 
-// helpers
+// columnsChecksum returns a checksum of the rows of a table without its
+// masked columns, CHECKSUM TABLE covers all of them: the row count and the sum
+// of the CRC32 of the other columns of each row, NULL values included.
+func columnsChecksum(db *sql.DB, database, table string, masked map[string]MaskRule) (string, error) {
+	rows, err := db.Query("SELECT COLUMN_NAME FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? ORDER BY ORDINAL_POSITION", database, table)
+	if err != nil {
+		return "", err
+	}
+	var columns, nulls []string
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			rows.Close()
+			return "", err
+		}
+		if _, ok := masked[column]; ok {
+			continue
+		}
+		// the bytes, the collations of the columns may not mix
+		columns = append(columns, fmt.Sprintf("CAST(%s AS BINARY)", quoteIdentifier(column)))
+		nulls = append(nulls, fmt.Sprintf("ISNULL(%s)", quoteIdentifier(column)))
+	}
+	if err := closeRows(rows); err != nil {
+		return "", err
+	}
 
-// normalize the URL
-func normalizeMySQLURL(u *url.URL) string {
-	normalizedURL := *u
-	normalizedURL.Scheme = ""
+	sum := "0"
+	if len(columns) > 0 {
+		sum = fmt.Sprintf("COALESCE(SUM(CRC32(CONCAT_WS('#', %s, CONCAT(%s)))), 0)", strings.Join(columns, ", "), strings.Join(nulls, ", "))
+	}
+	var count, checksum string
+	query := fmt.Sprintf("SELECT COUNT(*), %s FROM %s", sum, quoteIdentifier(table))
+	if err := db.QueryRow(query).Scan(&count, &checksum); err != nil {
+		return "", err
+	}
+	return count + ":" + checksum, nil
+}
 
-	// set default port
-	if normalizedURL.Port() == "" {
-		normalizedURL.Host = fmt.Sprintf("%s:3306", normalizedURL.Host)
+func (drv MySQLDriver) GetSchema(u *url.URL, opts Options) (_ *Schema, err error) {
+	name := databaseName(u)
+
+	db, err := drv.Open(u)
+	if err != nil {
+		drv.log(opts).Errorf("Failed to open db %s", name)
+		return nil, err
 	}
+	defer closeErr(db, &err)
+
+	return readMySQLSchema(db, name, opts)
+}
 
-	// host format required by go-sql-driver/mysql
-	normalizedURL.Host = fmt.Sprintf("tcp(%s)", normalizedURL.Host)
+// helpers
 
-	query := normalizedURL.Query()
+// normalize the URL into a DSN of go-sql-driver/mysql, with tlsConfig as its
+// tls parameter when set. The driver does not unescape the credentials, it
+// reads them up to the last @ before the database name.
+func normalizeMySQLURL(u *url.URL, tlsConfig string) string {
+	query := u.Query()
 	query.Set("multiStatements", "true")
-	normalizedURL.RawQuery = query.Encode()
+	for _, param := range []string{datatype.SocketParam, tlsModeParam, tlsCAParam, tlsCertParam, tlsKeyParam} {
+		query.Del(param)
+	}
+	if tlsConfig != "" {
+		query.Set("tls", tlsConfig)
+	}
+
+	// address format required by go-sql-driver/mysql
+	var address string
+	if socket := u.Query().Get(datatype.SocketParam); socket != "" {
+		address = fmt.Sprintf("unix(%s)", socket)
+	} else {
+		host := u.Host
+		// set default port
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "3306")
+		}
+		address = fmt.Sprintf("tcp(%s)", host)
+	}
 
-	str := normalizedURL.String()
-	return strings.TrimLeft(str, "/")
+	var user string
+	if u.User != nil {
+		user = u.User.Username()
+		if password, set := u.User.Password(); set {
+			user += ":" + password
+		}
+		user += "@"
+	}
+	return fmt.Sprintf("%s%s/%s?%s", user, address, databaseName(u), query.Encode())
 }
 
 //mysqlArgs returns command mysql arguments
@@ -206,27 +395,150 @@ func mysqlArgs(u *url.URL) []string {
 	if port := u.Port(); port != "" {
 		args = append(args, "--port="+port)
 	}
+	if socket := u.Query().Get(datatype.SocketParam); socket != "" {
+		args = append(args, "--socket="+socket)
+	}
 	if username := u.User.Username(); username != "" {
 		args = append(args, "--user="+username)
 	}
-	// mysql recommends against using environment variables to supply password
+	// the password is in the file of mysqlDefaultsFile, mysql recommends
+	// against the command line and environment variables
 	// https://dev.mysql.com/doc/refman/5.7/en/password-security-user.html
-	if password, set := u.User.Password(); set {
-		args = append(args, "--password="+password)
-	}
 	// add database name
 	args = append(args, strings.TrimLeft(u.Path, "/"))
 
 	return args
 }
 
+// mysqlDefaultsFile writes the password of the URL into a temporary option
+// file only readable by its owner, keeping it out of the command lines of the
+// mysql tools. The returned arguments must come first, the returned function
+// removes the file.
+func mysqlDefaultsFile(u *url.URL) ([]string, func(), error) {
+	password, set := u.User.Password()
+	if !set {
+		return nil, func() {}, nil
+	}
+
+	f, err := ioutil.TempFile("", "mysql-defaults-")
+	if err != nil {
+		return nil, nil, err
+	}
+	remove := func() {
+		os.Remove(f.Name())
+	}
+	// only the outer quotes are stripped, so the password needs no escaping
+	// besides the escape sequences of option files
+	_, err = fmt.Fprintf(f, "[client]\npassword=\"%s\"\n", optionEscaper.Replace(password))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0600)
+	}
+	if err != nil {
+		remove()
+		return nil, nil, err
+	}
+	return []string{"--defaults-extra-file=" + f.Name()}, remove, nil
+}
+
+// optionEscaper escapes the escape sequences of mysql option files
+var optionEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`, "\t", `\t`, "\b", `\b`)
+
+// dumpRun is a single mysqldump invocation of an export
+type dumpRun struct {
+	// dump only these tables, or all tables when empty
+	tables []string
+	// skip these tables
+	ignored []string
+	// row filter applied to all dumped tables
+	where string
+	// dump stored routines
+	routines bool
+	// additional mysqldump arguments
+	extra []string
+}
+
+// dumpRuns splits an export into mysqldump invocations. mysqldump accepts a
+// single --where for all tables, so each table with a row filter is dumped by
+// its own run.
+func (drv MySQLDriver) dumpRuns(u *url.URL, opts Options) ([]dumpRun, error) {
+	if opts.NoData {
+		// row filters are meaningless when no rows are dumped
+		opts = opts.WithoutRowFilters()
+	}
+	if !opts.Filtered() && len(opts.Where) == 0 {
+		return []dumpRun{{routines: true}}, nil
+	}
+
+	tables, err := drv.listTables(u)
+	if err != nil {
+		return nil, err
+	}
+	included, excluded := opts.FilterTables(tables)
+	if len(included) == 0 {
+		return nil, errors.New("No table matches the table filters")
+	}
+
+	var whole, filtered []string
+	for _, table := range included {
+		if opts.RowFilter(table) != "" {
+			filtered = append(filtered, table)
+			excluded = append(excluded, table)
+		} else {
+			whole = append(whole, table)
+		}
+	}
+
+	var runs []dumpRun
+	// an explicit table list is only needed when tables are included by
+	// pattern, otherwise ignoring the excluded ones is enough
+	if len(opts.IncludeTables) > 0 && len(whole) > 0 {
+		runs = append(runs, dumpRun{tables: whole, routines: true})
+	} else {
+		runs = append(runs, dumpRun{ignored: excluded, routines: true})
+	}
+	for _, table := range filtered {
+		runs = append(runs, dumpRun{tables: []string{table}, where: opts.RowFilter(table)})
+	}
+	return runs, nil
+}
+
 // mysqldumpArgs return arguments for mysqldump
-func mysqldumpArgs(u *url.URL) []string {
+func mysqldumpArgs(u *url.URL, opts Options, run dumpRun) []string {
 	// generate CLI arguments
-	args := []string{"--opt", "--routines"}
-	//"--no-data", "--skip-dump-date", "--skip-add-drop-table"}
+	args := []string{"--opt"}
+	//"--skip-dump-date", "--skip-add-drop-table"}
+
+	switch {
+	case opts.NoData:
+		args = append(args, "--no-data")
+	case opts.NoSchema:
+		// triggers and routines are part of the schema
+		args = append(args, "--no-create-info", "--skip-triggers")
+		run.routines = false
+	}
+	if run.routines {
+		args = append(args, "--routines")
+	}
+	args = append(args, run.extra...)
+	if run.where != "" {
+		args = append(args, "--where="+run.where)
+	}
+	if opts.Charset != "" {
+		// dump in the converted character set, lossy values are rejected by
+		// CheckCharset beforehand
+		args = append(args, "--default-character-set="+strings.ToLower(opts.Charset))
+	}
+
+	name := databaseName(u)
+	for _, table := range run.ignored {
+		args = append(args, fmt.Sprintf("--ignore-table=%s.%s", name, table))
+	}
 
 	args = append(args, mysqlArgs(u)...)
+	args = append(args, run.tables...)
 
 	return args
 }
@@ -241,6 +553,119 @@ func databaseName(u *url.URL) string {
 	return name
 }
 
+// dump runs mysqldump for each run, writing to w
+func (drv MySQLDriver) dump(u *url.URL, opts Options, runs []dumpRun, w io.Writer) error {
+	defaults, remove, err := mysqlDefaultsFile(u)
+	if err != nil {
+		return err
+	}
+	defer remove()
+	tlsArgs, err := mysqlTLSArgs(u)
+	if err != nil {
+		return err
+	}
+
+	for _, run := range runs {
+		args := append(append(defaults, tlsArgs...), mysqldumpArgs(u, opts, run)...)
+		output, err := opts.runner("mysql").RunCommandOutTOFile("mysqldump", w, args...)
+		if err != nil {
+			return err
+		}
+		drv.log(opts).With("command", "mysqldump").Debugf("mysqldump output: %s", output)
+	}
+	return nil
+}
+
+// importFile runs the statements of the file with mysql
+func (drv MySQLDriver) importFile(u *url.URL, filename string, opts Options) (err error) {
+	log := drv.log(opts)
+	log.Infof("Will import mysql db from file: %s", filename)
+
+	f, err := openDumpFile(filename, opts.Encryption)
+	if err != nil {
+		log.Errorf("Failed to open file %s", filename)
+		return err
+	}
+	// a corrupt compressed dump fails once decompressed
+	defer closeErr(f, &err)
+
+	var in io.Reader = f
+	name := databaseName(u)
+	if opts.SourceDatabase != "" && opts.SourceDatabase != name || len(opts.RenameTables) > 0 {
+		log.Infof("Will rename database %s to %s, tables %v", opts.SourceDatabase, name, opts.RenameTables)
+		pr, pw := io.Pipe()
+		// unblock the renaming if mysql exits early
+		defer pr.Close()
+		go func(src io.Reader) {
+			pw.CloseWithError(renameDump(pw, src, name, opts))
+		}(in)
+		in = pr
+	}
+	if opts.Charset != "" {
+		log.Infof("Will convert character sets to %s", opts.Charset)
+		pr, pw := io.Pipe()
+		defer pr.Close()
+		go func(src io.Reader) {
+			pw.CloseWithError(convertCharsetDump(pw, src, opts))
+		}(in)
+		in = pr
+	}
+
+	defaults, remove, err := mysqlDefaultsFile(u)
+	if err != nil {
+		return err
+	}
+	defer remove()
+	tlsArgs, err := mysqlTLSArgs(u)
+	if err != nil {
+		return err
+	}
+
+	args := append(append(defaults, tlsArgs...), mysqlArgs(u)...)
+	_, err = opts.runner("mysql").RunCommandWithStdin("mysql", in, args...)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// quoteIdentifier quotes a table or column name with backticks
+func quoteIdentifier(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+// listTables returns the tables of the database in the URL
+func (drv MySQLDriver) listTables(u *url.URL) (_ []string, err error) {
+	db, err := drv.Open(u)
+	if err != nil {
+		drv.log(Options{}).Errorf("Failed to open db %s", databaseName(u))
+		return nil, err
+	}
+	defer closeErr(db, &err)
+
+	return queryTables(db)
+}
+
+// queryTables returns the tables of the current database
+func queryTables(db *sql.DB) (_ []string, err error) {
+	res, err := db.Query("SHOW TABLES")
+	if err != nil {
+		return nil, err
+	}
+	defer closeErr(res, &err)
+
+	tables := []string{}
+	for res.Next() {
+		var table string
+		if err := res.Scan(&table); err != nil {
+			return nil, err
+		}
+		tables = append(tables, table)
+	}
+	return tables, res.Err()
+}
+
 // openRootDB open the root database
 func (drv MySQLDriver) openRootDB(u *url.URL) (*sql.DB, error) {
 	// connect to no particular database
@@ -254,14 +679,15 @@ func (drv MySQLDriver) openRootDB(u *url.URL) (*sql.DB, error) {
 func (drv MySQLDriver) CreateDbIfNotExists(u *url.URL) error {
 	name := databaseName(u)
 
+	log := drv.log(Options{})
 	db, err := drv.openRootDB(u)
 	if err != nil {
-		log.Printf("Failed to open db %s", name)
+		log.Errorf("Failed to open db %s", name)
 		return err
 	}
 
 	if _, err := db.Exec("CREATE DATABASE IF NOT EXISTS " + name); err != nil {
-		log.Printf("Failed to create db %s", name)
+		log.Errorf("Failed to create db %s", name)
 		return err
 	}
 	return nil
@@ -0,0 +1,599 @@
+package database
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gossion/migration-producer/pkg/logging"
+	"github.com/gossion/migration-producer/pkg/metrics"
+)
+
+func init() {
+	RegisterConverter(MySQLToPostgreSQL{}, "mysql", "postgres")
+	RegisterConverter(MySQLToPostgreSQL{}, "mysql", "postgresql")
+}
+
+// MySQLToPostgreSQL converts a MySQL database into a PostgreSQL one. The
+// tables are read through information_schema and translated into PostgreSQL
+// DDL, then the rows are streamed into psql with COPY. Everything runs in a
+// single transaction, secondary indexes and foreign keys are created after
+// the rows are loaded and sequences are reset to the copied values.
+type MySQLToPostgreSQL struct {
+}
+
+// how a MySQL value is written in a COPY stream
+const (
+	pgAsText = iota
+	pgAsBool
+	pgAsBit
+	pgAsBytea
+	pgAsDate
+	pgAsTimestampTZ
+)
+
+type pgColumn struct {
+	Column
+	pgType string
+	check  string
+	value  int
+	bits   int
+}
+
+type pgTable struct {
+	*Table
+	name    string
+	columns []pgColumn
+	log     *logging.Logger
+}
+
+func (conv MySQLToPostgreSQL) Convert(src *url.URL, dst *url.URL, opts Options) (err error) {
+	log := opts.Log.With("driver", "mysql2pg")
+	db, err := MySQLDriver{}.Open(src)
+	if err != nil {
+		log.Errorf("Failed to open db %s", databaseName(src))
+		return err
+	}
+	defer closeErr(db, &err)
+
+	// a single connection, so the session settings apply to all reads
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec("SET NAMES utf8mb4, time_zone = '+00:00'"); err != nil {
+		return err
+	}
+
+	schema, err := readMySQLSchema(db, databaseName(src), opts)
+	if err != nil {
+		return err
+	}
+	if len(schema.Tables) == 0 {
+		return errors.New("No table matches the table filters")
+	}
+	if err := checkMasks(schema.Tables, opts); err != nil {
+		return err
+	}
+
+	tables := []pgTable{}
+	var unsupported []string
+	for i := range schema.Tables {
+		t := pgTable{Table: &schema.Tables[i], name: opts.DestinationTable(schema.Tables[i].Name)}
+		t.log = log.With("table", t.Table.Name)
+		for _, c := range t.Table.Columns {
+			col, err := translateColumn(c)
+			if err != nil {
+				unsupported = append(unsupported, fmt.Sprintf("%s.%s: %s", t.Table.Name, c.Name, err))
+				continue
+			}
+			t.columns = append(t.columns, col)
+		}
+		tables = append(tables, t)
+	}
+	if len(unsupported) > 0 {
+		return fmt.Errorf("Cannot convert columns: %s", strings.Join(unsupported, "; "))
+	}
+
+	if err := (PostgreSQLDriver{}).CreateDbIfNotExists(dst); err != nil {
+		return err
+	}
+
+	log.Infof("Will convert mysql db %s to postgres db %s", databaseName(src), databaseName(dst))
+
+	args, err := psqlArgs(dst)
+	if err != nil {
+		return err
+	}
+	pr, pw := io.Pipe()
+	// unblock the script writer if psql exits early
+	defer pr.Close()
+	done := make(chan error, 1)
+	go func() {
+		err := writePostgreSQLScript(pw, db, tables, opts)
+		pw.CloseWithError(err)
+		done <- err
+	}()
+
+	_, err = pgRunner(dst, opts).RunCommandWithStdin("psql", pr, args...)
+	pr.Close()
+	scriptErr := <-done
+	if err != nil {
+		return err
+	}
+	return scriptErr
+}
+
+// writePostgreSQLScript writes the DDL and the rows of the tables as a psql
+// script
+func writePostgreSQLScript(out io.Writer, db *sql.DB, tables []pgTable, opts Options) error {
+	w := bufio.NewWriter(out)
+
+	names := map[string]string{}
+	// names of the relations of the schema, the indexes share them
+	relations := map[string]bool{}
+	for _, t := range tables {
+		names[t.Table.Name] = t.name
+		relations[t.name] = true
+		relations[pgName(t.name, "pkey")] = true
+	}
+
+	w.WriteString("SET client_encoding = 'UTF8';\nBEGIN;\n")
+
+	// zero dates are copied as NULL, the NOT NULL constraints of dates are
+	// added once the rows are known
+	deferNotNull := !opts.NoSchema && !opts.NoData
+	if !opts.NoSchema {
+		for _, t := range tables {
+			writeCreateTable(w, t, deferNotNull)
+		}
+	}
+
+	if !opts.NoData {
+		for _, t := range tables {
+			zeroDates, err := copyRows(w, db, t, opts)
+			if err != nil {
+				return err
+			}
+			if deferNotNull {
+				writeNotNull(w, t, zeroDates)
+			}
+			writeResetSequences(w, t)
+		}
+	}
+
+	if !opts.NoSchema {
+		for _, t := range tables {
+			writeIndexes(w, t, relations)
+		}
+		for _, t := range tables {
+			writeForeignKeys(w, t, names)
+		}
+	}
+
+	w.WriteString("COMMIT;\n")
+	return w.Flush()
+}
+
+func writeCreateTable(w *bufio.Writer, t pgTable, deferNotNull bool) {
+	defs := []string{}
+	for _, c := range t.columns {
+		def := quotePostgreSQLIdentifier(c.Name) + " " + c.pgType
+		if !c.Nullable && !(deferNotNull && c.isDate()) {
+			def += " NOT NULL"
+		}
+		if d, ok := pgDefault(c, t.log); ok {
+			def += " DEFAULT " + d
+		}
+		if c.check != "" {
+			def += " CHECK (" + c.check + ")"
+		}
+		defs = append(defs, def)
+	}
+	if pk := t.PrimaryKey(); pk != nil {
+		defs = append(defs, fmt.Sprintf("PRIMARY KEY (%s)", quotePostgreSQLIdentifiers(pk.Columns)))
+	}
+
+	name := quotePostgreSQLIdentifier(t.name)
+	fmt.Fprintf(w, "DROP TABLE IF EXISTS %s CASCADE;\n", name)
+	fmt.Fprintf(w, "CREATE TABLE %s (\n  %s\n);\n", name, strings.Join(defs, ",\n  "))
+}
+
+// writeNotNull adds the NOT NULL constraints of the dates of a table, but
+// of the columns with zero dates, which were copied as NULL
+func writeNotNull(w *bufio.Writer, t pgTable, zeroDates map[string]int) {
+	for _, c := range t.columns {
+		if c.Nullable || !c.isDate() {
+			continue
+		}
+		if n := zeroDates[c.Name]; n > 0 {
+			t.log.Warnf("Column %s has %d zero dates, copied as NULL, it is left nullable", c.Name, n)
+			continue
+		}
+		fmt.Fprintf(w, "ALTER TABLE %s ALTER COLUMN %s SET NOT NULL;\n",
+			quotePostgreSQLIdentifier(t.name), quotePostgreSQLIdentifier(c.Name))
+	}
+}
+
+// writeIndexes writes the secondary indexes of a table, named uniquely
+// among the relations of the schema
+func writeIndexes(w *bufio.Writer, t pgTable, relations map[string]bool) {
+	for _, index := range t.Indexes {
+		if index.Primary() {
+			continue
+		}
+		if index.Type == "FULLTEXT" || index.Type == "SPATIAL" || len(index.Columns) == 0 {
+			t.log.Warnf("Skipping %s index %s of table %s", index.Type, index.Name, t.Table.Name)
+			continue
+		}
+		unique := ""
+		if index.Unique {
+			unique = "UNIQUE "
+		}
+		// index names are unique per schema in postgres
+		name := pgName(t.name, index.Name)
+		for i := 2; relations[name]; i++ {
+			name = pgName(t.name, index.Name+"_"+strconv.Itoa(i))
+		}
+		relations[name] = true
+		fmt.Fprintf(w, "CREATE %sINDEX %s ON %s (%s);\n", unique,
+			quotePostgreSQLIdentifier(name), quotePostgreSQLIdentifier(t.name),
+			quotePostgreSQLIdentifiers(index.Columns))
+	}
+}
+
+func writeForeignKeys(w *bufio.Writer, t pgTable, names map[string]string) {
+	for _, fk := range t.ForeignKeys {
+		ref, ok := names[fk.ReferencedTable]
+		if !ok {
+			t.log.Warnf("Skipping foreign key %s of table %s, %s is not migrated", fk.Name, t.Table.Name, fk.ReferencedTable)
+			continue
+		}
+		fmt.Fprintf(w, "ALTER TABLE %s ADD CONSTRAINT %s FOREIGN KEY (%s) REFERENCES %s (%s) ON UPDATE %s ON DELETE %s;\n",
+			quotePostgreSQLIdentifier(t.name), quotePostgreSQLIdentifier(fk.Name), quotePostgreSQLIdentifiers(fk.Columns),
+			quotePostgreSQLIdentifier(ref), quotePostgreSQLIdentifiers(fk.ReferencedColumns), fk.OnUpdate, fk.OnDelete)
+	}
+}
+
+func writeResetSequences(w *bufio.Writer, t pgTable) {
+	name := quotePostgreSQLIdentifier(t.name)
+	for _, c := range t.columns {
+		if !c.AutoIncrement() {
+			continue
+		}
+		col := quotePostgreSQLIdentifier(c.Name)
+		fmt.Fprintf(w, "SELECT setval(pg_get_serial_sequence(%s, %s), COALESCE(MAX(%s), 1), MAX(%s) IS NOT NULL) FROM %s;\n",
+			quotePostgreSQLLiteral(name), quotePostgreSQLLiteral(c.Name), col, col, name)
+	}
+}
+
+// copyRows writes the rows of the table selected by the options as a COPY
+// statement, masking them. It returns the number of zero dates of the
+// columns, copied as NULL.
+func copyRows(w *bufio.Writer, db *sql.DB, t pgTable, opts Options) (_ map[string]int, err error) {
+	columns := make([]Column, len(t.columns))
+	for i, c := range t.columns {
+		columns[i] = c.Column
+	}
+	m, err := newMasker(t.Table.Name, columns, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	srcCols := make([]string, len(t.columns))
+	dstCols := make([]string, len(t.columns))
+	for i, c := range t.columns {
+		srcCols[i] = quoteIdentifier(c.Name)
+		dstCols[i] = quotePostgreSQLIdentifier(c.Name)
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s", strings.Join(srcCols, ", "), quoteIdentifier(t.Table.Name))
+	if where := opts.RowFilter(t.Table.Name); where != "" {
+		query = fmt.Sprintf("%s WHERE %s", query, where)
+	}
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer closeErr(rows, &err)
+
+	fmt.Fprintf(w, "COPY %s (%s) FROM stdin;\n", quotePostgreSQLIdentifier(t.name), strings.Join(dstCols, ", "))
+
+	values := make([]sql.RawBytes, len(t.columns))
+	dest := make([]interface{}, len(values))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	copied := 0
+	zeroDates := map[string]int{}
+	defer func() {
+		metrics.RowsCopied.Add(float64(copied))
+	}()
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		copied++
+		if m != nil {
+			m.mask(values)
+		}
+		for i, c := range t.columns {
+			if i > 0 {
+				w.WriteByte('\t')
+			}
+			if v, ok := pgValue(c, values[i]); ok {
+				w.WriteString(copyEscaper.Replace(v))
+			} else {
+				if values[i] != nil {
+					zeroDates[c.Name]++
+				}
+				w.WriteString(`\N`)
+			}
+		}
+		w.WriteByte('\n')
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	w.WriteString("\\.\n")
+	t.log.Debugf("Copied %d rows", copied)
+	return zeroDates, nil
+}
+
+// copyEscaper escapes a value in the COPY text format
+var copyEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+
+// pgValue converts a MySQL value in text protocol, it returns false for NULL
+func pgValue(c pgColumn, raw sql.RawBytes) (string, bool) {
+	if raw == nil {
+		return "", false
+	}
+	switch c.value {
+	case pgAsBool:
+		return strconv.FormatBool(string(raw) != "0"), true
+	case pgAsBit:
+		var bits strings.Builder
+		for _, b := range raw {
+			fmt.Fprintf(&bits, "%08b", b)
+		}
+		s := bits.String()
+		if c.bits == 1 {
+			return strconv.FormatBool(strings.Contains(s, "1")), true
+		}
+		if len(s) > c.bits {
+			s = s[len(s)-c.bits:]
+		}
+		return s, true
+	case pgAsBytea:
+		return `\x` + hex.EncodeToString(raw), true
+	case pgAsDate:
+		if isZeroDate(string(raw)) {
+			return "", false
+		}
+	case pgAsTimestampTZ:
+		if isZeroDate(string(raw)) {
+			return "", false
+		}
+		return string(raw) + "+00", true
+	}
+	return string(raw), true
+}
+
+// isDate reports whether the column is a date, which may hold zero dates
+func (c pgColumn) isDate() bool {
+	return c.value == pgAsDate || c.value == pgAsTimestampTZ
+}
+
+// isZeroDate reports whether a MySQL date has a zero year, month or day,
+// which postgres does not accept
+func isZeroDate(s string) bool {
+	return len(s) >= 10 && (s[:4] == "0000" || s[5:7] == "00" || s[8:10] == "00")
+}
+
+// translateColumn maps a MySQL column type to a PostgreSQL one
+func translateColumn(c Column) (pgColumn, error) {
+	col := pgColumn{Column: c}
+	args := typeArgs(c.ColumnType)
+
+	switch c.DataType {
+	case "tinyint":
+		if strings.HasPrefix(c.ColumnType, "tinyint(1)") {
+			col.pgType, col.value = "boolean", pgAsBool
+		} else {
+			col.pgType = "smallint"
+		}
+	case "smallint", "year":
+		col.pgType = "smallint"
+		if c.Unsigned() {
+			col.pgType = "integer"
+		}
+	case "mediumint":
+		col.pgType = "integer"
+	case "int", "integer":
+		col.pgType = "integer"
+		if c.Unsigned() {
+			col.pgType = "bigint"
+		}
+	case "bigint":
+		col.pgType = "bigint"
+		if c.Unsigned() && !c.AutoIncrement() {
+			col.pgType = "numeric(20)"
+		}
+	case "decimal", "numeric":
+		col.pgType = "numeric" + args
+	case "float":
+		col.pgType = "real"
+	case "double", "real":
+		col.pgType = "double precision"
+	case "bit":
+		n, _ := strconv.Atoi(strings.Trim(args, "()"))
+		if n <= 1 {
+			col.pgType, col.value, col.bits = "boolean", pgAsBit, 1
+		} else {
+			col.pgType, col.value, col.bits = fmt.Sprintf("bit varying(%d)", n), pgAsBit, n
+		}
+	case "char", "varchar":
+		col.pgType = c.DataType + args
+	case "tinytext", "text", "mediumtext", "longtext":
+		col.pgType = "text"
+	case "binary", "varbinary", "tinyblob", "blob", "mediumblob", "longblob":
+		col.pgType, col.value = "bytea", pgAsBytea
+	case "date":
+		col.pgType, col.value = "date", pgAsDate
+	case "datetime":
+		col.pgType, col.value = "timestamp"+args+" without time zone", pgAsDate
+	case "timestamp":
+		col.pgType, col.value = "timestamp"+args+" with time zone", pgAsTimestampTZ
+	case "time":
+		col.pgType = "time" + args
+	case "enum":
+		values := enumValues(c.ColumnType)
+		quoted := make([]string, len(values))
+		for i, v := range values {
+			quoted[i] = quotePostgreSQLLiteral(v)
+		}
+		col.pgType = "text"
+		col.check = fmt.Sprintf("%s IN (%s)", quotePostgreSQLIdentifier(c.Name), strings.Join(quoted, ", "))
+	case "set":
+		col.pgType = "text"
+	case "json":
+		col.pgType = "jsonb"
+	default:
+		return col, fmt.Errorf("unsupported type %s", c.ColumnType)
+	}
+
+	if c.AutoIncrement() {
+		switch col.pgType {
+		case "smallint":
+			col.pgType = "smallserial"
+		case "integer":
+			col.pgType = "serial"
+		case "bigint":
+			col.pgType = "bigserial"
+		default:
+			return col, fmt.Errorf("unsupported auto increment type %s", c.ColumnType)
+		}
+	}
+	return col, nil
+}
+
+// pgDefault translates the column default, it returns false when the column
+// has no default or it cannot be translated
+func pgDefault(c pgColumn, log *logging.Logger) (string, bool) {
+	if c.Default == nil || c.AutoIncrement() {
+		return "", false
+	}
+	def := *c.Default
+
+	// MariaDB quotes literals and reports NULL defaults
+	if def == "NULL" {
+		return "", false
+	}
+	if len(def) >= 2 && def[0] == '\'' && def[len(def)-1] == '\'' {
+		def = strings.Replace(def[1:len(def)-1], "''", "'", -1)
+	}
+
+	upper := strings.ToUpper(def)
+	if strings.HasPrefix(upper, "CURRENT_TIMESTAMP") || strings.HasPrefix(upper, "NOW(") {
+		return "CURRENT_TIMESTAMP", true
+	}
+	if strings.Contains(strings.ToUpper(c.Extra), "DEFAULT_GENERATED") {
+		log.Warnf("Skipping expression default of column %s: %s", c.Name, def)
+		return "", false
+	}
+
+	switch c.value {
+	case pgAsBool:
+		return strings.ToUpper(strconv.FormatBool(def != "0")), true
+	case pgAsBit:
+		bits := strings.TrimSuffix(strings.TrimPrefix(def, "b'"), "'")
+		if c.bits == 1 {
+			return strings.ToUpper(strconv.FormatBool(strings.Contains(bits, "1"))), true
+		}
+		return "B" + quotePostgreSQLLiteral(bits), true
+	case pgAsBytea:
+		return "", false
+	case pgAsDate, pgAsTimestampTZ:
+		if isZeroDate(def) {
+			return "", false
+		}
+	}
+	if _, err := strconv.ParseFloat(def, 64); err == nil {
+		return def, true
+	}
+	return quotePostgreSQLLiteral(def), true
+}
+
+// pgMaxName is the length in bytes of the longest postgres identifier,
+// longer ones are truncated
+const pgMaxName = 63
+
+// pgName returns the name of an object of a table, as table_name. Names
+// too long for postgres are cut and suffixed with the checksum of the whole
+// name, so that distinct names stay distinct.
+func pgName(table, name string) string {
+	s := table + "_" + name
+	if len(s) <= pgMaxName {
+		return s
+	}
+	suffix := fmt.Sprintf("_%08x", crc32.ChecksumIEEE([]byte(s)))
+	s = s[:pgMaxName-len(suffix)]
+	// not within a character
+	for !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return s + suffix
+}
+
+// typeArgs returns the parenthesized arguments of a column type, e.g. (10,2)
+func typeArgs(columnType string) string {
+	start := strings.Index(columnType, "(")
+	end := strings.Index(columnType, ")")
+	if start < 0 || end < start {
+		return ""
+	}
+	return columnType[start : end+1]
+}
+
+// enumValues parses the values of an enum column type, e.g. enum('a','b')
+func enumValues(columnType string) []string {
+	values := []string{}
+	s := columnType[strings.Index(columnType, "(")+1:]
+	for {
+		start := strings.Index(s, "'")
+		if start < 0 {
+			return values
+		}
+		s = s[start+1:]
+		var v strings.Builder
+		for len(s) > 0 {
+			if s[0] == '\'' {
+				if len(s) > 1 && s[1] == '\'' {
+					v.WriteByte('\'')
+					s = s[2:]
+					continue
+				}
+				s = s[1:]
+				break
+			}
+			v.WriteByte(s[0])
+			s = s[1:]
+		}
+		values = append(values, v.String())
+	}
+}
+
+// quotePostgreSQLIdentifiers quotes a list of column names
+func quotePostgreSQLIdentifiers(names []string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = quotePostgreSQLIdentifier(name)
+	}
+	return strings.Join(quoted, ", ")
+}
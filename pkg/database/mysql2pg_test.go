@@ -0,0 +1,207 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/gossion/migration-producer/pkg/logging"
+)
+
+func TestTranslateColumn(t *testing.T) {
+	tests := []struct {
+		column Column
+		want   string
+		err    bool
+	}{
+		{column: Column{DataType: "tinyint", ColumnType: "tinyint(1)"}, want: "boolean"},
+		{column: Column{DataType: "tinyint", ColumnType: "tinyint(4)"}, want: "smallint"},
+		{column: Column{DataType: "int", ColumnType: "int(10) unsigned"}, want: "bigint"},
+		{column: Column{DataType: "int", ColumnType: "int(11)", Extra: "auto_increment"}, want: "serial"},
+		{column: Column{DataType: "bigint", ColumnType: "bigint(20) unsigned"}, want: "numeric(20)"},
+		{column: Column{DataType: "bigint", ColumnType: "bigint(20) unsigned", Extra: "auto_increment"}, want: "bigserial"},
+		{column: Column{DataType: "decimal", ColumnType: "decimal(10,2)"}, want: "numeric(10,2)"},
+		{column: Column{DataType: "bit", ColumnType: "bit(1)"}, want: "boolean"},
+		{column: Column{DataType: "bit", ColumnType: "bit(12)"}, want: "bit varying(12)"},
+		{column: Column{DataType: "varchar", ColumnType: "varchar(64)"}, want: "varchar(64)"},
+		{column: Column{DataType: "longblob", ColumnType: "longblob"}, want: "bytea"},
+		{column: Column{DataType: "datetime", ColumnType: "datetime(3)"}, want: "timestamp(3) without time zone"},
+		{column: Column{DataType: "timestamp", ColumnType: "timestamp"}, want: "timestamp with time zone"},
+		{column: Column{Name: "state", DataType: "enum", ColumnType: "enum('a','it''s')"}, want: "text"},
+		{column: Column{DataType: "json", ColumnType: "json"}, want: "jsonb"},
+		{column: Column{DataType: "geometry", ColumnType: "geometry"}, err: true},
+		{column: Column{DataType: "varchar", ColumnType: "varchar(8)", Extra: "auto_increment"}, err: true},
+	}
+	for _, tt := range tests {
+		got, err := translateColumn(tt.column)
+		if tt.err {
+			if err == nil {
+				t.Errorf("translateColumn(%s) = %s, want an error", tt.column.ColumnType, got.pgType)
+			}
+			continue
+		}
+		if err != nil || got.pgType != tt.want {
+			t.Errorf("translateColumn(%s) = %s, %v, want %s", tt.column.ColumnType, got.pgType, err, tt.want)
+		}
+	}
+
+	enum, _ := translateColumn(Column{Name: "state", DataType: "enum", ColumnType: "enum('a','it''s')"})
+	if want := `"state" IN ('a', 'it''s')`; enum.check != want {
+		t.Errorf("check of the enum = %s, want %s", enum.check, want)
+	}
+}
+
+func TestPgDefault(t *testing.T) {
+	def := func(s string) *string { return &s }
+	column := func(dataType, columnType string, d *string, extra string) pgColumn {
+		c, err := translateColumn(Column{Name: "c", DataType: dataType, ColumnType: columnType, Default: d, Extra: extra})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	tests := []struct {
+		name   string
+		column pgColumn
+		want   string
+		ok     bool
+	}{
+		{"no default", column("int", "int(11)", nil, ""), "", false},
+		{"MariaDB NULL", column("int", "int(11)", def("NULL"), ""), "", false},
+		{"number", column("int", "int(11)", def("42"), ""), "42", true},
+		{"text", column("varchar", "varchar(8)", def("it's"), ""), "'it''s'", true},
+		{"MariaDB quoted text", column("varchar", "varchar(8)", def("'it''s'"), ""), "'it''s'", true},
+		{"boolean", column("tinyint", "tinyint(1)", def("1"), ""), "TRUE", true},
+		{"bit", column("bit", "bit(1)", def("b'0'"), ""), "FALSE", true},
+		{"bits", column("bit", "bit(4)", def("b'1010'"), ""), "B'1010'", true},
+		{"current timestamp", column("timestamp", "timestamp", def("CURRENT_TIMESTAMP"), "DEFAULT_GENERATED"), "CURRENT_TIMESTAMP", true},
+		{"expression", column("int", "int(11)", def("(rand())"), "DEFAULT_GENERATED"), "", false},
+		{"zero date", column("datetime", "datetime", def("0000-00-00 00:00:00"), ""), "", false},
+		{"date", column("date", "date", def("2020-01-31"), ""), "'2020-01-31'", true},
+		{"blob", column("blob", "blob", def("x"), ""), "", false},
+	}
+	for _, tt := range tests {
+		got, ok := pgDefault(tt.column, logging.Default())
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%s: pgDefault() = %q, %v, want %q, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestIsZeroDate(t *testing.T) {
+	tests := map[string]bool{
+		"0000-00-00":          true,
+		"0000-00-00 00:00:00": true,
+		"2020-00-15":          true,
+		"2020-01-00 10:00:00": true,
+		"0000-01-01":          true,
+		"2020-01-31":          false,
+		"2020-01-31 00:00:00": false,
+		"10:00:00":            false,
+		"":                    false,
+	}
+	for s, want := range tests {
+		if got := isZeroDate(s); got != want {
+			t.Errorf("isZeroDate(%q) = %v, want %v", s, got, want)
+		}
+	}
+}
+
+func TestTypeArgs(t *testing.T) {
+	tests := map[string]string{
+		"decimal(10,2)":       "(10,2)",
+		"int(10) unsigned":    "(10)",
+		"enum('a','b')":       "('a','b')",
+		"text":                "",
+		"datetime(6)":         "(6)",
+		"varchar)(":           "",
+		"set('x') default ''": "('x')",
+	}
+	for columnType, want := range tests {
+		if got := typeArgs(columnType); got != want {
+			t.Errorf("typeArgs(%q) = %q, want %q", columnType, got, want)
+		}
+	}
+}
+
+func TestPgName(t *testing.T) {
+	if got := pgName("orders", "idx_user"); got != "orders_idx_user" {
+		t.Errorf("pgName() = %q", got)
+	}
+	long := strings.Repeat("a", 60)
+	a, b := pgName(long, "index_one"), pgName(long, "index_two")
+	if len(a) > pgMaxName || len(b) > pgMaxName || a == b {
+		t.Errorf("pgName() of long names = %q and %q, want distinct names of at most %d bytes", a, b, pgMaxName)
+	}
+	if got := pgName(strings.Repeat("é", 40), "idx"); len(got) > pgMaxName || !strings.HasPrefix(got, "éé") || strings.ContainsRune(got, '\uFFFD') {
+		t.Errorf("pgName() cut a character: %q", got)
+	}
+}
+
+func TestWriteIndexesUniqueNames(t *testing.T) {
+	long := strings.Repeat("t", 70)
+	table := func(name string, indexes ...string) pgTable {
+		t := pgTable{Table: &Table{Name: name}, name: name, log: logging.Default()}
+		for _, index := range indexes {
+			t.Indexes = append(t.Indexes, Index{Name: index, Type: "BTREE", Columns: []string{"id"}})
+		}
+		return t
+	}
+	relations := map[string]bool{"a_b": true}
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	writeIndexes(w, table("a", "b", "b_2"), relations)
+	writeIndexes(w, table(long, "idx"), relations)
+	writeIndexes(w, table(long+"x", "idx"), relations)
+	w.Flush()
+
+	names := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		name := strings.Fields(line)[2]
+		if names[name] || len(strings.Trim(name, `"`)) > pgMaxName {
+			t.Errorf("index %s is not unique or too long: %s", name, buf.String())
+		}
+		names[name] = true
+	}
+	if !names[`"a_b_2"`] || !names[`"a_b_2_2"`] {
+		t.Errorf("indexes of a were not renamed: %s", buf.String())
+	}
+}
+
+func TestWriteNotNull(t *testing.T) {
+	tbl := pgTable{Table: &Table{Name: "events"}, name: "events", log: logging.Default()}
+	for _, c := range []Column{
+		{Name: "at", DataType: "datetime", ColumnType: "datetime"},
+		{Name: "on", DataType: "date", ColumnType: "date"},
+		{Name: "maybe", DataType: "date", ColumnType: "date", Nullable: true},
+		{Name: "id", DataType: "int", ColumnType: "int(11)"},
+	} {
+		col, err := translateColumn(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tbl.columns = append(tbl.columns, col)
+	}
+
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	writeCreateTable(w, tbl, true)
+	writeNotNull(w, tbl, map[string]int{"on": 2})
+	w.Flush()
+	script := buf.String()
+
+	for _, want := range []string{
+		`"at" timestamp without time zone,`,
+		`"on" date,`,
+		`"id" integer NOT NULL`,
+		`ALTER TABLE "events" ALTER COLUMN "at" SET NOT NULL;`,
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("script lacks %s:\n%s", want, script)
+		}
+	}
+	if strings.Contains(script, `COLUMN "on"`) || strings.Contains(script, `COLUMN "maybe"`) {
+		t.Errorf("script sets NOT NULL on a column with zero dates or a nullable one:\n%s", script)
+	}
+}
@@ -0,0 +1,180 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// byte limits of MySQL
+const (
+	// maxIndexBytes is the key prefix limit of the DYNAMIC and COMPRESSED row
+	// formats, maxCompactIndexBytes the one of the COMPACT and REDUNDANT ones
+	maxIndexBytes        = 3072
+	maxCompactIndexBytes = 767
+	maxRowBytes          = 65535
+)
+
+// maxTextBytes are the byte limits of the text types
+var maxTextBytes = map[string]int64{
+	"tinytext":   255,
+	"text":       65535,
+	"mediumtext": 16777215,
+}
+
+// CheckCharset reports the columns whose data would be lossy once converted to
+// the character set of the options, or whose converted definitions would
+// exceed the length limits of indexes, rows or text types.
+func (drv MySQLDriver) CheckCharset(u *url.URL, opts Options) (_ []string, err error) {
+	if opts.Charset == "" {
+		return nil, nil
+	}
+
+	name := databaseName(u)
+
+	db, err := drv.Open(u)
+	if err != nil {
+		drv.log(opts).Errorf("Failed to open db %s", name)
+		return nil, err
+	}
+	defer closeErr(db, &err)
+
+	schema, err := readMySQLSchema(db, name, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// maximum bytes per character of each character set
+	maxlen := map[string]int64{}
+	rows, err := db.Query("SELECT CHARACTER_SET_NAME, MAXLEN FROM information_schema.CHARACTER_SETS")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var charset string
+		var n int64
+		if err := rows.Scan(&charset, &n); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		maxlen[charset] = n
+	}
+	if err := closeRows(rows); err != nil {
+		return nil, err
+	}
+	if _, ok := maxlen[strings.ToLower(opts.Charset)]; !ok {
+		return nil, fmt.Errorf("unknown character set: %s", opts.Charset)
+	}
+
+	var problems []string
+	for _, t := range schema.Tables {
+		tableProblems, err := checkTableCharset(db, name, t, maxlen, opts)
+		if err != nil {
+			return nil, err
+		}
+		problems = append(problems, tableProblems...)
+	}
+	return problems, nil
+}
+
+// checkTableCharset checks the converted columns and key parts of a table
+func checkTableCharset(db *sql.DB, name string, t Table, maxlen map[string]int64, opts Options) (_ []string, err error) {
+	var problems []string
+	charset := strings.ToLower(opts.Charset)
+
+	// bytes per character of the converted columns
+	widths := map[string]int64{}
+	var rowBytes int64
+	for _, c := range t.Columns {
+		if c.CharacterSet == "" {
+			continue
+		}
+		width := maxlen[opts.ConvertCharset(c.CharacterSet)]
+		if c.DataType == "varchar" || c.DataType == "char" {
+			rowBytes += charLength(c.ColumnType) * width
+		}
+		if c.CharacterSet == opts.ConvertCharset(c.CharacterSet) {
+			continue
+		}
+		widths[c.Name] = width
+
+		// values which differ once converted back are lossy
+		column := quoteIdentifier(c.Name)
+		converted := fmt.Sprintf("CONVERT(%s USING %s)", column, charset)
+		query := fmt.Sprintf("SELECT IFNULL(SUM(%s <> BINARY CONVERT(%s USING %s)), 0), IFNULL(MAX(LENGTH(%s)), 0) FROM %s WHERE %s IS NOT NULL",
+			column, converted, c.CharacterSet, converted, quoteIdentifier(t.Name), column)
+		if where := opts.RowFilter(t.Name); where != "" {
+			query = fmt.Sprintf("%s AND (%s)", query, where)
+		}
+
+		var lossy, maxBytes int64
+		if err := db.QueryRow(query).Scan(&lossy, &maxBytes); err != nil {
+			return nil, err
+		}
+		if lossy > 0 {
+			problems = append(problems, fmt.Sprintf("%s.%s: %d values are lossy in %s", t.Name, c.Name, lossy, charset))
+		}
+		if limit, ok := maxTextBytes[c.DataType]; ok && maxBytes > limit {
+			problems = append(problems, fmt.Sprintf("%s.%s: values of %d bytes in %s exceed %s", t.Name, c.Name, maxBytes, charset, c.DataType))
+		}
+	}
+
+	if rowBytes > maxRowBytes {
+		problems = append(problems, fmt.Sprintf("%s: rows of %d bytes in %s exceed %d bytes", t.Name, rowBytes, charset, maxRowBytes))
+	}
+
+	var rowFormat string
+	if err := db.QueryRow("SELECT IFNULL(ROW_FORMAT, '') FROM information_schema.TABLES WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ?",
+		name, t.Name).Scan(&rowFormat); err != nil {
+		return nil, err
+	}
+	limit := int64(maxIndexBytes)
+	if strings.EqualFold(rowFormat, "Compact") || strings.EqualFold(rowFormat, "Redundant") {
+		limit = maxCompactIndexBytes
+	}
+
+	// key parts of converted columns, with their prefix length if any
+	rows, err := db.Query(`SELECT INDEX_NAME, COLUMN_NAME, IFNULL(SUB_PART, 0) FROM information_schema.STATISTICS
+		WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? AND INDEX_TYPE = 'BTREE' AND COLUMN_NAME IS NOT NULL`, name, t.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer closeErr(rows, &err)
+	for rows.Next() {
+		var index, column string
+		var prefix int64
+		if err := rows.Scan(&index, &column, &prefix); err != nil {
+			return nil, err
+		}
+		width, ok := widths[column]
+		if !ok {
+			continue
+		}
+		chars := prefix
+		if chars == 0 {
+			for _, c := range t.Columns {
+				if c.Name == column {
+					chars = charLength(c.ColumnType)
+				}
+			}
+		}
+		if bytes := chars * width; bytes > limit {
+			problems = append(problems, fmt.Sprintf("%s.%s: key part %s of %d bytes in %s exceeds %d bytes",
+				t.Name, index, column, bytes, charset, limit))
+		}
+	}
+	return problems, rows.Err()
+}
+
+// charLength returns the declared length of a char or varchar column type,
+// e.g. 255 for varchar(255)
+func charLength(columnType string) int64 {
+	var n int64
+	start := strings.IndexByte(columnType, '(')
+	if start < 0 {
+		return 0
+	}
+	fmt.Sscanf(columnType[start+1:], "%d", &n)
+	return n
+}
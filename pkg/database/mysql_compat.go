@@ -0,0 +1,125 @@
+package database
+
+import (
+	"database/sql"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+func (drv MySQLDriver) GetServerInfo(u *url.URL, opts Options) (_ *ServerInfo, err error) {
+	db, err := drv.openRootDB(u)
+	if err != nil {
+		return nil, err
+	}
+	defer closeErr(db, &err)
+
+	info := &ServerInfo{}
+	if err := db.QueryRow(`SELECT VERSION(), @@sql_mode, @@character_set_server, @@collation_server, @@lower_case_table_names`).Scan(
+		&info.Version, &info.SQLMode, &info.CharacterSet, &info.Collation, &info.LowerCaseTableNames); err != nil {
+		return nil, err
+	}
+	info.Flavor = ServerFlavor("mysql", info.Version)
+
+	if info.Engines, err = queryStrings(db, `SELECT ENGINE FROM information_schema.ENGINES WHERE SUPPORT IN ('YES', 'DEFAULT')`); err != nil {
+		return nil, err
+	}
+	if info.Collations, err = queryStrings(db, `SELECT COLLATION_NAME FROM information_schema.COLLATIONS`); err != nil {
+		return nil, err
+	}
+	if info.Plugins, err = queryStrings(db, `SELECT PLUGIN_NAME FROM information_schema.PLUGINS WHERE PLUGIN_STATUS = 'ACTIVE'`); err != nil {
+		return nil, err
+	}
+
+	name := databaseName(u)
+	engines := map[string]bool{}
+	collations := map[string]bool{}
+
+	rows, err := db.Query(`SELECT TABLE_NAME, IFNULL(ENGINE, ''), IFNULL(TABLE_COLLATION, '')
+		FROM information_schema.TABLES WHERE TABLE_SCHEMA = ?`, name)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var table, engine, collation string
+		if err := rows.Scan(&table, &engine, &collation); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if opts.MatchTable(table) {
+			engines[engine] = true
+			collations[collation] = true
+		}
+	}
+	if err := closeRows(rows); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.Query(`SELECT DISTINCT TABLE_NAME, COLLATION_NAME
+		FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = ? AND COLLATION_NAME IS NOT NULL`, name)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var table, collation string
+		if err := rows.Scan(&table, &collation); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if opts.MatchTable(table) {
+			collations[collation] = true
+		}
+	}
+	if err := closeRows(rows); err != nil {
+		return nil, err
+	}
+
+	// views have no engine nor collation
+	delete(engines, "")
+	delete(collations, "")
+	info.UsedEngines = sortedKeys(engines)
+	info.UsedCollations = sortedKeys(collations)
+
+	// engines other than the builtin ones are provided by plugins of the
+	// same name
+	plugins, err := queryStrings(db, `SELECT PLUGIN_NAME FROM information_schema.PLUGINS
+		WHERE PLUGIN_STATUS = 'ACTIVE' AND PLUGIN_TYPE = 'STORAGE ENGINE' AND PLUGIN_LIBRARY IS NOT NULL`)
+	if err != nil {
+		return nil, err
+	}
+	for _, plugin := range plugins {
+		if contains(info.UsedEngines, plugin) {
+			info.RequiredPlugins = append(info.RequiredPlugins, strings.ToUpper(plugin))
+		}
+	}
+
+	return info, nil
+}
+
+// queryStrings returns the first column of the rows of a query
+func queryStrings(db *sql.DB, query string, args ...interface{}) (_ []string, err error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer closeErr(rows, &err)
+
+	values := []string{}
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,704 @@
+package database
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/gossion/migration-producer/pkg/logging"
+	"github.com/gossion/migration-producer/pkg/metrics"
+)
+
+const (
+	// tables with more estimated rows are dumped in chunks of primary key
+	// ranges
+	chunkRows = 1000000
+	// maximum size of an extended INSERT statement
+	maxStatementSize = 1 << 20
+	// manifest of a parallel dump directory
+	parallelDumpManifest = "dump.json"
+)
+
+// statements run before the rows of a data file are loaded
+const dataFileHeader = `/*!40101 SET NAMES utf8mb4 */;
+SET time_zone = '+00:00';
+SET sql_mode = 'NO_AUTO_VALUE_ON_ZERO';
+SET foreign_key_checks = 0;
+SET unique_checks = 0;
+`
+
+// parallelDump lists the files of a parallel dump directory
+type parallelDump struct {
+	// Tables are the source names of the dumped tables
+	Tables []string `json:"tables"`
+	// Schema creates the tables, views and routines
+	Schema string `json:"schema"`
+	// Data are the files holding the rows, one per table or chunk
+	Data []string `json:"data"`
+	// Triggers creates the triggers, after the rows are loaded
+	Triggers string `json:"triggers"`
+}
+
+// dumpChunk is a part of a table dumped by a worker
+type dumpChunk struct {
+	table *Table
+	where string
+	file  string
+}
+
+// deferredKeys are the secondary indexes and foreign keys of a table, which
+// are dropped while its rows are loaded
+type deferredKeys struct {
+	table       string
+	indexes     []string
+	indexNames  []string
+	foreignKeys []string
+	fkNames     []string
+	// the keys created again
+	indexesAdded     bool
+	foreignKeysAdded bool
+}
+
+// ExportParallel dumps each table, or primary key ranges of large tables, into
+// its own file. The rows are read concurrently by several connections sharing
+// a consistent snapshot.
+func (drv MySQLDriver) ExportParallel(u *url.URL, opts Options) (_ *Dump, err error) {
+	if err := checkCodec(opts.Compression); err != nil {
+		return nil, err
+	}
+
+	log := drv.log(opts)
+	dir, err := ioutil.TempDir("", "mysql-")
+	if err != nil {
+		log.Errorf("%s", err)
+		return nil, err
+	}
+
+	// a failed export leaves no partial dump behind
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	log.Infof("Will export mysql db to directory: %s", dir)
+
+	dump := &parallelDump{Schema: "schema.sql", Triggers: "triggers.sql"}
+	result := &Dump{Path: dir, Codec: opts.Codec(), Encrypted: opts.Encryption.Enabled()}
+
+	db, err := drv.Open(u)
+	if err != nil {
+		log.Errorf("Failed to open db %s", databaseName(u))
+		return nil, err
+	}
+	defer closeErr(db, &err)
+
+	// the schema is dumped and the chunks planned under the read lock of the
+	// snapshot, DDL in between would not match the rows
+	plan := func() ([]dumpChunk, error) {
+		if err := drv.dumpSchema(u, opts, dir, dump, result); err != nil {
+			return nil, err
+		}
+		schema, err := readMySQLSchema(db, databaseName(u), opts)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkMasks(schema.Tables, opts); err != nil {
+			return nil, err
+		}
+
+		chunks := []dumpChunk{}
+		for i := range schema.Tables {
+			t := &schema.Tables[i]
+			dump.Tables = append(dump.Tables, t.Name)
+			for j, where := range planChunks(db, t, opts.RowFilter(t.Name), log) {
+				chunk := dumpChunk{table: t, where: where, file: fmt.Sprintf("data-%04d-%04d.sql", i, j)}
+				chunks = append(chunks, chunk)
+				dump.Data = append(dump.Data, chunk.file)
+			}
+		}
+		return chunks, nil
+	}
+	if err := dumpChunks(db, opts, plan, dir, result); err != nil {
+		return nil, err
+	}
+
+	manifest, err := json.MarshalIndent(dump, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, parallelDumpManifest), manifest, 0600); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// ImportParallel restores a directory created by ExportParallel. Secondary
+// indexes and foreign keys are dropped after creating the tables, the data
+// files are loaded concurrently, then the keys and the triggers are created.
+// A failed import logs the statements creating the keys it dropped.
+func (drv MySQLDriver) ImportParallel(u *url.URL, dir string, opts Options) (err error) {
+	log := drv.log(opts)
+	manifest, err := ioutil.ReadFile(filepath.Join(dir, parallelDumpManifest))
+	if err != nil {
+		log.Errorf("Failed to read dump manifest in %s", dir)
+		return err
+	}
+	var dump parallelDump
+	if err := json.Unmarshal(manifest, &dump); err != nil {
+		return err
+	}
+
+	if err := drv.CreateDbIfNotExists(u); err != nil {
+		log.Errorf("%s", err)
+		return err
+	}
+
+	if err := drv.importFile(u, filepath.Join(dir, dump.Schema), opts); err != nil {
+		return err
+	}
+
+	db, err := drv.Open(u)
+	if err != nil {
+		log.Errorf("Failed to open db %s", databaseName(u))
+		return err
+	}
+	defer closeErr(db, &err)
+
+	tables := make([]string, len(dump.Tables))
+	for i, table := range dump.Tables {
+		tables[i] = opts.DestinationTable(table)
+	}
+	deferred, err := dropDeferredKeys(db, tables)
+	// the definitions of the dropped keys are only kept here, a failed
+	// import logs the missing ones
+	defer func() {
+		if err != nil {
+			logMissingKeys(log, deferred)
+		}
+	}()
+	if err != nil {
+		return err
+	}
+
+	workers := opts.Workers()
+	err = runParallel(workers, len(dump.Data), func(i int) error {
+		return drv.importFile(u, filepath.Join(dir, dump.Data[i]), opts)
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Creating deferred indexes")
+	err = runParallel(workers, len(deferred), func(i int) error {
+		if err := addKeys(db, deferred[i].table, deferred[i].indexes); err != nil {
+			return err
+		}
+		deferred[i].indexesAdded = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Creating deferred foreign keys")
+	if err := addForeignKeys(db, deferred); err != nil {
+		return err
+	}
+
+	return drv.importFile(u, filepath.Join(dir, dump.Triggers), opts)
+}
+
+// dumpSchema dumps the schema of a parallel dump, and its triggers which must
+// not fire while loading rows. It runs under the read lock of the export,
+// mysqldump does not lock the tables itself.
+func (drv MySQLDriver) dumpSchema(u *url.URL, opts Options, dir string, dump *parallelDump, result *Dump) error {
+	opts.NoData = true
+	runs, err := drv.dumpRuns(u, opts)
+	if err != nil {
+		return err
+	}
+	for i := range runs {
+		runs[i].extra = []string{"--skip-triggers", "--skip-lock-tables"}
+	}
+	if err := drv.dumpToFile(u, opts, runs, filepath.Join(dir, dump.Schema), result); err != nil {
+		return err
+	}
+	for i := range runs {
+		runs[i].routines = false
+		runs[i].extra = []string{"--no-create-info", "--skip-lock-tables"}
+	}
+	return drv.dumpToFile(u, opts, runs, filepath.Join(dir, dump.Triggers), result)
+}
+
+// dumpToFile runs mysqldump into a new file, adding its size to the dump
+func (drv MySQLDriver) dumpToFile(u *url.URL, opts Options, runs []dumpRun, filename string, dump *Dump) error {
+	f, err := createDumpFile(filename, opts)
+	if err != nil {
+		return err
+	}
+	if err := drv.dump(u, opts, runs, f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	dump.add(f)
+	return nil
+}
+
+// planChunks splits a large table with an integer primary key into ranges of
+// the key, it returns the predicate of each chunk
+func planChunks(db *sql.DB, t *Table, where string, log *logging.Logger) []string {
+	pk := t.PrimaryKey()
+	if t.Rows <= chunkRows || pk == nil || len(pk.Columns) != 1 || !isIntegerColumn(t, pk.Columns[0]) {
+		return []string{where}
+	}
+
+	key := quoteIdentifier(pk.Columns[0])
+	var min, max sql.NullInt64
+	query := fmt.Sprintf("SELECT MIN(%s), MAX(%s) FROM %s", key, key, quoteIdentifier(t.Name))
+	if err := db.QueryRow(query).Scan(&min, &max); err != nil || !min.Valid {
+		log.With("table", t.Name).Warnf("Dumping table %s in one chunk: %v", t.Name, err)
+		return []string{where}
+	}
+
+	n := t.Rows/chunkRows + 1
+	step := (max.Int64-min.Int64)/n + 1
+	chunks := []string{}
+	for i := int64(0); i < n; i++ {
+		lower := min.Int64 + i*step
+		var bounds []string
+		// the first and last chunks are open, rows may be inserted before
+		// the snapshot is taken
+		if i > 0 {
+			bounds = append(bounds, fmt.Sprintf("%s >= %d", key, lower))
+		}
+		if i < n-1 {
+			bounds = append(bounds, fmt.Sprintf("%s < %d", key, lower+step))
+		}
+		if where != "" {
+			bounds = append(bounds, "("+where+")")
+		}
+		chunks = append(chunks, strings.Join(bounds, " AND "))
+	}
+	return chunks
+}
+
+func isIntegerColumn(t *Table, name string) bool {
+	for _, c := range t.Columns {
+		if c.Name == name {
+			switch c.DataType {
+			case "tinyint", "smallint", "mediumint", "int", "integer", "bigint":
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// dumpChunks dumps the chunks returned by plan with several connections,
+// adding their sizes to the dump. The read lock is held while planning and
+// until every connection has started a transaction, so they all read from the
+// same snapshot as the plan.
+func dumpChunks(db *sql.DB, opts Options, plan func() ([]dumpChunk, error), dir string, dump *Dump) error {
+	log := opts.Log.With("driver", "mysql")
+	ctx := context.Background()
+
+	lock, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	if _, err := lock.ExecContext(ctx, "FLUSH TABLES WITH READ LOCK"); err != nil {
+		log.Errorf("Failed to lock db for a consistent snapshot")
+		return err
+	}
+	locked := true
+	unlock := func() {
+		if locked {
+			locked = false
+			if _, err := lock.ExecContext(ctx, "UNLOCK TABLES"); err != nil {
+				log.Errorf("Failed to unlock db: %s", err)
+			}
+		}
+	}
+	defer unlock()
+
+	chunks, err := plan()
+	if err != nil {
+		return err
+	}
+	workers := opts.Workers()
+	if workers > len(chunks) {
+		workers = len(chunks)
+	}
+	db.SetMaxOpenConns(workers + 1)
+
+	conns := []*sql.Conn{}
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for i := 0; i < workers; i++ {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			return err
+		}
+		conns = append(conns, conn)
+		for _, stmt := range []string{
+			"SET NAMES utf8mb4",
+			"SET time_zone = '+00:00'",
+			"SET SESSION TRANSACTION ISOLATION LEVEL REPEATABLE READ",
+			"START TRANSACTION WITH CONSISTENT SNAPSHOT",
+		} {
+			if _, err := conn.ExecContext(ctx, stmt); err != nil {
+				return err
+			}
+		}
+	}
+	unlock()
+
+	log.Infof("Dumping %d chunks with %d connections", len(chunks), workers)
+
+	var mu sync.Mutex
+	queue := make(chan dumpChunk)
+	errs := make(chan error, workers)
+	for _, conn := range conns {
+		go func(conn *sql.Conn) {
+			var err error
+			for chunk := range queue {
+				if err != nil {
+					continue
+				}
+				var f *dumpFile
+				f, err = dumpChunkToFile(ctx, conn, chunk, filepath.Join(dir, chunk.file), opts)
+				if err == nil {
+					mu.Lock()
+					dump.add(f)
+					mu.Unlock()
+				}
+			}
+			errs <- err
+		}(conn)
+	}
+	for _, chunk := range chunks {
+		queue <- chunk
+	}
+	close(queue)
+
+	var firstErr error
+	for range conns {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// dumpChunkToFile writes the rows of a chunk as extended INSERT statements
+func dumpChunkToFile(ctx context.Context, conn *sql.Conn, chunk dumpChunk, filename string, opts Options) (_ *dumpFile, err error) {
+	cols := make([]string, len(chunk.table.Columns))
+	for i, c := range chunk.table.Columns {
+		cols[i] = quoteIdentifier(c.Name)
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s", strings.Join(cols, ", "), quoteIdentifier(chunk.table.Name))
+	if chunk.where != "" {
+		query = fmt.Sprintf("%s WHERE %s", query, chunk.where)
+	}
+
+	rows, err := conn.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer closeErr(rows, &err)
+
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	m, err := newMasker(chunk.table.Name, chunk.table.Columns, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := createDumpFile(filename, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	w.WriteString(dataFileHeader)
+
+	insert := fmt.Sprintf("INSERT INTO %s (%s) VALUES ", quoteIdentifier(chunk.table.Name), strings.Join(cols, ","))
+	values := make([]sql.RawBytes, len(cols))
+	dest := make([]interface{}, len(values))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	size := 0
+	copied := 0
+	defer func() {
+		metrics.RowsCopied.Add(float64(copied))
+	}()
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		copied++
+		if m != nil {
+			m.mask(values)
+		}
+		row := formatMySQLRow(values, types)
+		if size > 0 && size+len(row) > maxStatementSize {
+			w.WriteString(";\n")
+			size = 0
+		}
+		if size == 0 {
+			w.WriteString(insert)
+			size = len(insert)
+		} else {
+			w.WriteByte(',')
+			size++
+		}
+		w.WriteString(row)
+		size += len(row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if size > 0 {
+		w.WriteString(";\n")
+	}
+	opts.Log.With("driver", "mysql", "table", chunk.table.Name).Debugf("Dumped %d rows into %s", copied, chunk.file)
+
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	return f, f.Close()
+}
+
+// mysqlEscaper escapes a string literal like mysql_real_escape_string
+var mysqlEscaper = strings.NewReplacer(`\`, `\\`, "'", `\'`, `"`, `\"`, "\x00", `\0`,
+	"\n", `\n`, "\r", `\r`, "\x1a", `\Z`)
+
+// formatMySQLRow formats a row of the text protocol as a value list
+func formatMySQLRow(values []sql.RawBytes, types []*sql.ColumnType) string {
+	var b strings.Builder
+	b.WriteByte('(')
+	for i, v := range values {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(mysqlLiteral(v, types[i].DatabaseTypeName()))
+	}
+	b.WriteByte(')')
+	return b.String()
+}
+
+// mysqlLiteral formats a value of the text protocol as a SQL literal
+func mysqlLiteral(v sql.RawBytes, typeName string) string {
+	if v == nil {
+		return "NULL"
+	}
+	switch typeName {
+	case "TINYINT", "SMALLINT", "MEDIUMINT", "INT", "BIGINT", "DECIMAL", "FLOAT", "DOUBLE", "YEAR":
+		return string(v)
+	case "BIT":
+		var bits strings.Builder
+		for _, b := range v {
+			fmt.Fprintf(&bits, "%08b", b)
+		}
+		return "b'" + bits.String() + "'"
+	case "BINARY", "VARBINARY", "TINYBLOB", "BLOB", "MEDIUMBLOB", "LONGBLOB", "GEOMETRY":
+		return "X'" + hex.EncodeToString(v) + "'"
+	}
+	return "'" + mysqlEscaper.Replace(string(v)) + "'"
+}
+
+// dropDeferredKeys drops the secondary indexes and foreign keys of the
+// tables, it returns their definitions to create them again, even when
+// failing to drop them.
+func dropDeferredKeys(db *sql.DB, tables []string) ([]deferredKeys, error) {
+	all := []deferredKeys{}
+	for _, table := range tables {
+		var name, create string
+		if err := db.QueryRow("SHOW CREATE TABLE "+quoteIdentifier(table)).Scan(&name, &create); err != nil {
+			return nil, err
+		}
+		keys := parseDeferredKeys(table, create)
+		if len(keys.indexes) > 0 || len(keys.foreignKeys) > 0 {
+			all = append(all, keys)
+		}
+	}
+
+	// foreign keys first, they depend on the indexes
+	for _, keys := range all {
+		if err := dropKeys(db, keys.table, "DROP FOREIGN KEY", keys.fkNames); err != nil {
+			return all, err
+		}
+	}
+	for _, keys := range all {
+		if err := dropKeys(db, keys.table, "DROP INDEX", keys.indexNames); err != nil {
+			return all, err
+		}
+	}
+	return all, nil
+}
+
+// parseDeferredKeys finds the secondary indexes and foreign keys in the
+// output of SHOW CREATE TABLE
+func parseDeferredKeys(table string, create string) deferredKeys {
+	keys := deferredKeys{table: table}
+	for _, line := range strings.Split(create, "\n") {
+		def := strings.TrimSuffix(strings.TrimSpace(line), ",")
+		switch {
+		case strings.HasPrefix(def, "KEY "), strings.HasPrefix(def, "UNIQUE KEY "),
+			strings.HasPrefix(def, "FULLTEXT KEY "), strings.HasPrefix(def, "SPATIAL KEY "):
+			keys.indexes = append(keys.indexes, def)
+			keys.indexNames = append(keys.indexNames, firstIdentifier(def))
+		case strings.HasPrefix(def, "CONSTRAINT ") && strings.Contains(def, " FOREIGN KEY "):
+			keys.foreignKeys = append(keys.foreignKeys, def)
+			keys.fkNames = append(keys.fkNames, firstIdentifier(def))
+		}
+	}
+	return keys
+}
+
+// firstIdentifier returns the first backtick quoted identifier of s
+func firstIdentifier(s string) string {
+	start := strings.Index(s, "`")
+	if start < 0 {
+		return ""
+	}
+	var b strings.Builder
+	for i := start + 1; i < len(s); i++ {
+		if s[i] == '`' {
+			if i+1 < len(s) && s[i+1] == '`' {
+				i++
+			} else {
+				break
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func dropKeys(db *sql.DB, table string, clause string, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	drops := make([]string, len(names))
+	for i, name := range names {
+		drops[i] = clause + " " + quoteIdentifier(name)
+	}
+	_, err := db.Exec(fmt.Sprintf("ALTER TABLE %s %s", quoteIdentifier(table), strings.Join(drops, ", ")))
+	return err
+}
+
+func addKeys(db *sql.DB, table string, defs []string) error {
+	if len(defs) == 0 {
+		return nil
+	}
+	_, err := db.Exec(addKeysStatement(table, defs))
+	return err
+}
+
+// addForeignKeys creates the deferred foreign keys without checking the
+// rows, which come from a consistent snapshot. The checks are disabled on a
+// connection of its own and enabled again before it returns to the pool.
+func addForeignKeys(db *sql.DB, deferred []deferredKeys) (err error) {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeErr(conn, &err)
+
+	if _, err := conn.ExecContext(ctx, "SET foreign_key_checks = 0"); err != nil {
+		return err
+	}
+	defer func() {
+		if _, setErr := conn.ExecContext(ctx, "SET foreign_key_checks = 1"); setErr != nil && err == nil {
+			err = setErr
+		}
+	}()
+	for i := range deferred {
+		if len(deferred[i].foreignKeys) > 0 {
+			if _, err := conn.ExecContext(ctx, addKeysStatement(deferred[i].table, deferred[i].foreignKeys)); err != nil {
+				return err
+			}
+		}
+		deferred[i].foreignKeysAdded = true
+	}
+	return nil
+}
+
+func addKeysStatement(table string, defs []string) string {
+	adds := make([]string, len(defs))
+	for i, def := range defs {
+		adds[i] = "ADD " + def
+	}
+	return fmt.Sprintf("ALTER TABLE %s %s", quoteIdentifier(table), strings.Join(adds, ", "))
+}
+
+// logMissingKeys logs the statements creating the deferred keys which were
+// not created again, once the import failed
+func logMissingKeys(log *logging.Logger, deferred []deferredKeys) {
+	for _, keys := range deferred {
+		if !keys.indexesAdded && len(keys.indexes) > 0 {
+			log.Errorf("Indexes of %s were dropped, create them with: %s", keys.table, addKeysStatement(keys.table, keys.indexes))
+		}
+		if !keys.foreignKeysAdded && len(keys.foreignKeys) > 0 {
+			log.Errorf("Foreign keys of %s were dropped, create them with: %s", keys.table, addKeysStatement(keys.table, keys.foreignKeys))
+		}
+	}
+}
+
+// runParallel calls fn for 0..n-1 with at most workers calls at a time, it
+// returns the first error
+func runParallel(workers int, n int, fn func(int) error) error {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+
+	sem := make(chan struct{}, workers)
+	for i := 0; i < n; i++ {
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			break
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := fn(i); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	return firstErr
+}
@@ -0,0 +1,59 @@
+package database
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gossion/migration-producer/pkg/logging"
+)
+
+const createOrders = "CREATE TABLE `orders` (\n" +
+	"  `id` int(11) NOT NULL AUTO_INCREMENT,\n" +
+	"  `user_id` int(11) NOT NULL,\n" +
+	"  `code` varchar(8) NOT NULL,\n" +
+	"  PRIMARY KEY (`id`),\n" +
+	"  UNIQUE KEY `code` (`code`),\n" +
+	"  KEY `user` (`user_id`),\n" +
+	"  CONSTRAINT `fk_user` FOREIGN KEY (`user_id`) REFERENCES `users` (`id`) ON DELETE CASCADE\n" +
+	") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4"
+
+func TestParseDeferredKeys(t *testing.T) {
+	keys := parseDeferredKeys("orders", createOrders)
+	want := deferredKeys{
+		table:       "orders",
+		indexes:     []string{"UNIQUE KEY `code` (`code`)", "KEY `user` (`user_id`)"},
+		indexNames:  []string{"code", "user"},
+		foreignKeys: []string{"CONSTRAINT `fk_user` FOREIGN KEY (`user_id`) REFERENCES `users` (`id`) ON DELETE CASCADE"},
+		fkNames:     []string{"fk_user"},
+	}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("parseDeferredKeys() = %+v, want %+v", keys, want)
+	}
+}
+
+func TestLogMissingKeys(t *testing.T) {
+	var buf bytes.Buffer
+	log, err := logging.New(&buf, logging.TextFormat, logging.InfoLevel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := parseDeferredKeys("orders", createOrders)
+	logMissingKeys(log, []deferredKeys{keys})
+	for _, want := range []string{
+		"ALTER TABLE `orders` ADD UNIQUE KEY `code` (`code`), ADD KEY `user` (`user_id`)",
+		"ALTER TABLE `orders` ADD CONSTRAINT `fk_user` FOREIGN KEY",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("log lacks %s:\n%s", want, buf.String())
+		}
+	}
+
+	buf.Reset()
+	keys.indexesAdded = true
+	logMissingKeys(log, []deferredKeys{keys})
+	if strings.Contains(buf.String(), "ADD KEY") || !strings.Contains(buf.String(), "FOREIGN KEY") {
+		t.Errorf("log of the missing foreign keys only:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,43 @@
+package database
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/gossion/migration-producer/pkg/retry"
+)
+
+// mysqlRetryableErrors are the codes of the transient errors of the server
+// and the client
+var mysqlRetryableErrors = map[int]bool{
+	1040: true, // too many connections
+	1205: true, // lock wait timeout exceeded
+	1213: true, // deadlock found when trying to get lock
+	2002: true, // can't connect through socket
+	2003: true, // can't connect
+	2006: true, // server has gone away
+	2013: true, // lost connection during query
+}
+
+// mysqlErrorCode matches the codes of the errors of the mysql tools, e.g.
+// "ERROR 2013 (HY000): Lost connection" or "mysqldump: Got error: 2013: Lost
+// connection"
+var mysqlErrorCode = regexp.MustCompile(`(?i)\berror:? (\d{4})\b`)
+
+func (drv MySQLDriver) Retryable(err error) bool {
+	var myErr *mysql.MySQLError
+	if errors.As(err, &myErr) {
+		return mysqlRetryableErrors[int(myErr.Number)]
+	}
+	if err == mysql.ErrInvalidConn {
+		return true
+	}
+	for _, m := range mysqlErrorCode.FindAllStringSubmatch(err.Error(), -1) {
+		if code, _ := strconv.Atoi(m[1]); mysqlRetryableErrors[code] {
+			return true
+		}
+	}
+	return retry.Temporary(err)
+}
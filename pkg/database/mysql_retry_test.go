@@ -0,0 +1,36 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestMySQLRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&mysql.MySQLError{Number: 1205, Message: "Lock wait timeout exceeded"}, true},
+		{&mysql.MySQLError{Number: 1213, Message: "Deadlock found when trying to get lock"}, true},
+		{fmt.Errorf("checksum: %w", &mysql.MySQLError{Number: 1213}), true},
+		{&mysql.MySQLError{Number: 1064, Message: "You have an error in your SQL syntax"}, false},
+		{&mysql.MySQLError{Number: 1146, Message: "Table 'shop.orders' doesn't exist"}, false},
+		{mysql.ErrInvalidConn, true},
+		{errors.New("ERROR 2006 (HY000) at line 12: MySQL server has gone away"), true},
+		{errors.New("mysqldump: Got error: 2013: Lost connection to MySQL server during query when dumping table `orders` at row: 1024"), true},
+		{errors.New("ERROR 1045 (28000): Access denied for user 'root'@'localhost'"), false},
+		{errors.New("mysqldump: Got error: 1044: Access denied for user 'app' to database 'shop' when selecting the database"), false},
+		{errors.New("error 2013 without a colon is still a code"), true},
+		{errors.New("dumped 2013 rows"), false},
+		{fmt.Errorf("dial: %w", syscall.ECONNREFUSED), true},
+	}
+	for _, tt := range tests {
+		if got := (MySQLDriver{}).Retryable(tt.err); got != tt.want {
+			t.Errorf("Retryable(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
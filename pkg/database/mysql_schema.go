@@ -0,0 +1,201 @@
+package database
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// readMySQLSchema introspects the base tables of the database name selected by
+// the options, and its views, triggers and routines through information_schema
+func readMySQLSchema(db *sql.DB, name string, opts Options) (*Schema, error) {
+	schema := &Schema{}
+	tables := map[string]*Table{}
+
+	rows, err := db.Query(`SELECT TABLE_NAME, TABLE_TYPE, IFNULL(ENGINE, ''), IFNULL(TABLE_COLLATION, ''), IFNULL(TABLE_ROWS, 0)
+		FROM information_schema.TABLES WHERE TABLE_SCHEMA = ? ORDER BY TABLE_NAME`, name)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var t Table
+		var kind string
+		if err := rows.Scan(&t.Name, &kind, &t.Engine, &t.Collation, &t.Rows); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if kind != "BASE TABLE" {
+			opts.Log.With("driver", "mysql", "table", t.Name).Debugf("Skipping %s %s", kind, t.Name)
+			continue
+		}
+		if !opts.MatchTable(t.Name) {
+			continue
+		}
+		schema.Tables = append(schema.Tables, t)
+	}
+	if err := closeRows(rows); err != nil {
+		return nil, err
+	}
+	for i := range schema.Tables {
+		tables[schema.Tables[i].Name] = &schema.Tables[i]
+	}
+
+	rows, err = db.Query(`SELECT TABLE_NAME, COLUMN_NAME, DATA_TYPE, COLUMN_TYPE, IS_NULLABLE,
+			COLUMN_DEFAULT, EXTRA, IFNULL(CHARACTER_SET_NAME, ''), IFNULL(COLLATION_NAME, '')
+		FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = ? ORDER BY TABLE_NAME, ORDINAL_POSITION`, name)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var table, nullable string
+		var def sql.NullString
+		var c Column
+		if err := rows.Scan(&table, &c.Name, &c.DataType, &c.ColumnType, &nullable,
+			&def, &c.Extra, &c.CharacterSet, &c.Collation); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if def.Valid {
+			c.Default = &def.String
+		}
+		c.Nullable = nullable == "YES"
+		if t, ok := tables[table]; ok {
+			t.Columns = append(t.Columns, c)
+		}
+	}
+	if err := closeRows(rows); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.Query(`SELECT TABLE_NAME, INDEX_NAME, NON_UNIQUE, INDEX_TYPE, COLUMN_NAME
+		FROM information_schema.STATISTICS WHERE TABLE_SCHEMA = ? ORDER BY TABLE_NAME, INDEX_NAME, SEQ_IN_INDEX`, name)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var table, index, kind string
+		var nonUnique int
+		var column sql.NullString
+		if err := rows.Scan(&table, &index, &nonUnique, &kind, &column); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		t, ok := tables[table]
+		if !ok {
+			continue
+		}
+		n := len(t.Indexes)
+		if n == 0 || t.Indexes[n-1].Name != index {
+			t.Indexes = append(t.Indexes, Index{Name: index, Unique: nonUnique == 0, Type: kind})
+			n++
+		}
+		// functional key parts have no column
+		if column.Valid {
+			t.Indexes[n-1].Columns = append(t.Indexes[n-1].Columns, column.String)
+		}
+	}
+	if err := closeRows(rows); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.Query(`SELECT k.TABLE_NAME, k.CONSTRAINT_NAME, k.COLUMN_NAME,
+			k.REFERENCED_TABLE_NAME, k.REFERENCED_COLUMN_NAME, r.UPDATE_RULE, r.DELETE_RULE
+		FROM information_schema.KEY_COLUMN_USAGE k
+		JOIN information_schema.REFERENTIAL_CONSTRAINTS r
+			ON r.CONSTRAINT_SCHEMA = k.CONSTRAINT_SCHEMA AND r.CONSTRAINT_NAME = k.CONSTRAINT_NAME AND r.TABLE_NAME = k.TABLE_NAME
+		WHERE k.TABLE_SCHEMA = ? AND k.REFERENCED_TABLE_NAME IS NOT NULL
+		ORDER BY k.TABLE_NAME, k.CONSTRAINT_NAME, k.ORDINAL_POSITION`, name)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var table, constraint, column, refTable, refColumn, onUpdate, onDelete string
+		if err := rows.Scan(&table, &constraint, &column, &refTable, &refColumn, &onUpdate, &onDelete); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		t, ok := tables[table]
+		if !ok {
+			continue
+		}
+		n := len(t.ForeignKeys)
+		if n == 0 || t.ForeignKeys[n-1].Name != constraint {
+			t.ForeignKeys = append(t.ForeignKeys, ForeignKey{
+				Name:            constraint,
+				ReferencedTable: refTable,
+				OnUpdate:        onUpdate,
+				OnDelete:        onDelete,
+			})
+			n++
+		}
+		t.ForeignKeys[n-1].Columns = append(t.ForeignKeys[n-1].Columns, column)
+		t.ForeignKeys[n-1].ReferencedColumns = append(t.ForeignKeys[n-1].ReferencedColumns, refColumn)
+	}
+	if err := closeRows(rows); err != nil {
+		return nil, err
+	}
+
+	return schema, readMySQLObjects(db, name, opts, schema)
+}
+
+// readMySQLObjects introspects the views, triggers and routines of the
+// database name, the views and triggers of tables selected by the options
+func readMySQLObjects(db *sql.DB, name string, opts Options, schema *Schema) error {
+	// definitions qualify the objects of their own database
+	qualifier := quoteIdentifier(name) + "."
+
+	rows, err := db.Query(`SELECT TABLE_NAME, VIEW_DEFINITION
+		FROM information_schema.VIEWS WHERE TABLE_SCHEMA = ? ORDER BY TABLE_NAME`, name)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var v View
+		if err := rows.Scan(&v.Name, &v.Definition); err != nil {
+			rows.Close()
+			return err
+		}
+		if opts.MatchTable(v.Name) {
+			v.Definition = strings.Replace(v.Definition, qualifier, "", -1)
+			schema.Views = append(schema.Views, v)
+		}
+	}
+	if err := closeRows(rows); err != nil {
+		return err
+	}
+
+	rows, err = db.Query(`SELECT TRIGGER_NAME, EVENT_OBJECT_TABLE, ACTION_TIMING, EVENT_MANIPULATION, ACTION_STATEMENT
+		FROM information_schema.TRIGGERS WHERE TRIGGER_SCHEMA = ? ORDER BY TRIGGER_NAME`, name)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var t Trigger
+		if err := rows.Scan(&t.Name, &t.Table, &t.Timing, &t.Event, &t.Statement); err != nil {
+			rows.Close()
+			return err
+		}
+		if opts.MatchTable(t.Table) {
+			t.Statement = strings.Replace(t.Statement, qualifier, "", -1)
+			schema.Triggers = append(schema.Triggers, t)
+		}
+	}
+	if err := closeRows(rows); err != nil {
+		return err
+	}
+
+	rows, err = db.Query(`SELECT ROUTINE_NAME, ROUTINE_TYPE, IFNULL(DTD_IDENTIFIER, ''), IFNULL(ROUTINE_DEFINITION, '')
+		FROM information_schema.ROUTINES WHERE ROUTINE_SCHEMA = ? ORDER BY ROUTINE_TYPE, ROUTINE_NAME`, name)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var r Routine
+		if err := rows.Scan(&r.Name, &r.Type, &r.Returns, &r.Definition); err != nil {
+			rows.Close()
+			return err
+		}
+		r.Definition = strings.Replace(r.Definition, qualifier, "", -1)
+		schema.Routines = append(schema.Routines, r)
+	}
+	return closeRows(rows)
+}
@@ -0,0 +1,88 @@
+package database
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"net/url"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// mysqlSSLModes are the --ssl-mode values of the mysql tools
+var mysqlSSLModes = map[string]string{
+	TLSDisable:    "DISABLED",
+	TLSPreferred:  "PREFERRED",
+	TLSRequired:   "REQUIRED",
+	TLSVerifyCA:   "VERIFY_CA",
+	TLSVerifyFull: "VERIFY_IDENTITY",
+}
+
+// openMySQL opens a connection pool with the TLS parameters of the URL. The
+// vendored go-sql-driver/mysql cannot fall back to plain text, so the
+// preferred mode retries without TLS when the server does not support it.
+func openMySQL(u *url.URL) (*sql.DB, error) {
+	p, err := parseTLSParams(u)
+	if err != nil {
+		return nil, err
+	}
+	name, err := registerMySQLTLS(p, u.Hostname())
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("mysql", normalizeMySQLURL(u, name))
+	if err != nil || p.mode != TLSPreferred {
+		return db, err
+	}
+	if err := db.Ping(); err == mysql.ErrNoTLS {
+		db.Close()
+		return sql.Open("mysql", normalizeMySQLURL(u, "false"))
+	}
+	return db, nil
+}
+
+// registerMySQLTLS registers the TLS configuration of the parameters with
+// go-sql-driver/mysql, it returns the value of its tls parameter. The name
+// of the configuration is derived from the parameters, so that connections
+// with the same ones share it.
+func registerMySQLTLS(p tlsParams, host string) (string, error) {
+	switch p.mode {
+	case "":
+		return "", nil
+	case TLSDisable:
+		return "false", nil
+	}
+
+	cfg, err := p.config(host)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%q", []string{p.mode, p.ca, p.cert, p.key, host})))
+	name := fmt.Sprintf("migrator-%x", sum[:8])
+	if err := mysql.RegisterTLSConfig(name, cfg); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// mysqlTLSArgs returns the TLS options of the mysql tools, of MySQL 5.7.11 or
+// later
+func mysqlTLSArgs(u *url.URL) ([]string, error) {
+	p, err := parseTLSParams(u)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{}
+	if p.mode != "" {
+		args = append(args, "--ssl-mode="+mysqlSSLModes[p.mode])
+	}
+	if p.ca != "" {
+		args = append(args, "--ssl-ca="+p.ca)
+	}
+	if p.cert != "" {
+		args = append(args, "--ssl-cert="+p.cert, "--ssl-key="+p.key)
+	}
+	return args, nil
+}
@@ -0,0 +1,267 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/gossion/migration-producer/pkg/logging"
+	"github.com/gossion/migration-producer/pkg/retry"
+	"github.com/gossion/migration-producer/pkg/utils"
+)
+
+// Options narrows down what a driver exports, imports or summarizes.
+// The zero value selects everything.
+type Options struct {
+	// IncludeTables limits the migration to tables matching one of the glob
+	// patterns. An empty list includes all tables.
+	IncludeTables []string
+	// ExcludeTables skips tables matching one of the glob patterns, even if
+	// they are included.
+	ExcludeTables []string
+	// Where maps a table name to a SQL predicate, only rows matching the
+	// predicate are migrated.
+	Where map[string]string
+	// NoData exports table definitions and routines without rows.
+	NoData bool
+	// NoSchema exports rows only, the tables must already exist on the
+	// destination.
+	NoSchema bool
+	// SkipViews leaves the views out of the row counts, e.g. of a source
+	// converted to another engine without its views.
+	SkipViews bool
+	// SourceDatabase is the name of the exported database. When it differs
+	// from the database imported into, references to it in the dump are
+	// rewritten to the new name.
+	SourceDatabase string
+	// RenameTables maps source table names to destination table names. Table
+	// filters and row filters always use the source names.
+	RenameTables map[string]string
+	// Parallelism is the number of tables exported or imported concurrently
+	// by drivers supporting it, DefaultParallelism when not set.
+	Parallelism int
+	// Compression is the codec compressing the exported files, Gzip, Zstd or
+	// NoCompression. Imports detect the codec of a file by itself.
+	Compression string
+	// Encryption encrypts the exported files when it sets a key. Imports
+	// detect encrypted files by themselves, and need the same key.
+	Encryption Encryption
+	// Charset converts the tables and text columns of other character sets
+	// to this one, e.g. utf8mb4. Binary columns are left alone.
+	Charset string
+	// Collation replaces the collations of converted columns, binary
+	// collations are replaced with the binary collation of Charset. It
+	// defaults to the unicode collation of Charset.
+	Collation string
+	// Masks maps source columns, as table.column, to the masking rule of
+	// their values, e.g. hash or constant:REDACTED. Only drivers copying
+	// the rows themselves can mask them.
+	Masks map[string]string
+	// MaskKey is the secret of the hashes of masked values, the same key
+	// masks the same values alike across tables and migrations. The hash,
+	// email and format rules require it.
+	MaskKey string
+	// Log is the logger of the driver, the default one when not set
+	Log *logging.Logger
+	// Retry is the policy of the idempotent operations failing on transient
+	// errors, e.g. pings and row counts, retry.DefaultPolicy when not set
+	Retry retry.Policy
+
+	// destination matches the table filters with the source names of the
+	// renamed tables
+	destination bool
+}
+
+// DefaultParallelism is the number of concurrent exports or imports when not
+// set in the options
+const DefaultParallelism = 4
+
+// Validate checks that the options are consistent and well formed.
+func (o Options) Validate() error {
+	// nothing would be migrated
+	if o.NoData && o.NoSchema {
+		return errors.New("NoData and NoSchema are mutually exclusive")
+	}
+	switch o.Codec() {
+	case NoCompression, Gzip, Zstd:
+	default:
+		return fmt.Errorf("unsupported compression: %s", o.Compression)
+	}
+	if err := o.Encryption.Validate(); err != nil {
+		return err
+	}
+	// the collation only applies to the converted columns
+	if o.Collation != "" && o.Charset == "" {
+		return fmt.Errorf("collation %s needs the character set it converts to, e.g. %s", o.Collation, collationCharset(o.Collation))
+	}
+	if o.Collation != "" && !strings.HasPrefix(strings.ToLower(o.Collation), strings.ToLower(o.Charset)+"_") {
+		return fmt.Errorf("collation %s is not a collation of the character set %q", o.Collation, o.Charset)
+	}
+	// the masked columns are checked against the schema once it is read
+	for column, rule := range o.Masks {
+		if _, _, err := splitMaskedColumn(column); err != nil {
+			return err
+		}
+		r, err := ParseMaskRule(rule)
+		if err != nil {
+			return err
+		}
+		if r.Keyed() && o.MaskKey == "" {
+			return fmt.Errorf("masking rule %s of %s needs a mask key", r.Kind, column)
+		}
+	}
+	for _, pattern := range append(append([]string{}, o.IncludeTables...), o.ExcludeTables...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid table pattern %q: %s", pattern, err)
+		}
+	}
+	return nil
+}
+
+// RowFilter returns the predicate rows of table must match, or an empty string
+// when all rows are migrated.
+func (o Options) RowFilter(table string) string {
+	return strings.TrimSpace(o.Where[table])
+}
+
+// WithoutRowFilters returns a copy of the options selecting all rows, e.g. to
+// summarize a destination which only holds the filtered rows.
+func (o Options) WithoutRowFilters() Options {
+	o.Where = nil
+	return o
+}
+
+// ForDestination returns a copy of the options querying the destination of
+// a migration: all rows are selected, it only holds the filtered ones, and
+// the table filters match the renamed tables by their source names.
+func (o Options) ForDestination() Options {
+	o = o.WithoutRowFilters()
+	o.destination = true
+	return o
+}
+
+// WithLog returns a copy of the options logging to l, e.g. with the fields
+// of a phase.
+func (o Options) WithLog(l *logging.Logger) Options {
+	o.Log = l
+	return o
+}
+
+// Retried runs an idempotent operation of the driver, e.g. GetSum, retrying
+// it on the transient errors of the driver with the retry policy
+func (o Options) Retried(drv DatabaseDriver, operation string, fn func() error) error {
+	retryable := func(err error) bool { return Retryable(drv, err) }
+	return o.Retry.Do(o.Log, operation, retryable, fn)
+}
+
+// runner runs the external commands of a driver with the logger of the
+// options
+func (o Options) runner(driver string) utils.Runner {
+	return utils.Runner{Log: o.Log.With("driver", driver)}
+}
+
+// DestinationTable returns the name of table in the destination.
+func (o Options) DestinationTable(table string) string {
+	if renamed, ok := o.RenameTables[table]; ok && renamed != "" {
+		return renamed
+	}
+	return table
+}
+
+// Codec returns the compression codec of exported files.
+func (o Options) Codec() string {
+	if o.Compression == "" {
+		return NoCompression
+	}
+	return o.Compression
+}
+
+// Workers returns the number of concurrent exports or imports.
+func (o Options) Workers() int {
+	if o.Parallelism > 0 {
+		return o.Parallelism
+	}
+	return DefaultParallelism
+}
+
+// Filtered reports whether any table filter is set. Row filters are not
+// considered.
+func (o Options) Filtered() bool {
+	return len(o.IncludeTables) > 0 || len(o.ExcludeTables) > 0
+}
+
+// ConvertCharset returns the character set replacing charset, which is
+// unchanged when not converting or binary.
+func (o Options) ConvertCharset(charset string) string {
+	if o.Charset == "" || strings.EqualFold(charset, "binary") || charset == "" {
+		return charset
+	}
+	return strings.ToLower(o.Charset)
+}
+
+// ConvertCollation returns the collation replacing collation, which is
+// unchanged when not converting or binary.
+func (o Options) ConvertCollation(collation string) string {
+	if o.Charset == "" || strings.EqualFold(collation, "binary") || collation == "" {
+		return collation
+	}
+	if strings.HasSuffix(strings.ToLower(collation), "_bin") {
+		return strings.ToLower(o.Charset) + "_bin"
+	}
+	if o.Collation != "" {
+		return strings.ToLower(o.Collation)
+	}
+	return strings.ToLower(o.Charset) + "_unicode_ci"
+}
+
+// collationCharset returns the character set a collation name starts with
+func collationCharset(collation string) string {
+	if i := strings.IndexByte(collation, '_'); i > 0 {
+		return collation[:i]
+	}
+	return collation
+}
+
+// SourceTable returns the name in the source of a destination table.
+func (o Options) SourceTable(table string) string {
+	for source, renamed := range o.RenameTables {
+		if renamed == table {
+			return source
+		}
+	}
+	return table
+}
+
+// MatchTable reports whether table should be migrated, a table of the
+// destination when the options are for it.
+func (o Options) MatchTable(table string) bool {
+	if o.destination {
+		table = o.SourceTable(table)
+	}
+	if len(o.IncludeTables) > 0 && !matchAny(o.IncludeTables, table) {
+		return false
+	}
+	return !matchAny(o.ExcludeTables, table)
+}
+
+// FilterTables splits tables into the ones to migrate and the ones to skip.
+func (o Options) FilterTables(tables []string) (included, excluded []string) {
+	for _, table := range tables {
+		if o.MatchTable(table) {
+			included = append(included, table)
+		} else {
+			excluded = append(excluded, table)
+		}
+	}
+	return included, excluded
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+package database
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestForDestinationMatchTable(t *testing.T) {
+	opts := Options{
+		IncludeTables: []string{"orders*", "users"},
+		ExcludeTables: []string{"orders_tmp"},
+		RenameTables:  map[string]string{"orders": "sales", "orders_tmp": "scratch", "users": "customers"},
+		Where:         map[string]string{"orders": "id > 10"},
+	}
+	dst := opts.ForDestination()
+	if dst.RowFilter("orders") != "" {
+		t.Errorf("ForDestination() kept the row filters")
+	}
+
+	tests := []struct {
+		table string
+		want  bool
+	}{
+		{"sales", true},
+		{"customers", true},
+		{"orders_2020", true},
+		{"scratch", false},
+		{"orders", true},
+		{"users", true},
+		{"other", false},
+	}
+	for _, tt := range tests {
+		if got := dst.MatchTable(tt.table); got != tt.want {
+			t.Errorf("MatchTable(%q) = %v, want %v", tt.table, got, tt.want)
+		}
+	}
+	if opts.MatchTable("sales") {
+		t.Errorf("MatchTable(%q) of the source options matched a destination name", "sales")
+	}
+}
+
+func TestValidateCollation(t *testing.T) {
+	tests := []struct {
+		charset, collation string
+		err                string
+	}{
+		{charset: "utf8mb4"},
+		{charset: "utf8mb4", collation: "utf8mb4_0900_ai_ci"},
+		{charset: "UTF8MB4", collation: "utf8mb4_bin"},
+		{collation: "utf8mb4_bin", err: "needs the character set it converts to, e.g. utf8mb4"},
+		{charset: "utf8mb4", collation: "latin1_bin", err: "is not a collation of the character set"},
+	}
+	for _, tt := range tests {
+		err := Options{Charset: tt.charset, Collation: tt.collation}.Validate()
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("Validate() of %q and %q = %v, want %q", tt.charset, tt.collation, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,409 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/gossion/migration-producer/pkg/datatype"
+	"github.com/gossion/migration-producer/pkg/logging"
+	"github.com/gossion/migration-producer/pkg/retry"
+	"github.com/gossion/migration-producer/pkg/utils"
+)
+
+func init() {
+	RegisterDriver(PostgreSQLDriver{}, "postgres")
+	RegisterDriver(PostgreSQLDriver{}, "postgresql")
+}
+
+// PostgreSQLDriver provides top level database functions through the psql and
+// pg_dump tools
+type PostgreSQLDriver struct {
+}
+
+// log returns the logger of the options with the driver field
+func (drv PostgreSQLDriver) log(opts Options) *logging.Logger {
+	return opts.Log.With("driver", "postgres")
+}
+
+// check if psql, pg_dump exist in env
+func (drv PostgreSQLDriver) CheckDependency() error {
+	cmds := []string{"psql", "pg_dump"}
+	log := drv.log(Options{})
+	log.Debugf("Checking cmd dependency: %s", cmds)
+
+	for _, cmd := range cmds {
+		if _, err := exec.LookPath(cmd); err != nil {
+			log.Errorf("%s", err)
+			return err
+		}
+	}
+	return nil
+}
+
+func (drv PostgreSQLDriver) Ping(u *url.URL) error {
+	_, err := drv.query(maintenanceURL(u), Options{}, "SELECT 1")
+	return err
+}
+
+// Open is not supported, no database/sql driver of postgres is built in: the
+// queries of the driver run through psql.
+func (drv PostgreSQLDriver) Open(u *url.URL) (*sql.DB, error) {
+	return nil, errors.New("The postgres driver has no database/sql connection, its queries run through psql")
+}
+
+func (drv PostgreSQLDriver) Version(u *url.URL) (string, error) {
+	out, err := drv.query(maintenanceURL(u), Options{}, "SHOW server_version")
+	if err != nil {
+		return "", err
+	}
+	if len(out) != 1 {
+		return "", fmt.Errorf("unexpected server version: %v", out)
+	}
+	return out[0], nil
+}
+
+// GetServerInfo describes the version and encoding of the server, postgres
+// has no engines nor per table collations to compare
+func (drv PostgreSQLDriver) GetServerInfo(u *url.URL, opts Options) (*ServerInfo, error) {
+	version, err := drv.Version(u)
+	if err != nil {
+		return nil, err
+	}
+	encoding, err := drv.query(maintenanceURL(u), opts, "SHOW server_encoding")
+	if err != nil {
+		return nil, err
+	}
+	if len(encoding) != 1 {
+		return nil, fmt.Errorf("unexpected server encoding: %v", encoding)
+	}
+	return &ServerInfo{Version: version, Flavor: PostgreSQL, CharacterSet: encoding[0]}, nil
+}
+
+func (drv PostgreSQLDriver) Export(u *url.URL, opts Options) (_ *Dump, err error) {
+	if len(opts.Where) > 0 {
+		return nil, errors.New("Row filters are not supported by pg_dump")
+	}
+	if opts.Charset != "" {
+		return nil, errors.New("Converting character sets is not supported by the postgres driver")
+	}
+	if len(opts.Masks) > 0 && !opts.NoData {
+		return nil, errors.New("Masking columns is not supported by pg_dump")
+	}
+	if err := checkCodec(opts.Compression); err != nil {
+		return nil, err
+	}
+
+	log := drv.log(opts)
+	tmpfile, err := ioutil.TempFile("", "postgres-")
+	if err != nil {
+		log.Errorf("%s", err)
+		return nil, err
+	}
+	defer tmpfile.Close()
+	// a failed export leaves no partial dump behind
+	defer func() {
+		if err != nil {
+			os.Remove(tmpfile.Name())
+		}
+	}()
+
+	log.Infof("Will export postgres db to file: %s", tmpfile.Name())
+
+	out, err := newDumpFile(tmpfile, opts)
+	if err != nil {
+		return nil, err
+	}
+	args, err := pgDumpArgs(u, opts)
+	if err != nil {
+		out.Close()
+		return nil, err
+	}
+	output, err := pgRunner(u, opts).RunCommandOutTOFile("pg_dump", out, args...)
+	if err != nil {
+		out.Close()
+		return nil, err
+	}
+	if err := out.Close(); err != nil {
+		log.Errorf("Error closing exported file: %s", err)
+		return nil, err
+	}
+
+	if out.rawSize == 0 {
+		log.Errorf("Nothing was exported to file: %s", tmpfile.Name())
+		return nil, errors.New("Nothing exported")
+	}
+
+	log.With("command", "pg_dump").Debugf("pg_dump output: %s", output)
+	dump := &Dump{Path: tmpfile.Name(), Codec: opts.Codec(), Encrypted: opts.Encryption.Enabled()}
+	dump.add(out)
+	return dump, nil
+}
+
+func (drv PostgreSQLDriver) Import(u *url.URL, filename string, opts Options) (err error) {
+	if len(opts.RenameTables) > 0 {
+		return errors.New("Renaming tables is not supported by the postgres driver")
+	}
+	if opts.Charset != "" {
+		return errors.New("Converting character sets is not supported by the postgres driver")
+	}
+
+	log := drv.log(opts)
+	if err := drv.CreateDbIfNotExists(u); err != nil {
+		log.Errorf("%s", err)
+		return err
+	}
+
+	log.Infof("Will import postgres db from file: %s", filename)
+
+	f, err := openDumpFile(filename, opts.Encryption)
+	if err != nil {
+		log.Errorf("Failed to open file %s", filename)
+		return err
+	}
+	// a corrupt compressed dump fails once decompressed
+	defer closeErr(f, &err)
+
+	args, err := psqlArgs(u)
+	if err != nil {
+		return err
+	}
+	_, err = pgRunner(u, opts).RunCommandWithStdin("psql", f, args...)
+	return err
+}
+
+// Lock is a no-op, pg_dump reads from a consistent snapshot and postgres has
+// no lock blocking writes to a whole database.
+func (drv PostgreSQLDriver) Lock(u *url.URL) error {
+	_, err := drv.LockSession(u, Options{})
+	return err
+}
+
+func (drv PostgreSQLDriver) UnLock(u *url.URL) error {
+	return nil
+}
+
+// LockSession is a no-op like Lock, the skipped lock is logged with the
+// logger of the options.
+func (drv PostgreSQLDriver) LockSession(u *url.URL, opts Options) (func() error, error) {
+	drv.log(opts).Warnf("Locking is not supported by postgres, skipped: %s", u.Host)
+	return func() error { return nil }, nil
+}
+
+func (drv PostgreSQLDriver) GetSum(u *url.URL, opts Options) (map[string]int, error) {
+	sum := make(map[string]int)
+
+	tables, err := drv.query(u, opts, "SELECT tablename FROM pg_tables WHERE schemaname = current_schema() ORDER BY 1")
+	if err != nil {
+		return nil, err
+	}
+	tables, _ = opts.FilterTables(tables)
+
+	for _, table := range tables {
+		query := fmt.Sprintf("SELECT COUNT(*) FROM %s", quotePostgreSQLIdentifier(table))
+		if where := opts.RowFilter(table); where != "" {
+			query = fmt.Sprintf("%s WHERE %s", query, where)
+		}
+		out, err := drv.query(u, opts, query)
+		if err != nil {
+			return nil, err
+		}
+		if len(out) != 1 {
+			return nil, fmt.Errorf("unexpected count of table %s: %v", table, out)
+		}
+		count, err := strconv.Atoi(out[0])
+		if err != nil {
+			return nil, err
+		}
+		sum[table] = count
+	}
+
+	drv.log(opts).Infof("Row counts: %v", sum)
+
+	return sum, nil
+}
+
+// Create database if it is not exist
+func (drv PostgreSQLDriver) CreateDbIfNotExists(u *url.URL) error {
+	name := databaseName(u)
+	root := maintenanceURL(u)
+
+	log := drv.log(Options{})
+	out, err := drv.query(root, Options{}, fmt.Sprintf("SELECT 1 FROM pg_database WHERE datname = %s", quotePostgreSQLLiteral(name)))
+	if err != nil {
+		log.Errorf("Failed to query db %s", name)
+		return err
+	}
+	if len(out) > 0 {
+		return nil
+	}
+
+	if _, err := drv.query(root, Options{}, "CREATE DATABASE "+quotePostgreSQLIdentifier(name)); err != nil {
+		log.Errorf("Failed to create db %s", name)
+		return err
+	}
+	return nil
+}
+
+// query runs a statement with psql and returns the output lines, logging
+// with the options
+func (drv PostgreSQLDriver) query(u *url.URL, opts Options, query string) ([]string, error) {
+	args, err := psqlArgs(u)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, "--no-align", "--tuples-only", "--command="+query)
+	out, err := pgRunner(u, opts).RunCommand("psql", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := []string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+// pgRetryableErrors are the messages of the transient errors reported by
+// psql and pg_dump
+var pgRetryableErrors = []string{
+	"could not connect to server",
+	"Connection refused",
+	"Connection timed out",
+	"timeout expired",
+	"server closed the connection unexpectedly",
+	"terminating connection due to administrator command",
+	"the database system is starting up",
+	"the database system is shutting down",
+	"sorry, too many clients already",
+	"deadlock detected",
+	"could not serialize access",
+}
+
+func (drv PostgreSQLDriver) Retryable(err error) bool {
+	for _, msg := range pgRetryableErrors {
+		if strings.Contains(err.Error(), msg) {
+			return true
+		}
+	}
+	return retry.Temporary(err)
+}
+
+// helpers
+
+// maintenanceURL returns the URL of the database which always exists
+func maintenanceURL(u *url.URL) *url.URL {
+	rootURL := *u
+	rootURL.Path = "/postgres"
+	return &rootURL
+}
+
+// psqlArgs returns command psql arguments
+func psqlArgs(u *url.URL) ([]string, error) {
+	conn, err := pgConnString(u)
+	if err != nil {
+		return nil, err
+	}
+	return []string{"--no-psqlrc", "--quiet", "--set=ON_ERROR_STOP=1", "--dbname=" + conn}, nil
+}
+
+// pgConnString returns the connection URL without the password, which is
+// passed by pgRunner
+func pgConnString(u *url.URL) (string, error) {
+	conn, err := pgURL(u)
+	if err != nil {
+		return "", err
+	}
+	if conn.User != nil {
+		conn.User = url.User(conn.User.Username())
+	}
+	return conn.String(), nil
+}
+
+// pgSSLModes are the libpq spellings of the TLS modes
+var pgSSLModes = map[string]string{
+	TLSDisable:    "disable",
+	TLSPreferred:  "prefer",
+	TLSRequired:   "require",
+	TLSVerifyCA:   "verify-ca",
+	TLSVerifyFull: "verify-full",
+}
+
+// pgURL returns a copy of the URL with the libpq spelling of its TLS mode,
+// as read by parseTLSParams, and of its socket. The other TLS parameters
+// are the libpq ones.
+func pgURL(u *url.URL) (*url.URL, error) {
+	p, err := parseTLSParams(u)
+	if err != nil {
+		return nil, err
+	}
+	conn := *u
+	q := conn.Query()
+	if p.mode != "" {
+		q.Set(tlsModeParam, pgSSLModes[p.mode])
+	}
+	if socket := q.Get(datatype.SocketParam); socket != "" {
+		// libpq reads the directory of the socket from the host parameter
+		q.Del(datatype.SocketParam)
+		q.Set("host", socket)
+		if port := conn.Port(); port != "" {
+			q.Set("port", port)
+		}
+		conn.Host = ""
+	}
+	conn.RawQuery = q.Encode()
+	return &conn, nil
+}
+
+// pgRunner runs the postgres tools with the password of the URL in their
+// environment, keeping it out of their command lines
+func pgRunner(u *url.URL, opts Options) utils.Runner {
+	r := opts.runner("postgres")
+	if password, set := u.User.Password(); set {
+		r.Env = []string{"PGPASSWORD=" + password}
+	}
+	return r
+}
+
+// pgDumpArgs return arguments for pg_dump
+func pgDumpArgs(u *url.URL, opts Options) ([]string, error) {
+	args := []string{"--no-owner", "--no-privileges"}
+
+	switch {
+	case opts.NoData:
+		args = append(args, "--schema-only")
+	case opts.NoSchema:
+		args = append(args, "--data-only")
+	}
+	for _, pattern := range opts.IncludeTables {
+		args = append(args, "--table="+pattern)
+	}
+	for _, pattern := range opts.ExcludeTables {
+		args = append(args, "--exclude-table="+pattern)
+	}
+
+	conn, err := pgConnString(u)
+	if err != nil {
+		return nil, err
+	}
+	return append(args, "--dbname="+conn), nil
+}
+
+// quotePostgreSQLIdentifier quotes a table or column name with double quotes
+func quotePostgreSQLIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// quotePostgreSQLLiteral quotes a string constant
+func quotePostgreSQLLiteral(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
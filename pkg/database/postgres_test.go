@@ -0,0 +1,44 @@
+package database
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestPgURL(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+		err   bool
+	}{
+		{query: "", want: ""},
+		{query: "sslmode=disabled", want: "disable"},
+		{query: "sslmode=preferred", want: "prefer"},
+		{query: "sslmode=REQUIRED", want: "require"},
+		{query: "sslmode=verify_ca", want: "verify-ca"},
+		{query: "sslmode=verify_identity", want: "verify-full"},
+		{query: "sslmode=verify-full", want: "verify-full"},
+		{query: "sslrootcert=/ca.pem", want: "verify-ca"},
+		{query: "sslcert=/c.pem&sslkey=/k.pem", want: "require"},
+		{query: "sslmode=strict", err: true},
+		{query: "sslcert=/c.pem", err: true},
+		{query: "sslmode=disable&sslrootcert=/ca.pem", err: true},
+	}
+	for _, tt := range tests {
+		u := &url.URL{Scheme: "postgres", Host: "db", Path: "/orders", RawQuery: tt.query}
+		conn, err := pgURL(u)
+		if tt.err {
+			if err == nil {
+				t.Errorf("pgURL(%q) = %s, want an error", tt.query, conn)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("pgURL(%q): %v", tt.query, err)
+			continue
+		}
+		if got := conn.Query().Get("sslmode"); got != tt.want {
+			t.Errorf("pgURL(%q) sslmode = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
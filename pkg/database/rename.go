@@ -0,0 +1,401 @@
+package database
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// tableKeywords are the words after which an identifier names a table, ON
+// only after the event of a trigger
+var tableKeywords = map[string]bool{
+	"TABLE":      true,
+	"TABLES":     true,
+	"VIEW":       true,
+	"INTO":       true,
+	"FROM":       true,
+	"JOIN":       true,
+	"UPDATE":     true,
+	"REFERENCES": true,
+	"ON":         true,
+	"EXISTS":     true,
+}
+
+// triggerEvents are the words after which ON names the table of a trigger
+var triggerEvents = map[string]bool{
+	"INSERT": true,
+	"UPDATE": true,
+	"DELETE": true,
+}
+
+// notIdentifiers are the words following the table keywords which are not
+// unquoted identifiers, e.g. IF in DROP TABLE IF EXISTS
+var notIdentifiers = map[string]bool{
+	"IF": true, "NOT": true, "EXISTS": true, "ON": true, "AS": true,
+	"IGNORE": true, "LOW_PRIORITY": true, "DELAYED": true, "HIGH_PRIORITY": true, "QUICK": true,
+	"SELECT": true, "SET": true, "VALUES": true, "VALUE": true, "WHERE": true, "USING": true,
+	"DUAL": true, "LATERAL": true, "ALL": true, "DISTINCT": true, "WITH": true,
+	"LEFT": true, "RIGHT": true, "INNER": true, "OUTER": true, "CROSS": true, "NATURAL": true, "STRAIGHT_JOIN": true,
+	"CASCADE": true, "RESTRICT": true, "NO": true, "NULL": true, "DEFAULT": true, "CURRENT_TIMESTAMP": true,
+	"NOWAIT": true, "SKIP": true, "LOCAL": true, "TEMPORARY": true,
+}
+
+// clauseKeywords end a list of tables, the identifiers after its commas are
+// not tables anymore
+var clauseKeywords = map[string]bool{
+	"WHERE": true, "ON": true, "USING": true, "SET": true, "VALUES": true, "VALUE": true,
+	"SELECT": true, "GROUP": true, "ORDER": true, "HAVING": true, "LIMIT": true,
+	"UNION": true, "WINDOW": true, "FOR": true, "PARTITION": true,
+}
+
+// databaseKeywords are the words after which a quoted identifier names a
+// database
+var databaseKeywords = map[string]bool{
+	"USE":      true,
+	"DATABASE": true,
+	"SCHEMA":   true,
+	"EXISTS":   true,
+}
+
+// qualifier kinds of an identifier
+const (
+	unqualified = iota
+	qualifiedByDatabase
+	qualifiedByTable
+)
+
+// renamer rewrites the database and table names of a SQL dump, quoted with
+// backticks or not, e.g. in the bodies of routines. String literals and
+// comments are copied as is. Tables are recognized by the keyword preceding
+// them, the list of tables following it, or by qualified names, so a column
+// which has the same name as a renamed table is left alone.
+type renamer struct {
+	sqlStream
+
+	fromDatabase string
+	toDatabase   string
+	opts         Options
+
+	// last and previous bare words of the statement, upper cased
+	lastWord string
+	prevWord string
+	// table keyword of the list of tables in progress, the identifiers
+	// after its commas are tables
+	tableList string
+	// whether the statement is about a database or a table
+	aboutDatabase bool
+	// whether the previous token was a quoted identifier
+	afterIdentifier bool
+	// qualifier of the next identifier
+	qualifier int
+}
+
+// renameDump copies the dump from src to dst, replacing references to the
+// source database of the options with the database to and renaming tables.
+func renameDump(dst io.Writer, src io.Reader, to string, opts Options) error {
+	rn := &renamer{
+		sqlStream:    newSQLStream(dst, src),
+		fromDatabase: opts.SourceDatabase,
+		toDatabase:   to,
+		opts:         opts,
+	}
+	if err := rn.run(); err != nil {
+		return err
+	}
+	return rn.w.Flush()
+}
+
+func (rn *renamer) run() error {
+	for {
+		c, err := rn.r.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case c == '`':
+			name, err := rn.readQuoted('`')
+			if err != nil {
+				return err
+			}
+			rn.writeIdentifier(name, true)
+			continue
+		case c == '\'' || c == '"':
+			rn.w.WriteByte(c)
+			if err := rn.copyString(c); err != nil {
+				return err
+			}
+		case c == '#' || c == '-' && rn.startsComment():
+			rn.w.WriteByte(c)
+			if err := rn.copyLine(); err != nil {
+				return err
+			}
+		case c == '/' && rn.startsBlockComment():
+			rn.w.WriteByte(c)
+			if err := rn.copyBlockComment(); err != nil {
+				return err
+			}
+		case isWordStart(c):
+			rn.r.UnreadByte()
+			word, err := rn.readWord()
+			if err != nil {
+				return err
+			}
+			if rn.isIdentifier(strings.ToUpper(word)) {
+				rn.writeIdentifier(word, false)
+				continue
+			}
+			rn.w.WriteString(word)
+			rn.handleWord(strings.ToUpper(word))
+		case c == '.':
+			rn.w.WriteByte(c)
+			continue
+		case c == ';':
+			rn.w.WriteByte(c)
+			rn.lastWord, rn.prevWord, rn.tableList = "", "", ""
+			rn.aboutDatabase = false
+		case c == ',':
+			rn.w.WriteByte(c)
+			// a list of tables goes on, any other list ends the keyword
+			rn.lastWord, rn.prevWord = rn.tableList, ""
+		case c == '(':
+			rn.w.WriteByte(c)
+			// the column list of a table, not a table list
+			if rn.afterIdentifier {
+				rn.lastWord, rn.prevWord, rn.tableList = "", "", ""
+			}
+		default:
+			rn.w.WriteByte(c)
+		}
+		rn.afterIdentifier = false
+		rn.qualifier = unqualified
+	}
+}
+
+func (rn *renamer) handleWord(word string) {
+	switch word {
+	case "DATABASE", "SCHEMA", "USE":
+		rn.aboutDatabase = true
+	case "TABLE", "TABLES", "VIEW", "TRIGGER":
+		rn.aboutDatabase = false
+	}
+	if clauseKeywords[word] {
+		rn.tableList = ""
+	}
+	rn.prevWord, rn.lastWord = rn.lastWord, word
+}
+
+// tablePosition reports whether the next unqualified identifier names a
+// table
+func (rn *renamer) tablePosition() bool {
+	switch {
+	case rn.lastWord == "ON":
+		// not a join condition nor a referential action
+		return triggerEvents[rn.prevWord]
+	case rn.lastWord == "UPDATE":
+		// not ON UPDATE CASCADE nor FOR UPDATE
+		return rn.prevWord != "ON" && rn.prevWord != "FOR"
+	}
+	return tableKeywords[rn.lastWord]
+}
+
+// isIdentifier reports whether an unquoted word is an identifier the renamer
+// may rewrite: a qualifier, a qualified name, or a name in table or database
+// position
+func (rn *renamer) isIdentifier(word string) bool {
+	if rn.qualifier != unqualified {
+		return true
+	}
+	if next, _ := rn.r.Peek(1); len(next) == 1 && next[0] == '.' {
+		return true
+	}
+	if notIdentifiers[word] {
+		return false
+	}
+	return rn.tablePosition() || rn.aboutDatabase && databaseKeywords[rn.lastWord]
+}
+
+// writeIdentifier writes an identifier, renamed if it references the source
+// database or a renamed table. A renamed identifier is quoted.
+func (rn *renamer) writeIdentifier(name string, quoted bool) {
+	next, _ := rn.r.Peek(1)
+	qualifies := len(next) == 1 && next[0] == '.'
+
+	renamed := name
+	nextQualifier := unqualified
+	switch {
+	case qualifies && rn.qualifier == unqualified && name == rn.fromDatabase:
+		renamed = rn.toDatabase
+		nextQualifier = qualifiedByDatabase
+	case qualifies && rn.qualifier == qualifiedByTable:
+		// a column has no members
+	case qualifies:
+		renamed = rn.tableName(name)
+		nextQualifier = qualifiedByTable
+	case rn.qualifier == qualifiedByDatabase:
+		renamed = rn.tableName(name)
+	case rn.qualifier == qualifiedByTable:
+		// column
+	case rn.aboutDatabase && databaseKeywords[rn.lastWord]:
+		if name == rn.fromDatabase && name != "" {
+			renamed = rn.toDatabase
+		}
+	case rn.tablePosition():
+		renamed = rn.tableName(name)
+	}
+	if nextQualifier == unqualified && rn.qualifier != qualifiedByTable && rn.tablePosition() {
+		// the table is named, the words up to the next comma are not tables
+		rn.tableList = rn.lastWord
+		rn.lastWord, rn.prevWord = "", ""
+	}
+
+	if quoted || renamed != name {
+		rn.w.WriteString(quoteIdentifier(renamed))
+	} else {
+		rn.w.WriteString(name)
+	}
+	rn.afterIdentifier = true
+	rn.qualifier = nextQualifier
+}
+
+func (rn *renamer) tableName(name string) string {
+	return rn.opts.DestinationTable(name)
+}
+
+// sqlStream copies a SQL dump token by token
+type sqlStream struct {
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+func newSQLStream(dst io.Writer, src io.Reader) sqlStream {
+	return sqlStream{r: bufio.NewReader(src), w: bufio.NewWriter(dst)}
+}
+
+// readQuoted reads up to the closing quote, a doubled quote is an escaped one
+func (s *sqlStream) readQuoted(quote byte) (string, error) {
+	var b strings.Builder
+	for {
+		c, err := s.r.ReadByte()
+		if err != nil {
+			return "", unexpectedEOF(err)
+		}
+		if c == quote {
+			if next, _ := s.r.Peek(1); len(next) == 1 && next[0] == quote {
+				s.r.ReadByte()
+			} else {
+				return b.String(), nil
+			}
+		}
+		b.WriteByte(c)
+	}
+}
+
+// copyString copies a string literal up to the closing quote
+func (s *sqlStream) copyString(quote byte) error {
+	for {
+		c, err := s.r.ReadByte()
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		s.w.WriteByte(c)
+		switch c {
+		case '\\':
+			c, err := s.r.ReadByte()
+			if err != nil {
+				return unexpectedEOF(err)
+			}
+			s.w.WriteByte(c)
+		case quote:
+			if next, _ := s.r.Peek(1); len(next) == 1 && next[0] == quote {
+				c, _ := s.r.ReadByte()
+				s.w.WriteByte(c)
+			} else {
+				return nil
+			}
+		}
+	}
+}
+
+// startsComment reports whether the '-' just read starts a "-- " comment
+func (s *sqlStream) startsComment() bool {
+	next, _ := s.r.Peek(2)
+	return len(next) == 2 && next[0] == '-' && (next[1] == ' ' || next[1] == '\t' || next[1] == '\n' || next[1] == '\r')
+}
+
+// startsBlockComment reports whether the '/' just read starts a /* */
+// comment. The conditional comments of MySQL and MariaDB, e.g.
+// /*!40101 SET NAMES utf8 */ or /*M!100100 ... */, hold statements and are
+// read as such.
+func (s *sqlStream) startsBlockComment() bool {
+	next, _ := s.r.Peek(3)
+	if len(next) < 2 || next[0] != '*' {
+		return false
+	}
+	return next[1] != '!' && !(len(next) == 3 && next[1] == 'M' && next[2] == '!')
+}
+
+// copyBlockComment copies a /* */ comment after its '/', up to and including
+// the closing */
+func (s *sqlStream) copyBlockComment() error {
+	// the opening '*' does not close the comment, as in /*/
+	c, err := s.r.ReadByte()
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	s.w.WriteByte(c)
+	var last byte
+	for {
+		c, err := s.r.ReadByte()
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		s.w.WriteByte(c)
+		if last == '*' && c == '/' {
+			return nil
+		}
+		last = c
+	}
+}
+
+// copyLine copies up to and including the end of line
+func (s *sqlStream) copyLine() error {
+	line, err := s.r.ReadString('\n')
+	s.w.WriteString(line)
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+func (s *sqlStream) readWord() (string, error) {
+	var b strings.Builder
+	for {
+		c, err := s.r.ReadByte()
+		if err == io.EOF {
+			return b.String(), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if !isWordStart(c) && !(c >= '0' && c <= '9') && c != '$' {
+			s.r.UnreadByte()
+			return b.String(), nil
+		}
+		b.WriteByte(c)
+	}
+}
+
+func isWordStart(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_'
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
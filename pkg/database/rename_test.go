@@ -0,0 +1,90 @@
+package database
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRenameDump(t *testing.T) {
+	opts := Options{
+		SourceDatabase: "shop",
+		RenameTables:   map[string]string{"orders": "sales", "users": "customers"},
+	}
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "quoted",
+			in:   "USE `shop`;\nDROP TABLE IF EXISTS `orders`;\nINSERT INTO `orders` VALUES (1,'orders');",
+			want: "USE `new`;\nDROP TABLE IF EXISTS `sales`;\nINSERT INTO `sales` VALUES (1,'orders');",
+		},
+		{
+			name: "column after ON UPDATE",
+			in: "CREATE TABLE `audit` (\n  `changed` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,\n" +
+				"  `orders` int,\n  KEY `users` (`users`)\n);",
+			want: "CREATE TABLE `audit` (\n  `changed` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,\n" +
+				"  `orders` int,\n  KEY `users` (`users`)\n);",
+		},
+		{
+			name: "foreign key",
+			in:   "CONSTRAINT `fk` FOREIGN KEY (`user`) REFERENCES `users` (`id`) ON DELETE CASCADE ON UPDATE CASCADE,\n  `orders` int",
+			want: "CONSTRAINT `fk` FOREIGN KEY (`user`) REFERENCES `customers` (`id`) ON DELETE CASCADE ON UPDATE CASCADE,\n  `orders` int",
+		},
+		{
+			name: "unquoted routine body",
+			in: "CREATE PROCEDURE `p`()\nBEGIN\n  SELECT orders.id, o.users FROM shop.orders o JOIN users u ON u.id = o.users WHERE orders.id > 0;\n" +
+				"  UPDATE orders SET users = 1;\n  DELETE FROM shop.users WHERE id = 2;\nEND",
+			want: "CREATE PROCEDURE `p`()\nBEGIN\n  SELECT `sales`.id, o.users FROM `new`.`sales` o JOIN `customers` u ON u.id = o.users WHERE `sales`.id > 0;\n" +
+				"  UPDATE `sales` SET users = 1;\n  DELETE FROM `new`.`customers` WHERE id = 2;\nEND",
+		},
+		{
+			name: "unquoted table list",
+			in:   "SELECT orders FROM orders, users u, items WHERE users = 1 GROUP BY orders, users;",
+			want: "SELECT orders FROM `sales`, `customers` u, items WHERE users = 1 GROUP BY orders, users;",
+		},
+		{
+			name: "unquoted trigger",
+			in:   "CREATE TRIGGER t AFTER INSERT ON orders FOR EACH ROW INSERT INTO users (orders) VALUES (NEW.orders);",
+			want: "CREATE TRIGGER t AFTER INSERT ON `sales` FOR EACH ROW INSERT INTO `customers` (orders) VALUES (NEW.orders);",
+		},
+		{
+			name: "unquoted view",
+			in:   "CREATE VIEW v AS SELECT * FROM shop.orders LEFT JOIN users ON users.id = orders.user_id;",
+			want: "CREATE VIEW v AS SELECT * FROM `new`.`sales` LEFT JOIN `customers` ON `customers`.id = `sales`.user_id;",
+		},
+		{
+			name: "strings and comments",
+			in:   "-- FROM orders\nSELECT 'FROM orders' FROM orders; # INTO users\n",
+			want: "-- FROM orders\nSELECT 'FROM orders' FROM `sales`; # INTO users\n",
+		},
+		{
+			name: "block comments",
+			in:   "/* FROM orders */ SELECT 1 FROM /* users */ orders;\n/*\n INTO users; */\nINSERT INTO users VALUES (1 /* orders */);",
+			want: "/* FROM orders */ SELECT 1 FROM /* users */ `sales`;\n/*\n INTO users; */\nINSERT INTO `customers` VALUES (1 /* orders */);",
+		},
+		{
+			name: "conditional comments",
+			in:   "/*!40000 ALTER TABLE orders DISABLE KEYS */;\n/*!50003 CREATE*/ /*!50003 TRIGGER t AFTER INSERT ON orders FOR EACH ROW DELETE FROM users */;;\n/*M!100100 LOCK TABLES users WRITE */;",
+			want: "/*!40000 ALTER TABLE `sales` DISABLE KEYS */;\n/*!50003 CREATE*/ /*!50003 TRIGGER t AFTER INSERT ON `sales` FOR EACH ROW DELETE FROM `customers` */;;\n/*M!100100 LOCK TABLES `customers` WRITE */;",
+		},
+		{
+			name: "unrenamed",
+			in:   "LOCK TABLES items WRITE, `orders` WRITE;",
+			want: "LOCK TABLES items WRITE, `sales` WRITE;",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := renameDump(&out, strings.NewReader(tt.in), "new", opts); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tt.want {
+				t.Errorf("renameDump() =\n%s\nwant\n%s", out.String(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package database
+
+import (
+	"strings"
+)
+
+// Schema describes the tables of a database
+type Schema struct {
+	Tables   []Table
+	Views    []View
+	Triggers []Trigger
+	Routines []Routine
+}
+
+// Table returns the table with the given name, or nil
+func (s *Schema) Table(name string) *Table {
+	for i := range s.Tables {
+		if s.Tables[i].Name == name {
+			return &s.Tables[i]
+		}
+	}
+	return nil
+}
+
+// Table describes a base table
+type Table struct {
+	Name      string
+	Engine    string
+	Collation string
+	// Rows is the estimated number of rows
+	Rows        int64
+	Columns     []Column
+	Indexes     []Index
+	ForeignKeys []ForeignKey
+}
+
+// PrimaryKey returns the primary key of the table, or nil
+func (t *Table) PrimaryKey() *Index {
+	for i := range t.Indexes {
+		if t.Indexes[i].Primary() {
+			return &t.Indexes[i]
+		}
+	}
+	return nil
+}
+
+// Column describes a table column
+type Column struct {
+	Name string
+	// DataType is the bare type name, e.g. varchar
+	DataType string
+	// ColumnType is the full type definition, e.g. varchar(255)
+	ColumnType   string
+	Nullable     bool
+	Default      *string
+	Extra        string
+	CharacterSet string
+	Collation    string
+}
+
+// AutoIncrement reports whether the column value is generated by a sequence
+func (c Column) AutoIncrement() bool {
+	return strings.Contains(strings.ToLower(c.Extra), "auto_increment")
+}
+
+// Unsigned reports whether the column is an unsigned number
+func (c Column) Unsigned() bool {
+	return strings.Contains(strings.ToLower(c.ColumnType), "unsigned")
+}
+
+// Index describes a table index
+type Index struct {
+	Name    string
+	Unique  bool
+	Type    string
+	Columns []string
+}
+
+// Primary reports whether the index is the primary key
+func (i Index) Primary() bool {
+	return i.Name == "PRIMARY"
+}
+
+// ForeignKey describes a foreign key constraint
+type ForeignKey struct {
+	Name              string
+	Columns           []string
+	ReferencedTable   string
+	ReferencedColumns []string
+	OnUpdate          string
+	OnDelete          string
+}
+
+// View describes a view, its definition does not qualify the objects of its
+// own database
+type View struct {
+	Name       string
+	Definition string
+}
+
+// Trigger describes a table trigger
+type Trigger struct {
+	Name  string
+	Table string
+	// Timing is BEFORE or AFTER
+	Timing string
+	// Event is INSERT, UPDATE or DELETE
+	Event     string
+	Statement string
+}
+
+// Routine describes a stored procedure or function
+type Routine struct {
+	Name string
+	// Type is PROCEDURE or FUNCTION
+	Type string
+	// Returns is the return type of a function
+	Returns    string
+	Definition string
+}
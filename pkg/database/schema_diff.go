@@ -0,0 +1,272 @@
+package database
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Changes of an object between a source and a destination schema
+const (
+	// Missing objects are only in the source
+	Missing = "missing"
+	// Extra objects are only in the destination
+	Extra = "extra"
+	// Changed objects have different definitions
+	Changed = "changed"
+)
+
+// Kinds of schema objects
+const (
+	KindTable      = "table"
+	KindColumn     = "column"
+	KindIndex      = "index"
+	KindForeignKey = "foreign key"
+	KindView       = "view"
+	KindTrigger    = "trigger"
+	KindRoutine    = "routine"
+)
+
+// Difference is an object which differs between two schemas
+type Difference struct {
+	Kind string
+	// Object is the name of the object in the destination, qualified by its
+	// table for columns, indexes and foreign keys
+	Object string
+	Change string
+	// Source and Destination describe the definitions, empty when the
+	// object is missing on that side
+	Source      string
+	Destination string
+}
+
+func (d Difference) String() string {
+	switch d.Change {
+	case Missing:
+		return fmt.Sprintf("%s %s: missing in destination", d.Kind, d.Object)
+	case Extra:
+		return fmt.Sprintf("%s %s: missing in source", d.Kind, d.Object)
+	}
+	return fmt.Sprintf("%s %s: %s in source, %s in destination", d.Kind, d.Object, d.Source, d.Destination)
+}
+
+// SchemaDiff lists the differences between two schemas, sorted by kind and
+// object
+type SchemaDiff struct {
+	Differences []Difference
+}
+
+// Empty reports whether the schemas match
+func (d *SchemaDiff) Empty() bool {
+	return len(d.Differences) == 0
+}
+
+func (d *SchemaDiff) String() string {
+	lines := make([]string, len(d.Differences))
+	for i, diff := range d.Differences {
+		lines[i] = diff.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// DiffSchemas compares a destination schema with its source, the source tables
+// are renamed according to the options. Tables whose source name is not
+// selected by the options are skipped on both sides. The estimated row counts
+// and the column order are not compared, the definitions of views, triggers
+// and routines are compared verbatim.
+func DiffSchemas(src, dst *Schema, opts Options) *SchemaDiff {
+	d := &SchemaDiff{}
+
+	srcTables := map[string]*Table{}
+	for i := range src.Tables {
+		if opts.MatchTable(src.Tables[i].Name) {
+			t := convertTable(src.Tables[i], opts)
+			srcTables[opts.DestinationTable(t.Name)] = &t
+		}
+	}
+	dstTables := map[string]*Table{}
+	for i := range dst.Tables {
+		if opts.MatchTable(opts.SourceTable(dst.Tables[i].Name)) {
+			dstTables[dst.Tables[i].Name] = &dst.Tables[i]
+		}
+	}
+	d.diff(KindTable, "", describeTables(srcTables), describeTables(dstTables))
+	for name, s := range srcTables {
+		if t, ok := dstTables[name]; ok {
+			d.diffTable(name, s, t, opts)
+		}
+	}
+
+	srcViews, dstViews := map[string]string{}, map[string]string{}
+	for _, v := range src.Views {
+		if opts.MatchTable(v.Name) {
+			srcViews[opts.DestinationTable(v.Name)] = v.Definition
+		}
+	}
+	for _, v := range dst.Views {
+		if opts.MatchTable(opts.SourceTable(v.Name)) {
+			dstViews[v.Name] = v.Definition
+		}
+	}
+	d.diff(KindView, "", srcViews, dstViews)
+
+	srcTriggers, dstTriggers := map[string]string{}, map[string]string{}
+	for _, t := range src.Triggers {
+		if opts.MatchTable(t.Table) {
+			t.Table = opts.DestinationTable(t.Table)
+			srcTriggers[t.Name] = describeTrigger(t)
+		}
+	}
+	for _, t := range dst.Triggers {
+		if opts.MatchTable(opts.SourceTable(t.Table)) {
+			dstTriggers[t.Name] = describeTrigger(t)
+		}
+	}
+	d.diff(KindTrigger, "", srcTriggers, dstTriggers)
+
+	srcRoutines, dstRoutines := map[string]string{}, map[string]string{}
+	for _, r := range src.Routines {
+		srcRoutines[strings.ToLower(r.Type)+" "+r.Name] = describeRoutine(r)
+	}
+	for _, r := range dst.Routines {
+		dstRoutines[strings.ToLower(r.Type)+" "+r.Name] = describeRoutine(r)
+	}
+	d.diff(KindRoutine, "", srcRoutines, dstRoutines)
+
+	sort.SliceStable(d.Differences, func(i, j int) bool {
+		if d.Differences[i].Kind != d.Differences[j].Kind {
+			return kindOrder(d.Differences[i].Kind) < kindOrder(d.Differences[j].Kind)
+		}
+		return d.Differences[i].Object < d.Differences[j].Object
+	})
+	return d
+}
+
+// diffTable compares the columns, indexes and foreign keys of a table
+func (d *SchemaDiff) diffTable(name string, src, dst *Table, opts Options) {
+	srcColumns, dstColumns := map[string]string{}, map[string]string{}
+	for _, c := range src.Columns {
+		srcColumns[c.Name] = describeColumn(c)
+	}
+	for _, c := range dst.Columns {
+		dstColumns[c.Name] = describeColumn(c)
+	}
+	d.diff(KindColumn, name, srcColumns, dstColumns)
+
+	srcIndexes, dstIndexes := map[string]string{}, map[string]string{}
+	for _, i := range src.Indexes {
+		srcIndexes[i.Name] = describeIndex(i)
+	}
+	for _, i := range dst.Indexes {
+		dstIndexes[i.Name] = describeIndex(i)
+	}
+	d.diff(KindIndex, name, srcIndexes, dstIndexes)
+
+	srcKeys, dstKeys := map[string]string{}, map[string]string{}
+	for _, k := range src.ForeignKeys {
+		k.ReferencedTable = opts.DestinationTable(k.ReferencedTable)
+		srcKeys[k.Name] = describeForeignKey(k)
+	}
+	for _, k := range dst.ForeignKeys {
+		dstKeys[k.Name] = describeForeignKey(k)
+	}
+	d.diff(KindForeignKey, name, srcKeys, dstKeys)
+}
+
+// diff compares the definitions of objects by name, qualifying the names
+// with the table if set
+func (d *SchemaDiff) diff(kind, table string, src, dst map[string]string) {
+	object := func(name string) string {
+		if table == "" {
+			return name
+		}
+		return table + "." + name
+	}
+
+	for name, s := range src {
+		t, ok := dst[name]
+		switch {
+		case !ok:
+			d.Differences = append(d.Differences, Difference{Kind: kind, Object: object(name), Change: Missing, Source: s})
+		case s != t:
+			d.Differences = append(d.Differences, Difference{Kind: kind, Object: object(name), Change: Changed, Source: s, Destination: t})
+		}
+	}
+	for name, t := range dst {
+		if _, ok := src[name]; !ok {
+			d.Differences = append(d.Differences, Difference{Kind: kind, Object: object(name), Change: Extra, Destination: t})
+		}
+	}
+}
+
+func kindOrder(kind string) int {
+	for i, k := range []string{KindTable, KindColumn, KindIndex, KindForeignKey, KindView, KindTrigger, KindRoutine} {
+		if k == kind {
+			return i
+		}
+	}
+	return -1
+}
+
+// convertTable returns a copy of a source table with the character sets
+// and collations converted by the options, as migrated
+func convertTable(t Table, opts Options) Table {
+	t.Collation = opts.ConvertCollation(t.Collation)
+	columns := make([]Column, len(t.Columns))
+	for i, c := range t.Columns {
+		c.CharacterSet = opts.ConvertCharset(c.CharacterSet)
+		c.Collation = opts.ConvertCollation(c.Collation)
+		columns[i] = c
+	}
+	t.Columns = columns
+	return t
+}
+
+func describeTables(tables map[string]*Table) map[string]string {
+	described := make(map[string]string, len(tables))
+	for name, t := range tables {
+		described[name] = fmt.Sprintf("ENGINE=%s COLLATE=%s", t.Engine, t.Collation)
+	}
+	return described
+}
+
+func describeColumn(c Column) string {
+	desc := c.ColumnType
+	if c.Collation != "" {
+		desc += fmt.Sprintf(" CHARACTER SET %s COLLATE %s", c.CharacterSet, c.Collation)
+	}
+	if !c.Nullable {
+		desc += " NOT NULL"
+	}
+	if c.Default != nil {
+		desc += fmt.Sprintf(" DEFAULT %q", *c.Default)
+	}
+	if c.Extra != "" {
+		desc += " " + c.Extra
+	}
+	return desc
+}
+
+func describeIndex(i Index) string {
+	desc := i.Type
+	if i.Unique {
+		desc = "UNIQUE " + desc
+	}
+	return fmt.Sprintf("%s (%s)", desc, strings.Join(i.Columns, ", "))
+}
+
+func describeForeignKey(k ForeignKey) string {
+	return fmt.Sprintf("(%s) REFERENCES %s (%s) ON UPDATE %s ON DELETE %s",
+		strings.Join(k.Columns, ", "), k.ReferencedTable, strings.Join(k.ReferencedColumns, ", "), k.OnUpdate, k.OnDelete)
+}
+
+func describeTrigger(t Trigger) string {
+	return fmt.Sprintf("%s %s ON %s: %s", t.Timing, t.Event, t.Table, t.Statement)
+}
+
+func describeRoutine(r Routine) string {
+	if r.Returns != "" {
+		return fmt.Sprintf("RETURNS %s: %s", r.Returns, r.Definition)
+	}
+	return r.Definition
+}
@@ -0,0 +1,107 @@
+package database
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiffSchemasCharset(t *testing.T) {
+	src := &Schema{Tables: []Table{{
+		Name:      "users",
+		Engine:    "InnoDB",
+		Collation: "latin1_swedish_ci",
+		Columns: []Column{
+			{Name: "id", DataType: "int", ColumnType: "int(11)"},
+			{Name: "name", DataType: "varchar", ColumnType: "varchar(64)", CharacterSet: "latin1", Collation: "latin1_swedish_ci", Nullable: true},
+			{Name: "code", DataType: "varchar", ColumnType: "varchar(8)", CharacterSet: "latin1", Collation: "latin1_bin", Nullable: true},
+		},
+	}}}
+	dst := &Schema{Tables: []Table{{
+		Name:      "users",
+		Engine:    "InnoDB",
+		Collation: "utf8mb4_unicode_ci",
+		Columns: []Column{
+			{Name: "id", DataType: "int", ColumnType: "int(11)"},
+			{Name: "name", DataType: "varchar", ColumnType: "varchar(64)", CharacterSet: "utf8mb4", Collation: "utf8mb4_unicode_ci", Nullable: true},
+			{Name: "code", DataType: "varchar", ColumnType: "varchar(8)", CharacterSet: "utf8mb4", Collation: "utf8mb4_bin", Nullable: true},
+		},
+	}}}
+
+	if d := DiffSchemas(src, dst, Options{Charset: "utf8mb4"}); !d.Empty() {
+		t.Errorf("DiffSchemas() of the converted schema = %s", d)
+	}
+	if d := DiffSchemas(src, dst, Options{}); len(d.Differences) != 3 {
+		t.Errorf("DiffSchemas() without conversion = %s, want the table and 2 columns changed", d)
+	}
+	if src.Tables[0].Collation != "latin1_swedish_ci" || src.Tables[0].Columns[1].CharacterSet != "latin1" {
+		t.Errorf("DiffSchemas() changed the source schema")
+	}
+}
+
+func TestDiffSchemas(t *testing.T) {
+	users := func() Table {
+		return Table{
+			Name:      "users",
+			Engine:    "InnoDB",
+			Collation: "utf8mb4_bin",
+			Rows:      10,
+			Columns: []Column{
+				{Name: "id", DataType: "int", ColumnType: "int(11)", Extra: "auto_increment"},
+				{Name: "email", DataType: "varchar", ColumnType: "varchar(255)", CharacterSet: "utf8mb4", Collation: "utf8mb4_bin"},
+			},
+			Indexes: []Index{{Name: "PRIMARY", Unique: true, Type: "BTREE", Columns: []string{"id"}}},
+		}
+	}
+	orders := func() Table {
+		return Table{
+			Name:    "orders",
+			Engine:  "InnoDB",
+			Columns: []Column{{Name: "id", DataType: "int", ColumnType: "int(11)"}, {Name: "user_id", DataType: "int", ColumnType: "int(11)"}},
+			ForeignKeys: []ForeignKey{{Name: "fk_user", Columns: []string{"user_id"}, ReferencedTable: "users", ReferencedColumns: []string{"id"},
+				OnUpdate: "RESTRICT", OnDelete: "CASCADE"}},
+		}
+	}
+	src := &Schema{
+		Tables:   []Table{users(), orders(), {Name: "tmp_import", Engine: "InnoDB"}},
+		Views:    []View{{Name: "active", Definition: "select `id` from `users`"}},
+		Triggers: []Trigger{{Name: "audit", Table: "orders", Timing: "AFTER", Event: "INSERT", Statement: "SET @n = 1"}},
+		Routines: []Routine{{Name: "count_users", Type: "FUNCTION", Returns: "int", Definition: "RETURN 1"}},
+	}
+
+	customers := users()
+	customers.Name = "customers"
+	customers.Rows = 12
+	customers.Columns = []Column{customers.Columns[1], customers.Columns[0]}
+	customers.Indexes = append(customers.Indexes, Index{Name: "email", Unique: true, Type: "BTREE", Columns: []string{"email"}})
+	sales := orders()
+	sales.Name = "sales"
+	sales.ForeignKeys[0].ReferencedTable = "customers"
+	sales.Columns[1].ColumnType = "bigint(20)"
+	dst := &Schema{
+		Tables:   []Table{customers, sales, {Name: "extra", Engine: "MyISAM"}},
+		Views:    []View{{Name: "active", Definition: "select `id` from `customers`"}},
+		Triggers: []Trigger{{Name: "audit", Table: "sales", Timing: "AFTER", Event: "INSERT", Statement: "SET @n = 1"}},
+	}
+
+	opts := Options{
+		ExcludeTables: []string{"tmp_*"},
+		RenameTables:  map[string]string{"users": "customers", "orders": "sales"},
+	}
+	d := DiffSchemas(src, dst, opts)
+	want := []string{
+		"table extra: missing in source",
+		"column sales.user_id: int(11) NOT NULL in source, bigint(20) NOT NULL in destination",
+		"index customers.email: missing in source",
+		"view active: select `id` from `users` in source, select `id` from `customers` in destination",
+		"routine function count_users: missing in destination",
+	}
+	got := strings.Split(d.String(), "\n")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DiffSchemas() =\n%s\nwant\n%s", d, strings.Join(want, "\n"))
+	}
+
+	if d := DiffSchemas(src, src, Options{}); !d.Empty() {
+		t.Errorf("DiffSchemas() of a schema with itself = %s", d)
+	}
+}
@@ -0,0 +1,151 @@
+package database
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+)
+
+// TLS parameters of the DSNs, named after the libpq ones so that they keep
+// their meaning in postgres DSNs, e.g.
+// mysql://user@host/db?sslmode=verify-full&sslrootcert=/etc/ssl/ca.pem
+const (
+	tlsModeParam = "sslmode"
+	tlsCAParam   = "sslrootcert"
+	tlsCertParam = "sslcert"
+	tlsKeyParam  = "sslkey"
+)
+
+// TLS modes of the connections
+const (
+	// TLSDisable connects without TLS
+	TLSDisable = "disable"
+	// TLSPreferred uses TLS when the server supports it, without verifying
+	// its certificate
+	TLSPreferred = "preferred"
+	// TLSRequired requires TLS, without verifying the certificate of the
+	// server
+	TLSRequired = "required"
+	// TLSVerifyCA requires a server certificate signed by the CA
+	TLSVerifyCA = "verify-ca"
+	// TLSVerifyFull requires a server certificate signed by the CA and
+	// matching the host name
+	TLSVerifyFull = "verify-full"
+)
+
+// tlsParams are the TLS parameters of a URL, the mode is empty when unset
+type tlsParams struct {
+	mode string
+	ca   string
+	cert string
+	key  string
+}
+
+// parseTLSParams reads the TLS parameters of a URL. The libpq and mysql
+// spellings of the modes are accepted too, e.g. require or verify_identity.
+// Without a mode, a CA implies verify-ca and a client certificate required,
+// like the mysql tools.
+func parseTLSParams(u *url.URL) (tlsParams, error) {
+	q := u.Query()
+	p := tlsParams{ca: q.Get(tlsCAParam), cert: q.Get(tlsCertParam), key: q.Get(tlsKeyParam)}
+
+	switch mode := strings.ToLower(strings.Replace(q.Get(tlsModeParam), "_", "-", -1)); mode {
+	case "":
+		switch {
+		case p.ca != "":
+			p.mode = TLSVerifyCA
+		case p.cert != "":
+			p.mode = TLSRequired
+		}
+	case TLSDisable, "disabled":
+		p.mode = TLSDisable
+	case TLSPreferred, "prefer":
+		p.mode = TLSPreferred
+	case TLSRequired, "require":
+		p.mode = TLSRequired
+	case TLSVerifyCA:
+		p.mode = TLSVerifyCA
+	case TLSVerifyFull, "verify-identity":
+		p.mode = TLSVerifyFull
+	default:
+		return p, fmt.Errorf("unknown %s: %s", tlsModeParam, mode)
+	}
+
+	if (p.cert == "") != (p.key == "") {
+		return p, fmt.Errorf("%s and %s must be set together", tlsCertParam, tlsKeyParam)
+	}
+	if p.mode == TLSDisable && (p.ca != "" || p.cert != "") {
+		return p, fmt.Errorf("TLS certificates are set but %s is %s", tlsModeParam, TLSDisable)
+	}
+	return p, nil
+}
+
+// config returns the TLS configuration of a connection to host, nil without
+// TLS
+func (p tlsParams) config(host string) (*tls.Config, error) {
+	if p.mode == "" || p.mode == TLSDisable {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{}
+	if p.cert != "" {
+		cert, err := tls.LoadX509KeyPair(p.cert, p.key)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	var roots *x509.CertPool // system roots
+	if p.ca != "" {
+		pem, err := ioutil.ReadFile(p.ca)
+		if err != nil {
+			return nil, err
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in %s", p.ca)
+		}
+	}
+
+	switch p.mode {
+	case TLSVerifyFull:
+		cfg.RootCAs = roots
+		cfg.ServerName = host
+	case TLSVerifyCA:
+		// crypto/tls only skips the host name check with the whole
+		// verification, the chain is verified afterwards
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyPeerCertificate = verifyChain(roots)
+	default:
+		cfg.InsecureSkipVerify = true
+	}
+	return cfg, nil
+}
+
+// verifyChain verifies that the server certificate is signed by the roots,
+// whatever its host name
+func verifyChain(roots *x509.CertPool) func([][]byte, [][]*x509.Certificate) error {
+	return func(raw [][]byte, _ [][]*x509.Certificate) error {
+		if len(raw) == 0 {
+			return errors.New("no server certificate")
+		}
+		certs := make([]*x509.Certificate, len(raw))
+		for i, der := range raw {
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return err
+			}
+			certs[i] = cert
+		}
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := certs[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates})
+		return err
+	}
+}
@@ -1,12 +1,24 @@
 package database
 
 import (
+	"database/sql"
 	"io"
 )
 
-//close stream
-func mustClose(c io.Closer) {
-	if err := c.Close(); err != nil {
-		panic(err)
+// closeErr closes a connection or rows on return, its error becomes the error
+// of the caller unless it already failed. A lost connection then fails the
+// operation, which may be retried, rather than the process.
+func closeErr(c io.Closer, err *error) {
+	if cerr := c.Close(); cerr != nil && *err == nil {
+		*err = cerr
 	}
 }
+
+// closeRows closes rows read to the end and returns their error
+func closeRows(rows *sql.Rows) error {
+	err := rows.Err()
+	if cerr := rows.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
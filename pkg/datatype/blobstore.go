@@ -1,4 +1,47 @@
 package datatype
 
+import (
+	"net/url"
+	"strings"
+)
+
+// Blobstore locates where artifacts are stored, e.g. file:///var/lib/artifacts
+// or s3://bucket/prefix?region=eu-west-1
 type Blobstore struct {
+	Protocal   string
+	Host       string
+	Path       string
+	Parameters string
+}
+
+// Configured reports whether a blobstore is set
+func (b Blobstore) Configured() bool {
+	return b.Protocal != ""
+}
+
+func (b Blobstore) ToURL() (*url.URL, error) {
+	return &url.URL{
+		Scheme:   b.Protocal,
+		Host:     b.Host,
+		Path:     b.Path,
+		RawQuery: b.Parameters,
+	}, nil
+}
+
+// ParseBlobstore parses the URL of a blobstore, a path without a scheme is a
+// directory of the filesystem
+func ParseBlobstore(s string) (Blobstore, error) {
+	if !strings.Contains(s, "://") {
+		return Blobstore{Protocal: "file", Path: s}, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return Blobstore{}, err
+	}
+	return Blobstore{
+		Protocal:   u.Scheme,
+		Host:       u.Host,
+		Path:       u.Path,
+		Parameters: u.RawQuery,
+	}, nil
 }
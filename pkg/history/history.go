@@ -0,0 +1,190 @@
+package history
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gossion/migration-producer/pkg/logging"
+)
+
+// Statuses of a job
+const (
+	Running   = "running"
+	Succeeded = "succeeded"
+	Failed    = "failed"
+	// Canceled jobs of the server never ran or stopped between phases
+	Canceled = "canceled"
+)
+
+// Job records a run of the migrator
+type Job struct {
+	ID string `json:"id"`
+	// Command is the subcommand of the run, e.g. migrate-db
+	Command string `json:"command"`
+	// Source and Destination are DSNs without their password, or the
+	// artifact a database was exported to or imported from
+	Source      string    `json:"source,omitempty"`
+	Destination string    `json:"destination,omitempty"`
+	Method      string    `json:"method,omitempty"`
+	Status      string    `json:"status"`
+	StartedAt   time.Time `json:"started_at"`
+	FinishedAt  time.Time `json:"finished_at"`
+	Phases      []Phase   `json:"phases,omitempty"`
+	// Bytes is the size of the dump, as stored
+	Bytes    int64  `json:"bytes"`
+	Artifact string `json:"artifact,omitempty"`
+	// Validation is the outcome of the validation, skipped, passed or
+	// failed
+	Validation string `json:"validation,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Phase is a timed step of a job, e.g. export or import
+type Phase struct {
+	Name     string        `json:"name"`
+	Duration time.Duration `json:"duration"`
+}
+
+// Duration returns how long the job ran, until now if it is still running
+func (j *Job) Duration() time.Duration {
+	if j.FinishedAt.IsZero() {
+		return time.Since(j.StartedAt)
+	}
+	return j.FinishedAt.Sub(j.StartedAt)
+}
+
+// Store keeps the jobs in a directory, one JSON file per job
+type Store struct {
+	Dir string
+}
+
+// DefaultDir is the store of the user running the migrator
+func DefaultDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "migrator", "history")
+	}
+	return filepath.Join(home, ".migrator", "history")
+}
+
+// Open creates the directory of the store if needed
+func Open(dir string) (*Store, error) {
+	if dir == "" {
+		dir = DefaultDir()
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		logging.Default().Errorf("Failed to create history directory %s", dir)
+		return nil, err
+	}
+	return &Store{Dir: dir}, nil
+}
+
+// NewJob returns a running job with a new ID, sortable by start time
+func NewJob(command string) (*Job, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	return &Job{
+		ID:        fmt.Sprintf("%s-%s", now.Format("20060102T150405Z"), hex.EncodeToString(suffix)),
+		Command:   command,
+		Status:    Running,
+		StartedAt: now,
+	}, nil
+}
+
+var idPattern = regexp.MustCompile(`^[0-9A-Za-z-]+$`)
+
+func (s *Store) path(id string) (string, error) {
+	if !idPattern.MatchString(id) {
+		return "", fmt.Errorf("invalid job ID: %q", id)
+	}
+	return filepath.Join(s.Dir, id+".json"), nil
+}
+
+// Save writes the job, replacing the previous record of the same ID
+func (s *Store) Save(job *Job) error {
+	name, err := s.path(job.ID)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// readers never see a partial record
+	tmp, err := ioutil.TempFile(s.Dir, ".job-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// Get reads a job by ID
+func (s *Store) Get(id string) (*Job, error) {
+	name, err := s.path(id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no job %s in %s", id, s.Dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	job := &Job{}
+	if err := json.Unmarshal(data, job); err != nil {
+		return nil, fmt.Errorf("invalid record of job %s: %s", id, err)
+	}
+	return job, nil
+}
+
+// List reads the jobs, the most recent first
+func (s *Store) List() ([]*Job, error) {
+	files, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := []*Job{}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		job, err := s.Get(strings.TrimSuffix(f.Name(), ".json"))
+		if err != nil {
+			logging.Default().Warnf("Skipping %s: %s", f.Name(), err)
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].StartedAt.After(jobs[j].StartedAt)
+	})
+	return jobs, nil
+}
@@ -0,0 +1,260 @@
+// Package logging writes leveled log entries with fields, as text or JSON.
+//
+// The fields correlate the entries of a migration end to end:
+//
+//	job      ID of the job, in the history or the server
+//	phase    phase of the migration, e.g. export or import
+//	driver   database driver, e.g. mysql or postgres
+//	table    table being copied
+//	command  external command being run, e.g. mysqldump
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gossion/migration-producer/pkg/redact"
+)
+
+// Level is the severity of an entry
+type Level int
+
+// Levels, from the most verbose
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+func (l Level) String() string {
+	switch l {
+	case DebugLevel:
+		return "debug"
+	case InfoLevel:
+		return "info"
+	case WarnLevel:
+		return "warn"
+	default:
+		return "error"
+	}
+}
+
+// ParseLevel parses debug, info, warn or error
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return DebugLevel, nil
+	case "info", "":
+		return InfoLevel, nil
+	case "warn", "warning":
+		return WarnLevel, nil
+	case "error":
+		return ErrorLevel, nil
+	}
+	return InfoLevel, fmt.Errorf("unknown log level: %s", s)
+}
+
+// Formats of the entries
+const (
+	// TextFormat writes the time, level, caller and message, followed by the
+	// fields as key=value
+	TextFormat = "text"
+	// JSONFormat writes an object per line
+	JSONFormat = "json"
+)
+
+// output is shared by a logger and the loggers derived from it
+type output struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format string
+	level  Level
+}
+
+type field struct {
+	key   string
+	value interface{}
+}
+
+// Logger writes entries with its fields. A nil logger writes to the default
+// one, so that it can be left unset.
+type Logger struct {
+	out    *output
+	fields []field
+}
+
+// New returns a logger writing entries of level or above to w
+func New(w io.Writer, format string, level Level) (*Logger, error) {
+	switch format {
+	case TextFormat, JSONFormat:
+	case "":
+		format = TextFormat
+	default:
+		return nil, fmt.Errorf("unknown log format: %s", format)
+	}
+	return &Logger{out: &output{w: w, format: format, level: level}}, nil
+}
+
+var std = &Logger{out: &output{w: os.Stderr, format: TextFormat, level: InfoLevel}}
+
+// Default returns the logger of the entries without an injected logger
+func Default() *Logger {
+	return std
+}
+
+// SetDefault replaces the default logger, before any entry is written
+func SetDefault(l *Logger) {
+	std = l
+}
+
+func (l *Logger) orDefault() *Logger {
+	if l == nil {
+		return std
+	}
+	return l
+}
+
+// With returns a logger adding fields to the entries, given as key and value
+// pairs, e.g. With("table", "users")
+func (l *Logger) With(keyValues ...interface{}) *Logger {
+	l = l.orDefault()
+	fields := make([]field, len(l.fields), len(l.fields)+len(keyValues)/2)
+	copy(fields, l.fields)
+	for i := 0; i+1 < len(keyValues); i += 2 {
+		fields = append(fields, field{key: fmt.Sprint(keyValues[i]), value: keyValues[i+1]})
+	}
+	return &Logger{out: l.out, fields: fields}
+}
+
+// Enabled reports whether entries of the level are written
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.orDefault().out.level
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.orDefault().write(DebugLevel, format, args)
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.orDefault().write(InfoLevel, format, args)
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.orDefault().write(WarnLevel, format, args)
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.orDefault().write(ErrorLevel, format, args)
+}
+
+// write formats an entry, the caller is two frames up
+func (l *Logger) write(level Level, format string, args []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	caller := ""
+	if _, file, line, ok := runtime.Caller(2); ok {
+		caller = filepath.Base(file) + ":" + strconv.Itoa(line)
+	}
+	l.writeEntry(time.Now(), level, caller, fmt.Sprintf(format, args...))
+}
+
+// writeEntry writes an entry, masking the secrets of the message and of the
+// fields
+func (l *Logger) writeEntry(t time.Time, level Level, caller, msg string) {
+	msg = redact.String(msg)
+	var buf bytes.Buffer
+	if l.out.format == JSONFormat {
+		buf.WriteString(`{"time":`)
+		writeJSON(&buf, t.UTC().Format(time.RFC3339Nano))
+		buf.WriteString(`,"level":`)
+		writeJSON(&buf, level.String())
+		if caller != "" {
+			buf.WriteString(`,"caller":`)
+			writeJSON(&buf, caller)
+		}
+		buf.WriteString(`,"msg":`)
+		writeJSON(&buf, msg)
+		for _, f := range l.fields {
+			buf.WriteByte(',')
+			writeJSON(&buf, f.key)
+			buf.WriteByte(':')
+			writeJSON(&buf, jsonValue(f.value))
+		}
+		buf.WriteString("}\n")
+	} else {
+		fmt.Fprintf(&buf, "%s %-5s ", t.Format("2006/01/02 15:04:05"), strings.ToUpper(level.String()))
+		if caller != "" {
+			buf.WriteString(caller + ": ")
+		}
+		buf.WriteString(msg)
+		for _, f := range l.fields {
+			fmt.Fprintf(&buf, " %s=%s", f.key, textValue(f.value))
+		}
+		buf.WriteByte('\n')
+	}
+
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	l.out.w.Write(buf.Bytes())
+}
+
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(data)
+}
+
+// jsonValue returns strings, errors and stringers as their redacted text,
+// other values are encoded as is
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return redact.String(v)
+	case error:
+		return redact.String(v.Error())
+	case fmt.Stringer:
+		return redact.String(v.String())
+	}
+	return v
+}
+
+// textValue quotes the values which would not read as a single word
+func textValue(v interface{}) string {
+	s := fmt.Sprint(jsonValue(v))
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// Writer returns a writer logging each line at the info level, e.g. to
+// redirect the standard logger
+func (l *Logger) Writer() io.Writer {
+	return &lineWriter{l: l.orDefault()}
+}
+
+type lineWriter struct {
+	l *Logger
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		if w.l.Enabled(InfoLevel) {
+			w.l.writeEntry(time.Now(), InfoLevel, "", line)
+		}
+	}
+	return len(p), nil
+}
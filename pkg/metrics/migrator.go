@@ -0,0 +1,27 @@
+package metrics
+
+// Metrics of the migrator
+var (
+	// Jobs counts the finished runs, by type db or blob and status
+	// succeeded, failed or canceled
+	Jobs = NewCounter("migrator_jobs_total", "Migration jobs by type and status.", "type", "status")
+	// PhaseDuration observes the phases of the runs, e.g. export or import
+	PhaseDuration = NewHistogram("migrator_phase_duration_seconds", "Duration of the phases of migration jobs.", DurationBuckets, "phase")
+	// ExportedBytes and ImportedBytes count the size of the dumps, as stored
+	ExportedBytes = NewCounter("migrator_exported_bytes_total", "Bytes of the exported dumps.")
+	ImportedBytes = NewCounter("migrator_imported_bytes_total", "Bytes of the imported dumps.")
+	// RowsCopied counts the rows copied by the drivers themselves, the rows
+	// dumped by mysqldump or pg_dump are not counted
+	RowsCopied = NewCounter("migrator_rows_copied_total", "Rows copied by the parallel and cross-engine methods.")
+	// LockHold observes how long the sources are locked
+	LockHold = NewHistogram("migrator_lock_hold_seconds", "Duration the source databases are locked.", DurationBuckets)
+	// ValidationMismatches counts the differences found by validations, by
+	// check rows, checksum or schema
+	ValidationMismatches = NewCounter("migrator_validation_mismatches_total", "Differences found by validations.", "check")
+	// BlobObjects counts the blobs of artifacts, by operation upload,
+	// download or copy and result ok or failed
+	BlobObjects = NewCounter("migrator_blob_objects_total", "Blobs of artifacts transferred by operation and result.", "operation", "result")
+	// Retries counts the retries of the operations failing on transient
+	// errors, by operation, e.g. ping or blob_copy
+	Retries = NewCounter("migrator_retries_total", "Retries of operations failing on transient errors.", "operation")
+)
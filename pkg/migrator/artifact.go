@@ -0,0 +1,275 @@
+package migrator
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gossion/migration-producer/pkg/artifact"
+	"github.com/gossion/migration-producer/pkg/database"
+	"github.com/gossion/migration-producer/pkg/datatype"
+	"github.com/gossion/migration-producer/pkg/logging"
+	"github.com/gossion/migration-producer/pkg/redact"
+)
+
+// Export dumps the source database into an artifact of the blobstore, which
+// can be imported later by its ID, e.g. on another machine.
+func (dm *DatabaseMigrator) Export() (*artifact.Manifest, error) {
+	dm.Result = Result{}
+
+	if dm.Method == CrossEngine {
+		return nil, errors.New("The cross-engine method can not export an artifact")
+	}
+	if !dm.Blobstore.Configured() {
+		return nil, errors.New("No blobstore to export the artifact to")
+	}
+	if err := checkMethod(dm.Method, dm.Source.Protocal); err != nil {
+		return nil, err
+	}
+	closeTunnels, err := dm.openTunnels()
+	if err != nil {
+		return nil, err
+	}
+	defer closeTunnels()
+
+	opts, err := dm.options()
+	if err != nil {
+		return nil, err
+	}
+
+	drv, _ := database.GetDriver(dm.Source.Protocal) // checked by checkMethod
+	src, err := dm.Source.ToURL()
+	if err != nil {
+		return nil, err
+	}
+	if err := ping(drv, src, opts.WithLog(dm.log())); err != nil {
+		dm.log().Errorf("Failed to Ping %s", src.Host)
+		return nil, err
+	}
+	if err := drv.CheckDependency(); err != nil {
+		return nil, err
+	}
+
+	// the row counts match the dump only if the source is locked
+	var srcSum map[string]int
+	unlock := func() {}
+	if dm.Validate {
+		if unlock, err = lockSource(drv, src, opts.WithLog(dm.log())); err != nil {
+			return nil, err
+		}
+		defer unlock()
+
+		if srcSum, err = getSum(drv, src, opts); err != nil {
+			unlock()
+			return nil, err
+		}
+	}
+
+	var dump *database.Dump
+	err = dm.timed(PhaseExport, func() error {
+		var err error
+		dump, err = dm.export(drv, src, opts)
+		return err
+	})
+	unlock()
+	if err != nil {
+		return nil, err
+	}
+	// the dump may hold unencrypted data, it is only kept in the blobstore
+	defer removeDump(dump, dm.log())
+
+	var m *artifact.Manifest
+	err = dm.timed(PhaseUpload, func() error {
+		var err error
+		m, err = dm.upload(drv, src, opts, dump, srcSum)
+		return err
+	})
+	return m, err
+}
+
+// Import pulls the artifact from the blobstore and restores it into the
+// destination database, validating the row counts of the manifest if set.
+func (dm *DatabaseMigrator) Import(id string) (*artifact.Manifest, error) {
+	dm.Result = Result{}
+
+	if !dm.Blobstore.Configured() {
+		return nil, errors.New("No blobstore to import the artifact from")
+	}
+	store, err := dm.Blobstore.ToURL()
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := artifact.ReadManifest(store, id, dm.log())
+	if err != nil {
+		return nil, err
+	}
+	if !database.SameEngine(m.Driver, dm.Destination.Protocal) {
+		return nil, fmt.Errorf("Not compatiable protocal, artifact %s was exported from %s", id, m.Driver)
+	}
+	closeTunnels, err := dm.openTunnels()
+	if err != nil {
+		return nil, err
+	}
+	defer closeTunnels()
+
+	opts := dm.Options
+	opts.SourceDatabase = m.Database
+	opts.Log = dm.Log
+	opts.Charset = m.Charset
+	opts.Collation = m.Collation
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	drv, err := database.GetDriver(dm.Destination.Protocal)
+	if err != nil {
+		return nil, err
+	}
+	dst, err := dm.Destination.ToURL()
+	if err != nil {
+		return nil, err
+	}
+	if err := ping(drv, dst, opts.WithLog(dm.log())); err != nil {
+		dm.log().Errorf("Failed to Ping %s", dst.Host)
+		return nil, err
+	}
+	if err := drv.CheckDependency(); err != nil {
+		return nil, err
+	}
+	if err := checkArtifactServer(m, dm.Destination, opts.WithLog(dm.log())); err != nil {
+		return nil, err
+	}
+
+	var dump *database.Dump
+	err = dm.timed(PhaseDownload, func() error {
+		var err error
+		m, dump, err = artifact.Download(store, id, dm.log())
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer removeDownload(m, dump, dm.log())
+	dm.Result.Artifact = m
+	dm.Result.Dump = dump
+
+	err = dm.timed(PhaseImport, func() error {
+		return importDump(drv, dst, dump, opts.WithLog(dm.log()))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if dm.Validate {
+		err := dm.timed(PhaseValidate, func() error {
+			dstSum, err := getSum(drv, dst, opts.ForDestination().WithLog(dm.log()))
+			if err != nil {
+				return err
+			}
+
+			return compareManifestSums(m, renameSum(m.Tables, opts), dstSum, dm.log())
+		})
+		if err != nil {
+			return nil, err
+		}
+		dm.Result.Validated = true
+	}
+
+	return m, nil
+}
+
+// checkArtifactServer compares the destination server with the source server
+// of an artifact, the manifest only records the version of the source server
+func checkArtifactServer(m *artifact.Manifest, dest datatype.Database, opts database.Options) error {
+	dstInfo, err := serverInfo(dest, database.Options{Log: opts.Log, Retry: opts.Retry})
+	if err != nil || dstInfo == nil {
+		return err
+	}
+	srcInfo := *dstInfo
+	srcInfo.Version = m.ServerVersion
+	srcInfo.Flavor = database.ServerFlavor(m.Driver, m.ServerVersion)
+	srcInfo.UsedEngines = nil
+	srcInfo.UsedCollations = nil
+	srcInfo.RequiredPlugins = nil
+
+	return checkIncompatibilities(database.CheckServers(&srcInfo, dstInfo, database.Options{}), opts.Log)
+}
+
+// upload stores the dump as an artifact of the blobstore, counting the rows
+// of the source unless they are already known. The counts taken now are
+// approximate, the source changed since the export unless locked.
+func (dm *DatabaseMigrator) upload(drv database.DatabaseDriver, src *url.URL, opts database.Options, dump *database.Dump, sum map[string]int) (*artifact.Manifest, error) {
+	store, err := dm.Blobstore.ToURL()
+	if err != nil {
+		return nil, err
+	}
+
+	log := dm.log()
+	opts = opts.WithLog(log)
+	approximate := sum == nil
+	if approximate {
+		if sum, err = getSum(drv, src, opts); err != nil {
+			return nil, err
+		}
+	}
+	version, err := serverVersion(drv, src, opts)
+	if err != nil {
+		log.Errorf("Failed to get server version of %s", src.Host)
+		return nil, err
+	}
+
+	// the source as configured, not its SSH tunnel
+	source, err := dm.source.ToURL()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	id, err := artifact.NewID(dm.Source.Database, now)
+	if err != nil {
+		return nil, err
+	}
+	m := &artifact.Manifest{
+		ID:                id,
+		CreatedAt:         now,
+		Source:            redact.URL(source),
+		Driver:            dm.Source.Protocal,
+		ServerVersion:     version,
+		Database:          dm.Source.Database,
+		Method:            dm.Method,
+		Tables:            sum,
+		ApproximateCounts: approximate,
+		Charset:           opts.Charset,
+		Collation:         opts.Collation,
+	}
+	if err := artifact.Upload(store, m, dump, log); err != nil {
+		return nil, err
+	}
+	log.Infof("Stored artifact %s in %s", m.ID, redact.URL(store))
+
+	dm.Result.Artifact = m
+	return m, nil
+}
+
+// removeDump deletes the local dump of an export, once uploaded or imported
+func removeDump(dump *database.Dump, log *logging.Logger) {
+	if err := dump.Remove(); err != nil {
+		log.Warnf("Failed to remove %s: %s", dump.Path, err)
+		return
+	}
+	log.Debugf("Removed %s", dump.Path)
+}
+
+// removeDownload deletes the downloaded files of an artifact
+func removeDownload(m *artifact.Manifest, dump *database.Dump, log *logging.Logger) {
+	dir := dump.Path
+	if !m.Directory {
+		dir = filepath.Dir(dump.Path)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		log.Warnf("Failed to remove %s: %s", dir, err)
+	}
+}
@@ -1 +1,78 @@
 package migrator
+
+import (
+	"errors"
+
+	migration "github.com/gossion/migration-producer/pkg/apis"
+	"github.com/gossion/migration-producer/pkg/artifact"
+	"github.com/gossion/migration-producer/pkg/datatype"
+	"github.com/gossion/migration-producer/pkg/logging"
+	"github.com/gossion/migration-producer/pkg/redact"
+	"github.com/gossion/migration-producer/pkg/retry"
+)
+
+// BlobMigrator copies an artifact from a blobstore to another one, e.g. to
+// import it next to a destination in another region.
+type BlobMigrator struct {
+	Source      datatype.Blobstore
+	Destination datatype.Blobstore
+	Artifact    string
+	// Result is set by Migrate, the checksums of the files are always
+	// verified
+	Result Result
+	// Progress receives the phases of the copy when set
+	Progress func(Event)
+	// Log receives the entries of the copy, the default logger when not set
+	Log *logging.Logger
+	// Retry is the policy of the copies of the files failing,
+	// retry.DefaultPolicy when not set
+	Retry retry.Policy
+
+	canceled canceler
+}
+
+var _ migration.Migrator = &BlobMigrator{}
+var _ migration.Canceler = &BlobMigrator{}
+
+func NewBlobMigrator(src datatype.Blobstore, dest datatype.Blobstore, id string) *BlobMigrator {
+	return &BlobMigrator{
+		Source:      src,
+		Destination: dest,
+		Artifact:    id,
+	}
+}
+
+func (bm *BlobMigrator) Migrate() error {
+	bm.Result = Result{}
+
+	if bm.Artifact == "" {
+		return errors.New("No artifact to copy")
+	}
+	if !bm.Source.Configured() || !bm.Destination.Configured() {
+		return errors.New("No blobstore to copy the artifact from or to")
+	}
+	src, err := bm.Source.ToURL()
+	if err != nil {
+		return err
+	}
+	dst, err := bm.Destination.ToURL()
+	if err != nil {
+		return err
+	}
+
+	return timed(&bm.Result, &bm.canceled, bm.Progress, bm.Log, PhaseCopy, func(log *logging.Logger) error {
+		m, err := artifact.Copy(src, dst, bm.Artifact, bm.Retry, log)
+		if err != nil {
+			return err
+		}
+		log.Infof("Copied artifact %s from %s to %s", m.ID, redact.URL(src), redact.URL(dst))
+		bm.Result.Artifact = m
+		bm.Result.Validated = true
+		return nil
+	})
+}
+
+// Cancel stops the copy before its next phase
+func (bm *BlobMigrator) Cancel() {
+	bm.canceled.cancel()
+}
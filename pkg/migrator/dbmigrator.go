@@ -2,24 +2,127 @@ package migrator
 
 import (
 	"errors"
-	"log"
-	"reflect"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	migration "github.com/gossion/migration-producer/pkg/apis"
+	"github.com/gossion/migration-producer/pkg/artifact"
 	"github.com/gossion/migration-producer/pkg/database"
 	"github.com/gossion/migration-producer/pkg/datatype"
+	"github.com/gossion/migration-producer/pkg/logging"
+	"github.com/gossion/migration-producer/pkg/metrics"
+	"github.com/gossion/migration-producer/pkg/redact"
 )
 
-const FullDump = "fulldump"
+const (
+	// FullDump migrates the schema and the rows
+	FullDump = "fulldump"
+	// SchemaOnly migrates table definitions, triggers and routines only
+	SchemaOnly = "schema-only"
+	// DataOnly migrates rows into tables which already exist in the destination
+	DataOnly = "data-only"
+	// CrossEngine migrates between different database engines, translating
+	// the table definitions and converting the rows
+	CrossEngine = "cross-engine"
+	// Parallel migrates the schema and the rows, exporting and importing the
+	// tables concurrently
+	Parallel = "parallel"
+)
 
 type DatabaseMigrator struct {
 	Method      string
 	Validate    bool
 	Source      datatype.Database
 	Destination datatype.Database
+	// Options selects the tables and rows to migrate, it applies to both the
+	// export and the validation. The destination only holds the filtered rows,
+	// so it is summarized without row filters.
+	Options database.Options
+	// Blobstore stores the exported dump as an artifact when configured
+	Blobstore datatype.Blobstore
+	// Result is set by Migrate, Export and Import
+	Result Result
+	// Progress receives the phases of the migration when set
+	Progress func(Event)
+	// Log receives the entries of the migration, the default logger when
+	// not set. The drivers log with its fields, e.g. the ID of the job.
+	Log *logging.Logger
+
+	canceled canceler
+	// phaseLog is the logger of the running phase
+	phaseLog *logging.Logger
+	// source is the source database as configured, Source is replaced by
+	// the database reached through its SSH tunnel while running
+	source datatype.Database
+}
+
+// Result describes a finished migration
+type Result struct {
+	// Dump is the exported or downloaded dump, nil for the cross-engine method
+	Dump *database.Dump
+	// Artifact is the manifest of the artifact stored in the blobstore
+	Artifact *artifact.Manifest
+	// Phases are the timed steps of the run, in order
+	Phases []Phase
+	// Validated is set when the destination was validated successfully
+	Validated bool
+}
+
+// Validation returns the outcome of the validation, ValidationSkipped unless
+// a validation phase ran
+func (r Result) Validation() string {
+	switch {
+	case r.Validated:
+		return ValidationPassed
+	case r.ran(PhaseValidate):
+		return ValidationFailed
+	}
+	return ValidationSkipped
+}
+
+func (r Result) ran(phase string) bool {
+	for _, p := range r.Phases {
+		if p.Name == phase {
+			return true
+		}
+	}
+	return false
+}
+
+// Outcomes of the validation of a run
+const (
+	ValidationSkipped = "skipped"
+	ValidationPassed  = "passed"
+	ValidationFailed  = "failed"
+)
+
+// Phases of a run
+const (
+	PhaseCheck    = "check"
+	PhaseCopy     = "copy"
+	PhaseExport   = "export"
+	PhaseConvert  = "convert"
+	PhaseUpload   = "upload"
+	PhaseDownload = "download"
+	PhaseImport   = "import"
+	PhaseValidate = "validate"
+)
+
+// Phase is a timed step of a run
+type Phase struct {
+	Name     string
+	Duration time.Duration
 }
 
-func NewDatabaseMigrator(src datatype.Database, dest datatype.Database) migration.Migrator {
+var _ migration.Migrator = &DatabaseMigrator{}
+var _ migration.Canceler = &DatabaseMigrator{}
+
+func NewDatabaseMigrator(src datatype.Database, dest datatype.Database) *DatabaseMigrator {
 	return &DatabaseMigrator{
 		Method:      FullDump,
 		Validate:    false,
@@ -30,12 +133,26 @@ func NewDatabaseMigrator(src datatype.Database, dest datatype.Database) migratio
 
 func (dm *DatabaseMigrator) Migrate() error {
 	var srcSum, dstSum map[string]int
+	dm.Result = Result{}
 
-	if err := dm.CheckCompatibility(); err != nil {
+	closeTunnels, err := dm.openTunnels()
+	if err != nil {
 		return err
 	}
+	defer closeTunnels()
 
-	if err := dm.CheckConnections(); err != nil {
+	var opts database.Options
+	err = dm.timed(PhaseCheck, func() error {
+		if err := dm.CheckCompatibility(); err != nil {
+			return err
+		}
+		var err error
+		if opts, err = dm.options(); err != nil {
+			return err
+		}
+		return dm.CheckConnections()
+	})
+	if err != nil {
 		return err
 	}
 
@@ -48,83 +165,434 @@ func (dm *DatabaseMigrator) Migrate() error {
 		return err
 	}
 
+	dstDrv, err := database.GetDriver(dm.Destination.Protocal)
+	if err != nil {
+		return err
+	}
+
+	if dm.Method == CrossEngine {
+		if err := dstDrv.CheckDependency(); err != nil {
+			return err
+		}
+	}
+
 	src, _ := dm.Source.ToURL() //error already checked by CheckConnections
+	dst, _ := dm.Destination.ToURL()
 
-	locked := false
+	unlock := func() {}
 	if dm.Validate {
-		drv.Lock(src) //TODO: when using the same host, mysql will hang in create database when it is locked, unlocked.
-		locked = true
+		unlock, err = lockSource(drv, src, opts.WithLog(dm.log())) //TODO: when using the same host, mysql will hang in create database when it is locked, unlocked.
+		if err != nil {
+			return err
+		}
+		defer unlock()
 
 		//get summary, which should be compared with dest
-		if srcSum, err = drv.GetSum(src); err != nil {
-			drv.UnLock(src)
+		srcOpts := opts
+		// the converters create the tables only
+		srcOpts.SkipViews = dm.Method == CrossEngine
+		if srcSum, err = getSum(drv, src, srcOpts); err != nil {
+			unlock()
 			return err
 		}
 	}
 
-	//export
-	fn, err := drv.Export(src)
-	if err != nil {
-		if locked {
-			drv.UnLock(src)
+	if dm.Method == CrossEngine {
+		// convert, the rows are read while the source is locked
+		conv, _ := database.GetConverter(dm.Source.Protocal, dm.Destination.Protocal)
+		err := dm.timed(PhaseConvert, func() error {
+			return conv.Convert(src, dst, opts.WithLog(dm.log()))
+		})
+		unlock()
+		if err != nil {
+			return err
 		}
-		return err
-	}
-	log.Println(fn)
+	} else {
+		var dump *database.Dump
+		err := dm.timed(PhaseExport, func() error {
+			var err error
+			dump, err = dm.export(drv, src, opts)
+			return err
+		})
+		unlock()
+		if err != nil {
+			return err
+		}
+		// the dump may hold unencrypted data, it is only kept in the blobstore
+		defer removeDump(dump, dm.log())
 
-	if locked {
-		drv.UnLock(src)
-	}
+		if dm.Blobstore.Configured() {
+			err := dm.timed(PhaseUpload, func() error {
+				_, err := dm.upload(drv, src, opts, dump, srcSum)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+		}
 
-	// import
-	dst, _ := dm.Destination.ToURL()
-	if err := drv.Import(dst, fn); err != nil {
-		return err
+		err = dm.timed(PhaseImport, func() error {
+			return importDump(dstDrv, dst, dump, opts.WithLog(dm.log()))
+		})
+		if err != nil {
+			return err
+		}
 	}
 
 	//validate
 	if dm.Validate {
-		if dstSum, err = drv.GetSum(dst); err != nil {
+		err := dm.timed(PhaseValidate, func() error {
+			var err error
+			if dstSum, err = getSum(dstDrv, dst, opts.ForDestination().WithLog(dm.log())); err != nil {
+				return err
+			}
+
+			srcSum = renameSum(srcSum, opts)
+			if err := compareSums(dm.Method, srcSum, dstSum); err != nil {
+				dm.log().Errorf("src and dst have different sum. %v %v", srcSum, dstSum)
+				return err
+			}
+			return nil
+		})
+		if err != nil {
 			return err
 		}
+		dm.Result.Validated = true
+	}
+
+	return nil
+}
+
+// lockSource locks the source database, the returned function unlocks it
+// once however many times it is called
+func lockSource(drv database.DatabaseDriver, src *url.URL, opts database.Options) (func(), error) {
+	unlockDB, err := database.Lock(drv, src, opts)
+	if err != nil {
+		opts.Log.Errorf("Failed to lock the source, its row counts would not match the dump")
+		return nil, err
+	}
+	locked := time.Now()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			metrics.LockHold.ObserveDuration(time.Since(locked))
+			if err := unlockDB(); err != nil {
+				opts.Log.Warnf("Failed to unlock the source: %s", err)
+			}
+		})
+	}, nil
+}
+
+// timed runs a phase of the migration unless it is canceled, logging with
+// the phase field meanwhile
+func (dm *DatabaseMigrator) timed(phase string, fn func() error) error {
+	return timed(&dm.Result, &dm.canceled, dm.Progress, dm.Log, phase, func(log *logging.Logger) error {
+		dm.phaseLog = log
+		defer func() { dm.phaseLog = nil }()
+		return fn()
+	})
+}
+
+// log returns the logger of the running phase, or of the migration between
+// phases
+func (dm *DatabaseMigrator) log() *logging.Logger {
+	if dm.phaseLog != nil {
+		return dm.phaseLog
+	}
+	return dm.Log
+}
+
+// Cancel stops the migration before its next phase, the current one runs to
+// completion
+func (dm *DatabaseMigrator) Cancel() {
+	dm.canceled.cancel()
+}
+
+// export dumps the source database with the migration method
+func (dm *DatabaseMigrator) export(drv database.DatabaseDriver, src *url.URL, opts database.Options) (*database.Dump, error) {
+	opts = opts.WithLog(dm.log())
+	if err := checkCharset(drv, src, opts); err != nil {
+		return nil, err
+	}
+
+	var dump *database.Dump
+	var err error
+	if dm.Method == Parallel {
+		dump, err = drv.(database.ParallelDriver).ExportParallel(src, opts)
+	} else {
+		dump, err = drv.Export(src, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+	opts.Log.Infof("Exported %s, %d bytes compressed with %s to %d bytes, ratio %.2f",
+		dump.Path, dump.RawSize, dump.Codec, dump.Size, dump.Ratio())
+	metrics.ExportedBytes.Add(float64(dump.Size))
+	if dump.Encrypted {
+		opts.Log.Infof("Encrypted %s", dump.Path)
+	}
+	dm.Result.Dump = dump
+	return dump, nil
+}
+
+// checkCharset checks that the data of the source can be converted to the
+// character set of the options
+func checkCharset(drv database.DatabaseDriver, src *url.URL, opts database.Options) error {
+	if opts.Charset == "" {
+		return nil
+	}
+	csDrv, ok := drv.(database.CharsetDriver)
+	if !ok {
+		return fmt.Errorf("%s does not support converting character sets", src.Scheme)
+	}
+	problems, err := csDrv.CheckCharset(src, opts)
+	if err != nil {
+		opts.Log.Errorf("Failed to check the conversion to %s", opts.Charset)
+		return err
+	}
+	for _, problem := range problems {
+		opts.Log.Warnf("Charset conversion: %s", problem)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("Can not convert to %s: %d problems found", opts.Charset, len(problems))
+	}
+	return nil
+}
+
+// importDump restores a dump, a directory is imported by a ParallelDriver
+func importDump(drv database.DatabaseDriver, dst *url.URL, dump *database.Dump, opts database.Options) error {
+	info, err := os.Stat(dump.Path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		pdrv, ok := drv.(database.ParallelDriver)
+		if !ok {
+			return fmt.Errorf("%s does not support importing a parallel dump", dst.Scheme)
+		}
+		err = pdrv.ImportParallel(dst, dump.Path, opts)
+	} else {
+		err = drv.Import(dst, dump.Path, opts)
+	}
+	if err != nil {
+		return err
+	}
+	metrics.ImportedBytes.Add(float64(dump.Size))
+	return nil
+}
 
-		eq := reflect.DeepEqual(srcSum, dstSum)
-		if !eq {
-			log.Println("src and dst have different sum.", srcSum, dstSum)
-			return errors.New("Failed to check summary")
+// options returns the driver options for the migration method
+func (dm *DatabaseMigrator) options() (database.Options, error) {
+	opts := dm.Options
+	opts.SourceDatabase = dm.Source.Database
+	opts.Log = dm.Log
+	switch dm.Method {
+	case FullDump, DataOnly:
+		if len(opts.Masks) > 0 {
+			return opts, fmt.Errorf("The %s method can not mask columns, use the parallel or cross-engine method", dm.Method)
 		}
+		opts.NoSchema = dm.Method == DataOnly
+	case SchemaOnly:
+		opts.NoData = true
+	case CrossEngine:
+		if opts.Charset != "" {
+			return opts, errors.New("The cross-engine method can not convert character sets")
+		}
+	case Parallel:
+	default:
+		return opts, fmt.Errorf("unsupported migration method: %s", dm.Method)
 	}
+	return opts, opts.Validate()
+}
+
+// renameSum returns the source summary with the destination table names
+func renameSum(sum map[string]int, opts database.Options) map[string]int {
+	renamed := make(map[string]int, len(sum))
+	for table, count := range sum {
+		renamed[opts.DestinationTable(table)] = count
+	}
+	return renamed
+}
 
+// compareSums checks the destination summary against the source one. A schema
+// only migration leaves the tables empty, so only the table names are
+// compared. A data only migration loads into an existing schema which may
+// have additional tables, so only the source tables are compared.
+func compareSums(method string, srcSum, dstSum map[string]int) error {
+	return compareTables(srcSum, dstSum, method != SchemaOnly, method != DataOnly)
+}
+
+// compareManifestSums checks the destination summary against the row counts
+// of the manifest of an artifact, only the tables when they are approximate
+func compareManifestSums(m *artifact.Manifest, srcSum, dstSum map[string]int, log *logging.Logger) error {
+	counts := m.Method != SchemaOnly
+	if counts && m.ApproximateCounts {
+		log.Warnf("The rows of artifact %s were counted without locking the source, only its tables are compared", m.ID)
+		counts = false
+	}
+	if err := compareTables(srcSum, dstSum, counts, m.Method != DataOnly); err != nil {
+		log.Errorf("artifact and dst have different sum. %v %v", srcSum, dstSum)
+		return err
+	}
+	return nil
+}
+
+// compareTables compares the tables of the summaries, and their row counts if
+// counts is set. The destination tables missing in the source are differences
+// if all is set.
+func compareTables(srcSum, dstSum map[string]int, counts, all bool) error {
+	var diffs []string
+	for table, count := range srcSum {
+		dstCount, ok := dstSum[table]
+		switch {
+		case !ok:
+			diffs = append(diffs, fmt.Sprintf("%s: missing in destination", table))
+		case counts && dstCount != count:
+			diffs = append(diffs, fmt.Sprintf("%s: %d rows in source, %d in destination", table, count, dstCount))
+		}
+	}
+	if all {
+		for table := range dstSum {
+			if _, ok := srcSum[table]; !ok {
+				diffs = append(diffs, fmt.Sprintf("%s: missing in source", table))
+			}
+		}
+	}
+	if len(diffs) > 0 {
+		metrics.ValidationMismatches.Add(float64(len(diffs)), "rows")
+		sort.Strings(diffs)
+		return fmt.Errorf("Failed to check summary: %s", strings.Join(diffs, "; "))
+	}
 	return nil
 }
 
 // check if the source and dest has compatible schema,version
 func (dm *DatabaseMigrator) CheckCompatibility() error {
-	if dm.Source.Protocal != dm.Destination.Protocal {
-		return errors.New("Not compatiable protocal")
+	if dm.Method == CrossEngine {
+		_, err := database.GetConverter(dm.Source.Protocal, dm.Destination.Protocal)
+		return err
+	}
+	if !database.SameEngine(dm.Source.Protocal, dm.Destination.Protocal) {
+		return errors.New("Not compatiable protocal, use the cross-engine method")
+	}
+	if err := checkMethod(dm.Method, dm.Source.Protocal); err != nil {
+		return err
+	}
+	return dm.checkServers()
+}
+
+// checkServers compares the versions and settings of the source and
+// destination servers, logging the differences which may change the result of
+// the migration and failing on the ones which break it
+func (dm *DatabaseMigrator) checkServers() error {
+	opts, err := dm.options()
+	if err != nil {
+		return err
+	}
+
+	log := dm.log()
+	opts = opts.WithLog(log)
+	srcInfo, err := serverInfo(dm.Source, opts)
+	if err != nil {
+		return err
+	}
+	dstInfo, err := serverInfo(dm.Destination, database.Options{Log: log, Retry: opts.Retry})
+	if err != nil {
+		return err
+	}
+	if srcInfo == nil || dstInfo == nil {
+		log.Warnf("Server compatibility is not checked by %s", dm.Source.Protocal)
+		return nil
+	}
+
+	return checkIncompatibilities(database.CheckServers(srcInfo, dstInfo, opts), log)
+}
+
+// serverInfo returns the settings of the server of a database, or nil if its
+// driver can not describe them
+func serverInfo(db datatype.Database, opts database.Options) (*database.ServerInfo, error) {
+	drv, err := database.GetDriver(db.Protocal)
+	if err != nil {
+		return nil, err
+	}
+	infoDrv, ok := drv.(database.ServerInfoDriver)
+	if !ok {
+		return nil, nil
+	}
+	u, err := db.ToURL()
+	if err != nil {
+		return nil, err
+	}
+	var info *database.ServerInfo
+	err = opts.Retried(drv, "server_info", func() error {
+		var err error
+		info, err = infoDrv.GetServerInfo(u, opts)
+		return err
+	})
+	if err != nil {
+		opts.Log.Errorf("Failed to get server info of %s", u.Host)
+		return nil, err
+	}
+	return info, nil
+}
+
+// checkIncompatibilities logs the incompatibilities, failing on blocking ones
+func checkIncompatibilities(incompat []database.Incompatibility, log *logging.Logger) error {
+	var blocking []string
+	for _, i := range incompat {
+		if i.Blocking {
+			log.Errorf("Incompatible: %s", i)
+			blocking = append(blocking, i.Message)
+		} else {
+			log.Warnf("Warning: %s", i)
+		}
+	}
+	if len(blocking) > 0 {
+		return fmt.Errorf("Not compatiable servers: %s", strings.Join(blocking, "; "))
+	}
+	return nil
+}
+
+// checkMethod checks that the driver of protocal supports the method
+func checkMethod(method, protocal string) error {
+	drv, err := database.GetDriver(protocal)
+	if err != nil {
+		return err
+	}
+	if method == Parallel {
+		if _, ok := drv.(database.ParallelDriver); !ok {
+			return fmt.Errorf("%s does not support the parallel method", protocal)
+		}
 	}
-	//TODO: version
 	return nil
 }
 
 func (dm *DatabaseMigrator) CheckConnections() error {
+	log := dm.log()
+	opts := dm.Options.WithLog(log)
 	drv, err := database.GetDriver(dm.Source.Protocal)
 	if err != nil {
-		log.Println("Failed to get driver for", dm.Source.Protocal)
+		log.Errorf("Failed to get driver for %s", dm.Source.Protocal)
 		return err
 	}
 
 	src_url, err := dm.Source.ToURL()
-	err = drv.Ping(src_url)
+	err = ping(drv, src_url, opts)
+	if err != nil {
+		log.Errorf("Failed to Ping %s", redact.URL(src_url))
+		return err
+	}
+
+	drv, err = database.GetDriver(dm.Destination.Protocal)
 	if err != nil {
-		log.Println("Failed to Ping", src_url)
+		log.Errorf("Failed to get driver for %s", dm.Destination.Protocal)
 		return err
 	}
 
 	dest_url, err := dm.Destination.ToURL()
-	err = drv.Ping(dest_url)
+	err = ping(drv, dest_url, opts)
 	if err != nil {
-		log.Println("Failed to Ping", dest_url)
+		log.Errorf("Failed to Ping %s", redact.URL(dest_url))
 		return err
 	}
 
@@ -0,0 +1,74 @@
+package migrator
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/gossion/migration-producer/pkg/logging"
+	"github.com/gossion/migration-producer/pkg/metrics"
+	"github.com/gossion/migration-producer/pkg/redact"
+)
+
+// ErrCanceled is returned by migrations canceled before they finished
+var ErrCanceled = errors.New("migration canceled")
+
+// Event reports the progress of a migration, when a phase starts and when it
+// is done
+type Event struct {
+	Phase string
+	Time  time.Time
+	// Done is set when the phase finished, with its duration and error
+	Done     bool
+	Duration time.Duration
+	Error    string
+}
+
+// canceler flags a migration to stop. The drivers run to completion, so a
+// canceled migration stops before its next phase.
+type canceler struct {
+	flag int32
+}
+
+func (c *canceler) cancel() {
+	atomic.StoreInt32(&c.flag, 1)
+}
+
+func (c *canceler) canceled() bool {
+	return atomic.LoadInt32(&c.flag) != 0
+}
+
+// timed runs a phase of a migration unless it is canceled, recording its
+// duration in the result and reporting its progress. fn logs with the phase
+// field.
+func timed(res *Result, c *canceler, progress func(Event), log *logging.Logger, phase string, fn func(*logging.Logger) error) error {
+	if c.canceled() {
+		return ErrCanceled
+	}
+	log = log.With("phase", phase)
+	notify := func(e Event) {
+		if progress != nil {
+			e.Phase = phase
+			e.Time = time.Now().UTC()
+			progress(e)
+		}
+	}
+
+	notify(Event{})
+	log.Infof("Starting %s", phase)
+	start := time.Now()
+	err := fn(log)
+	duration := time.Since(start)
+	res.Phases = append(res.Phases, Phase{Name: phase, Duration: duration})
+	metrics.PhaseDuration.ObserveDuration(duration, phase)
+
+	done := Event{Done: true, Duration: duration}
+	if err != nil {
+		done.Error = redact.String(err.Error())
+		log.Errorf("Failed %s after %s: %s", phase, duration, err)
+	} else {
+		log.Infof("Finished %s in %s", phase, duration)
+	}
+	notify(done)
+	return err
+}
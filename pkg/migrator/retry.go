@@ -0,0 +1,36 @@
+package migrator
+
+import (
+	"net/url"
+
+	"github.com/gossion/migration-producer/pkg/database"
+)
+
+// The idempotent operations of the drivers, retried on transient errors with
+// the retry policy of the options
+
+func ping(drv database.DatabaseDriver, u *url.URL, opts database.Options) error {
+	return opts.Retried(drv, "ping", func() error {
+		return drv.Ping(u)
+	})
+}
+
+func getSum(drv database.DatabaseDriver, u *url.URL, opts database.Options) (map[string]int, error) {
+	var sum map[string]int
+	err := opts.Retried(drv, "get_sum", func() error {
+		var err error
+		sum, err = drv.GetSum(u, opts)
+		return err
+	})
+	return sum, err
+}
+
+func serverVersion(drv database.DatabaseDriver, u *url.URL, opts database.Options) (string, error) {
+	var v string
+	err := opts.Retried(drv, "version", func() error {
+		var err error
+		v, err = drv.Version(u)
+		return err
+	})
+	return v, err
+}
@@ -0,0 +1,45 @@
+package migrator
+
+import (
+	"github.com/gossion/migration-producer/pkg/datatype"
+	"github.com/gossion/migration-producer/pkg/logging"
+	"github.com/gossion/migration-producer/pkg/tunnel"
+)
+
+// openTunnels replaces the databases with SSH tunnels by the databases
+// reached through them, until the returned function closes the tunnels and
+// restores the databases
+func openTunnels(log *logging.Logger, dbs ...*datatype.Database) (func(), error) {
+	var restores []func()
+	closeAll := func() {
+		for i := len(restores) - 1; i >= 0; i-- {
+			restores[i]()
+		}
+	}
+	for _, db := range dbs {
+		tunneled, t, err := tunnel.Open(*db, log)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		if t == nil {
+			continue
+		}
+		db, orig := db, *db
+		*db = tunneled
+		restores = append(restores, func() {
+			*db = orig
+			if err := t.Close(); err != nil {
+				log.Warnf("Failed to close SSH tunnel on %s: %s", t.Addr, err)
+			}
+		})
+	}
+	return closeAll, nil
+}
+
+// openTunnels opens the SSH tunnels of the source and destination databases,
+// the source as configured is kept for the manifest of an export
+func (dm *DatabaseMigrator) openTunnels() (func(), error) {
+	dm.source = dm.Source
+	return openTunnels(dm.log(), &dm.Source, &dm.Destination)
+}
@@ -0,0 +1,285 @@
+package migrator
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/gossion/migration-producer/pkg/artifact"
+	"github.com/gossion/migration-producer/pkg/database"
+	"github.com/gossion/migration-producer/pkg/datatype"
+	"github.com/gossion/migration-producer/pkg/metrics"
+)
+
+// DatabaseValidator compares a destination database with its source, or with
+// the manifest of the artifact it was imported from, e.g. days after the
+// migration.
+type DatabaseValidator struct {
+	// Method is the migration method to validate, it is read from the
+	// manifest when validating against an artifact
+	Method      string
+	Source      datatype.Database
+	Destination datatype.Database
+	// Blobstore and Artifact locate the manifest to validate against instead
+	// of the source database
+	Blobstore datatype.Blobstore
+	Artifact  string
+	// Checksum compares the checksums of the rows besides the row counts
+	Checksum bool
+	// Schema compares the table definitions, views, triggers and routines
+	// besides the row counts
+	Schema bool
+	// Options selects the tables and rows which were migrated
+	Options database.Options
+}
+
+func NewDatabaseValidator(src datatype.Database, dest datatype.Database) *DatabaseValidator {
+	return &DatabaseValidator{
+		Method:      FullDump,
+		Source:      src,
+		Destination: dest,
+	}
+}
+
+// Validate returns an error listing the differences, if any
+func (v *DatabaseValidator) Validate() error {
+	// the masks only tell which columns differ
+	opts := v.Options.MaskedColumnsOnly()
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	closeTunnels, err := openTunnels(opts.Log, &v.Source, &v.Destination)
+	if err != nil {
+		return err
+	}
+	defer closeTunnels()
+
+	dstDrv, dst, err := connect(v.Destination, opts)
+	if err != nil {
+		return err
+	}
+
+	if v.Artifact != "" {
+		return v.validateArtifact(dstDrv, dst, opts)
+	}
+
+	if v.Checksum && !database.SameEngine(v.Source.Protocal, v.Destination.Protocal) {
+		return errors.New("Checksums can only be compared between the same database engine")
+	}
+	srcDrv, src, err := connect(v.Source, opts)
+	if err != nil {
+		return err
+	}
+	opts.SourceDatabase = v.Source.Database
+
+	srcOpts := opts
+	// the converters create the tables only
+	if _, err := database.GetConverter(v.Source.Protocal, v.Destination.Protocal); err == nil {
+		srcOpts.SkipViews = true
+	}
+	srcSum, err := getSum(srcDrv, src, srcOpts)
+	if err != nil {
+		return err
+	}
+	if err := validateSums(dstDrv, dst, v.Method, srcSum, opts); err != nil {
+		return err
+	}
+
+	if v.Schema {
+		if err := validateSchema(srcDrv, src, dstDrv, dst, v.Method, opts); err != nil {
+			return err
+		}
+	}
+
+	if !v.Checksum || v.Method == SchemaOnly {
+		return nil
+	}
+	return validateChecksums(srcDrv, src, dstDrv, dst, opts)
+}
+
+// validateArtifact compares the destination with the row counts of the
+// manifest of an artifact
+func (v *DatabaseValidator) validateArtifact(dstDrv database.DatabaseDriver, dst *url.URL, opts database.Options) error {
+	if v.Checksum || v.Schema {
+		return errors.New("Artifact manifests have no checksums nor schemas, validate against the source database")
+	}
+	store, err := v.Blobstore.ToURL()
+	if err != nil {
+		return err
+	}
+	m, err := artifact.ReadManifest(store, v.Artifact, opts.Log)
+	if err != nil {
+		return err
+	}
+	if !database.SameEngine(m.Driver, v.Destination.Protocal) {
+		return fmt.Errorf("Not compatiable protocal, artifact %s was exported from %s", m.ID, m.Driver)
+	}
+	opts.SourceDatabase = m.Database
+
+	dstSum, err := getSum(dstDrv, dst, opts.ForDestination())
+	if err != nil {
+		return err
+	}
+	return compareManifestSums(m, renameSum(m.Tables, opts), dstSum, opts.Log)
+}
+
+// validateSums compares the row counts of the destination with the source
+// ones
+func validateSums(dstDrv database.DatabaseDriver, dst *url.URL, method string, srcSum map[string]int, opts database.Options) error {
+	dstSum, err := getSum(dstDrv, dst, opts.ForDestination())
+	if err != nil {
+		return err
+	}
+
+	srcSum = renameSum(srcSum, opts)
+	if err := compareSums(method, srcSum, dstSum); err != nil {
+		opts.Log.Errorf("src and dst have different sum. %v %v", srcSum, dstSum)
+		return err
+	}
+	return nil
+}
+
+// validateSchema compares the schema of the destination with the source one.
+// A data only migration loads into an existing schema which may have
+// additional objects, so only the source objects are compared.
+func validateSchema(srcDrv database.DatabaseDriver, src *url.URL, dstDrv database.DatabaseDriver, dst *url.URL, method string, opts database.Options) error {
+	diff, err := diffSchemas(srcDrv, src, dstDrv, dst, opts)
+	if err != nil {
+		return err
+	}
+
+	var diffs []string
+	for _, d := range diff.Differences {
+		if method == DataOnly && d.Change == database.Extra {
+			continue
+		}
+		diffs = append(diffs, d.String())
+	}
+	if len(diffs) > 0 {
+		metrics.ValidationMismatches.Add(float64(len(diffs)), "schema")
+		return fmt.Errorf("Failed to check schema: %s", strings.Join(diffs, "; "))
+	}
+	return nil
+}
+
+// DiffSchemas compares the schema of the destination database with the
+// source one
+func DiffSchemas(src datatype.Database, dest datatype.Database, opts database.Options) (*database.SchemaDiff, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	closeTunnels, err := openTunnels(opts.Log, &src, &dest)
+	if err != nil {
+		return nil, err
+	}
+	defer closeTunnels()
+
+	srcDrv, srcURL, err := connect(src, opts)
+	if err != nil {
+		return nil, err
+	}
+	dstDrv, dstURL, err := connect(dest, opts)
+	if err != nil {
+		return nil, err
+	}
+	return diffSchemas(srcDrv, srcURL, dstDrv, dstURL, opts)
+}
+
+func diffSchemas(srcDrv database.DatabaseDriver, src *url.URL, dstDrv database.DatabaseDriver, dst *url.URL, opts database.Options) (*database.SchemaDiff, error) {
+	if src.Scheme != dst.Scheme {
+		return nil, errors.New("Schemas can only be compared between the same database engine")
+	}
+	srcSchemas, ok := srcDrv.(database.SchemaDriver)
+	if !ok {
+		return nil, fmt.Errorf("%s does not support introspecting schemas", src.Scheme)
+	}
+	dstSchemas := dstDrv.(database.SchemaDriver) // same engine as the source
+
+	var srcSchema, dstSchema *database.Schema
+	err := opts.Retried(srcDrv, "get_schema", func() error {
+		var err error
+		srcSchema, err = srcSchemas.GetSchema(src, opts)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = opts.Retried(dstDrv, "get_schema", func() error {
+		var err error
+		dstSchema, err = dstSchemas.GetSchema(dst, database.Options{})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return database.DiffSchemas(srcSchema, dstSchema, opts), nil
+}
+
+// validateChecksums compares the checksums of the rows of the source tables
+// with the destination ones. The masked columns differ by design, the
+// checksums of their tables cover the other columns only.
+func validateChecksums(srcDrv database.DatabaseDriver, src *url.URL, dstDrv database.DatabaseDriver, dst *url.URL, opts database.Options) error {
+	srcChecksummer, ok := srcDrv.(database.ChecksumDriver)
+	if !ok {
+		return fmt.Errorf("%s does not support checksums", src.Scheme)
+	}
+	dstChecksummer := dstDrv.(database.ChecksumDriver) // same engine as the source
+
+	var srcChecksums, dstChecksums map[string]string
+	err := opts.Retried(srcDrv, "get_checksums", func() error {
+		var err error
+		srcChecksums, err = srcChecksummer.GetChecksums(src, opts)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	err = opts.Retried(dstDrv, "get_checksums", func() error {
+		var err error
+		dstChecksums, err = dstChecksummer.GetChecksums(dst, opts.ForDestination())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	var diffs []string
+	for table, checksum := range srcChecksums {
+		table = opts.DestinationTable(table)
+		dstChecksum, ok := dstChecksums[table]
+		switch {
+		case !ok:
+			diffs = append(diffs, fmt.Sprintf("%s: no checksum in destination", table))
+		case dstChecksum != checksum:
+			diffs = append(diffs, fmt.Sprintf("%s: checksum %s in source, %s in destination", table, checksum, dstChecksum))
+		}
+	}
+	if len(diffs) > 0 {
+		metrics.ValidationMismatches.Add(float64(len(diffs)), "checksum")
+		sort.Strings(diffs)
+		return fmt.Errorf("Failed to check checksums: %s", strings.Join(diffs, "; "))
+	}
+	return nil
+}
+
+// connect returns the driver and URL of a database, verifying the connection
+func connect(db datatype.Database, opts database.Options) (database.DatabaseDriver, *url.URL, error) {
+	log := opts.Log
+	drv, err := database.GetDriver(db.Protocal)
+	if err != nil {
+		log.Errorf("Failed to get driver for %s", db.Protocal)
+		return nil, nil, err
+	}
+
+	u, err := db.ToURL()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := ping(drv, u, opts); err != nil {
+		log.Errorf("Failed to Ping %s", u.Host)
+		return nil, nil, err
+	}
+	return drv, u, nil
+}
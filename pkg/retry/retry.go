@@ -0,0 +1,86 @@
+// Package retry runs idempotent operations again when they fail on transient
+// errors, e.g. a lost connection, with an exponential backoff.
+package retry
+
+import (
+	"database/sql/driver"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/gossion/migration-producer/pkg/logging"
+	"github.com/gossion/migration-producer/pkg/metrics"
+)
+
+// Policy tells how many times and how long after an operation is retried.
+// The zero value retries like DefaultPolicy.
+type Policy struct {
+	// Attempts is the maximum number of attempts, 1 or less disables the
+	// retries
+	Attempts int
+	// Delay is the backoff before the first retry, it doubles after each
+	// retry. The backoffs are randomized between half and all of it, so
+	// that concurrent jobs do not retry together.
+	Delay time.Duration
+	// MaxDelay caps the backoff, when set
+	MaxDelay time.Duration
+}
+
+// DefaultPolicy retries twice, after about 1 and 2 seconds
+var DefaultPolicy = Policy{Attempts: 3, Delay: time.Second, MaxDelay: 30 * time.Second}
+
+// Do runs fn until it succeeds, fails with an error which is not retryable,
+// or the attempts are exhausted. It returns the last error. The operation
+// names the retries in the log and the metrics, e.g. ping.
+func (p Policy) Do(log *logging.Logger, operation string, retryable func(error) bool, fn func() error) error {
+	if p == (Policy{}) {
+		p = DefaultPolicy
+	}
+	err := fn()
+	for attempt := 1; err != nil && attempt < p.Attempts && retryable(err); attempt++ {
+		delay := p.backoff(attempt)
+		log.Warnf("Retrying %s in %s after attempt %d of %d failed: %s", operation, delay, attempt, p.Attempts, err)
+		metrics.Retries.Inc(operation)
+		time.Sleep(delay)
+		err = fn()
+	}
+	return err
+}
+
+// backoff returns the delay before the retry following an attempt
+func (p Policy) backoff(attempt int) time.Duration {
+	d := p.Delay
+	for i := 1; i < attempt && (p.MaxDelay <= 0 || d < p.MaxDelay); i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Temporary reports whether an error is a network error which may not happen
+// again, e.g. a reset connection, a refused connection or a timeout
+func Temporary(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == driver.ErrBadConn || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		switch errno {
+		case syscall.ECONNRESET, syscall.ECONNREFUSED, syscall.ECONNABORTED, syscall.EPIPE, syscall.ETIMEDOUT, syscall.EHOSTUNREACH, syscall.ENETUNREACH:
+			return true
+		}
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,112 @@
+package retry
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gossion/migration-producer/pkg/logging"
+)
+
+func TestBackoff(t *testing.T) {
+	p := Policy{Attempts: 10, Delay: 100 * time.Millisecond, MaxDelay: time.Second}
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{50, time.Second},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			if d := p.backoff(tt.attempt); d < tt.max/2 || d > tt.max {
+				t.Fatalf("backoff(%d) = %s, want between %s and %s", tt.attempt, d, tt.max/2, tt.max)
+			}
+		}
+	}
+	if d := (Policy{Attempts: 3}).backoff(1); d != 0 {
+		t.Errorf("backoff() without a delay = %s", d)
+	}
+}
+
+func TestDo(t *testing.T) {
+	errTransient := errors.New("transient")
+	errFatal := errors.New("fatal")
+	retryable := func(err error) bool { return err == errTransient }
+
+	tests := []struct {
+		name     string
+		policy   Policy
+		errs     []error
+		want     error
+		attempts int
+	}{
+		{name: "success", policy: Policy{Attempts: 3, Delay: time.Millisecond}, errs: []error{nil}, attempts: 1},
+		{name: "retried", policy: Policy{Attempts: 3, Delay: time.Millisecond}, errs: []error{errTransient, errTransient, nil}, attempts: 3},
+		{name: "exhausted", policy: Policy{Attempts: 3, Delay: time.Millisecond}, errs: []error{errTransient, errTransient, errTransient, nil}, want: errTransient, attempts: 3},
+		{name: "not retryable", policy: Policy{Attempts: 3, Delay: time.Millisecond}, errs: []error{errTransient, errFatal, nil}, want: errFatal, attempts: 2},
+		{name: "disabled", policy: Policy{Attempts: 1, Delay: time.Millisecond}, errs: []error{errTransient, nil}, want: errTransient, attempts: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			err := tt.policy.Do(logging.Default(), "test", retryable, func() error {
+				err := tt.errs[attempts]
+				attempts++
+				return err
+			})
+			if err != tt.want || attempts != tt.attempts {
+				t.Errorf("Do() = %v after %d attempts, want %v after %d", err, attempts, tt.want, tt.attempts)
+			}
+		})
+	}
+}
+
+func TestDoDefaultPolicy(t *testing.T) {
+	defer func(p Policy) { DefaultPolicy = p }(DefaultPolicy)
+	DefaultPolicy = Policy{Attempts: 2, Delay: time.Millisecond}
+
+	attempts := 0
+	Policy{}.Do(logging.Default(), "test", func(error) bool { return true }, func() error {
+		attempts++
+		return io.ErrUnexpectedEOF
+	})
+	if attempts != 2 {
+		t.Errorf("Do() of the zero policy made %d attempts, want the 2 of the default policy", attempts)
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestTemporary(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{io.ErrUnexpectedEOF, true},
+		{&net.OpError{Op: "dial", Err: &os.SyscallError{Syscall: "connect", Err: syscall.ECONNREFUSED}}, true},
+		{fmt.Errorf("ping: %w", syscall.ECONNRESET), true},
+		{&net.OpError{Op: "read", Err: timeoutError{}}, true},
+		{syscall.EACCES, false},
+		{errors.New("syntax error"), false},
+	}
+	for _, tt := range tests {
+		if got := Temporary(tt.err); got != tt.want {
+			t.Errorf("Temporary(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// Package secret resolves credentials kept out of the DSNs: in files,
+// environment variables or secret providers, e.g. Vault.
+package secret
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Provider reads secrets from a secret store
+type Provider interface {
+	// Get returns the value of key in the secret at path
+	Get(path, key string) (string, error)
+}
+
+var providers = map[string]Provider{}
+
+// Register provider
+func RegisterProvider(p Provider, name string) {
+	providers[name] = p
+}
+
+// GetProvider loads a secret provider by name
+func GetProvider(name string) (Provider, error) {
+	if val, ok := providers[name]; ok {
+		return val, nil
+	}
+
+	return nil, fmt.Errorf("unsupported secret provider: %s", name)
+}
+
+// File returns the content of a file, without its trailing line break
+func File(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// Env returns the value of an environment variable, which must be set
+func Env(name string) (string, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return value, nil
+}
+
+// Ref returns the secret referenced as provider:path[:key], e.g.
+// vault:secret/data/orders:password. The key defaults to defaultKey.
+func Ref(ref, defaultKey string) (string, error) {
+	i := strings.Index(ref, ":")
+	if i <= 0 {
+		return "", fmt.Errorf("invalid secret reference %q, expected provider:path[:key]", ref)
+	}
+	name, path, key := ref[:i], ref[i+1:], defaultKey
+	if j := strings.LastIndex(path, ":"); j >= 0 {
+		path, key = path[:j], path[j+1:]
+	}
+	if path == "" || key == "" {
+		return "", fmt.Errorf("invalid secret reference %q, expected provider:path[:key]", ref)
+	}
+
+	p, err := GetProvider(name)
+	if err != nil {
+		return "", err
+	}
+	return p.Get(path, key)
+}
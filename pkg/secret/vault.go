@@ -0,0 +1,98 @@
+package secret
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gossion/migration-producer/pkg/redact"
+)
+
+func init() {
+	RegisterProvider(&Vault{}, "vault")
+}
+
+// Vault reads secrets from the KV secrets engine, version 1 or 2, of a
+// HashiCorp Vault server or of any server implementing its HTTP API. The
+// path includes the mount, e.g. secret/data/orders for version 2. The
+// address, token and namespace default to VAULT_ADDR, VAULT_TOKEN and
+// VAULT_NAMESPACE.
+type Vault struct {
+	Address   string
+	Token     string
+	Namespace string
+	Client    *http.Client
+}
+
+// vaultResponse is the body of the responses, data holds the secret, or the
+// secret and its metadata for version 2
+type vaultResponse struct {
+	Data   map[string]interface{} `json:"data"`
+	Errors []string               `json:"errors"`
+}
+
+func (v *Vault) Get(path, key string) (string, error) {
+	addr := v.setting(v.Address, "VAULT_ADDR")
+	if addr == "" {
+		return "", fmt.Errorf("vault: no address, set VAULT_ADDR")
+	}
+	req, err := http.NewRequest("GET", strings.TrimRight(addr, "/")+"/v1/"+strings.TrimLeft(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	if token := v.setting(v.Token, "VAULT_TOKEN"); token != "" {
+		redact.Secret(token)
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if namespace := v.setting(v.Namespace, "VAULT_NAMESPACE"); namespace != "" {
+		req.Header.Set("X-Vault-Namespace", namespace)
+	}
+
+	client := v.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("vault: %s", err)
+	}
+	defer resp.Body.Close()
+
+	var body vaultResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil && resp.StatusCode == http.StatusOK {
+		return "", fmt.Errorf("vault: invalid response for %s: %s", path, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg := resp.Status
+		if len(body.Errors) > 0 {
+			msg += ": " + strings.Join(body.Errors, "; ")
+		}
+		return "", fmt.Errorf("vault: reading %s: %s", path, msg)
+	}
+
+	data := body.Data
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = inner // version 2
+		}
+	}
+	value, ok := data[key]
+	if !ok || value == nil {
+		return "", fmt.Errorf("vault: no key %s in %s", key, path)
+	}
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	return fmt.Sprint(value), nil
+}
+
+func (v *Vault) setting(value, env string) string {
+	if value != "" {
+		return value
+	}
+	return os.Getenv(env)
+}
@@ -0,0 +1,107 @@
+package secret
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// vaultStub serves the secrets of a KV version 1 mount at kv/ and of a
+// version 2 mount at secret/, for the token s3cr3t
+func vaultStub(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "s3cr3t" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		if ns := r.Header.Get("X-Vault-Namespace"); ns != "" && ns != "team" {
+			t.Errorf("unexpected namespace %q", ns)
+		}
+		switch r.URL.Path {
+		case "/v1/kv/orders":
+			w.Write([]byte(`{"data":{"password":"v1-pass","port":5432}}`))
+		case "/v1/secret/data/orders":
+			w.Write([]byte(`{"data":{"data":{"password":"v2-pass","username":"orders"},"metadata":{"version":3}}}`))
+		case "/v1/secret/data/broken":
+			w.Write([]byte(`{"data":`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+		}
+	}))
+}
+
+func TestVaultGet(t *testing.T) {
+	srv := vaultStub(t)
+	defer srv.Close()
+
+	tests := []struct {
+		name      string
+		token     string
+		namespace string
+		path, key string
+		want      string
+		err       string
+	}{
+		{name: "kv v1", token: "s3cr3t", path: "kv/orders", key: "password", want: "v1-pass"},
+		{name: "kv v1 number", token: "s3cr3t", path: "kv/orders", key: "port", want: "5432"},
+		{name: "kv v2", token: "s3cr3t", path: "secret/data/orders", key: "password", want: "v2-pass"},
+		{name: "kv v2 other key", token: "s3cr3t", path: "/secret/data/orders", key: "username", want: "orders"},
+		{name: "namespace", token: "s3cr3t", namespace: "team", path: "kv/orders", key: "password", want: "v1-pass"},
+		{name: "missing key", token: "s3cr3t", path: "secret/data/orders", key: "token", err: "no key token in secret/data/orders"},
+		{name: "missing secret", token: "s3cr3t", path: "secret/data/none", key: "password", err: "404 Not Found"},
+		{name: "denied", token: "wrong", path: "kv/orders", key: "password", err: "403 Forbidden: permission denied"},
+		{name: "invalid response", token: "s3cr3t", path: "secret/data/broken", key: "password", err: "invalid response"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &Vault{Address: srv.URL + "/", Token: tt.token, Namespace: tt.namespace}
+			got, err := v.Get(tt.path, tt.key)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Get() error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Get() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVaultEnv(t *testing.T) {
+	srv := vaultStub(t)
+	defer srv.Close()
+	t.Setenv("VAULT_ADDR", srv.URL)
+	t.Setenv("VAULT_TOKEN", "s3cr3t")
+
+	got, err := Ref("vault:secret/data/orders", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "v2-pass" {
+		t.Errorf("Ref() = %q, want v2-pass", got)
+	}
+	if got, err = Ref("vault:secret/data/orders:username", "password"); err != nil || got != "orders" {
+		t.Errorf("Ref() = %q, %v, want orders", got, err)
+	}
+
+	t.Setenv("VAULT_ADDR", "")
+	if _, err := Ref("vault:kv/orders", "password"); err == nil {
+		t.Error("Ref() without address succeeded")
+	}
+}
+
+func TestRefInvalid(t *testing.T) {
+	for _, ref := range []string{"", "vault", ":kv/orders", "vault:", "vault:kv/orders:", "nope:kv/orders"} {
+		if _, err := Ref(ref, "password"); err == nil {
+			t.Errorf("Ref(%q) succeeded", ref)
+		}
+	}
+}
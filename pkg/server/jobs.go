@@ -0,0 +1,421 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	migration "github.com/gossion/migration-producer/pkg/apis"
+	"github.com/gossion/migration-producer/pkg/database"
+	"github.com/gossion/migration-producer/pkg/datatype"
+	"github.com/gossion/migration-producer/pkg/history"
+	"github.com/gossion/migration-producer/pkg/logging"
+	"github.com/gossion/migration-producer/pkg/metrics"
+	"github.com/gossion/migration-producer/pkg/migrator"
+	"github.com/gossion/migration-producer/pkg/redact"
+	"github.com/gossion/migration-producer/pkg/retry"
+)
+
+// Types of jobs
+const (
+	// DatabaseJob migrates a database with a migrator.DatabaseMigrator
+	DatabaseJob = "db"
+	// BlobJob copies an artifact with a migrator.BlobMigrator
+	BlobJob = "blob"
+)
+
+// Statuses of a job
+const (
+	Queued    = "queued"
+	Running   = "running"
+	Succeeded = "succeeded"
+	Failed    = "failed"
+	Canceled  = "canceled"
+)
+
+// JobRequest creates a job. A database job migrates SourceDSN into
+// DestinationDSN, a blob job copies Artifact from SourceBlobstore to
+// DestinationBlobstore.
+type JobRequest struct {
+	Type string `json:"type"`
+
+	Method         string            `json:"method"`
+	SourceDSN      string            `json:"source_dsn"`
+	DestinationDSN string            `json:"dest_dsn"`
+	Validate       bool              `json:"validate"`
+	Blobstore      string            `json:"blobstore"`
+	IncludeTables  []string          `json:"include_tables"`
+	ExcludeTables  []string          `json:"exclude_tables"`
+	Where          map[string]string `json:"where"`
+	RenameTables   map[string]string `json:"rename_tables"`
+	Parallelism    int               `json:"parallelism"`
+	Compression    string            `json:"compression"`
+	Charset        string            `json:"charset"`
+	Collation      string            `json:"collation"`
+	Masks          map[string]string `json:"masks"`
+
+	// RetryAttempts, RetryDelay and RetryMaxDelay override the retry policy
+	// of the server when set, the delays as durations, e.g. 500ms
+	RetryAttempts int    `json:"retry_attempts"`
+	RetryDelay    string `json:"retry_delay"`
+	RetryMaxDelay string `json:"retry_max_delay"`
+
+	SourceBlobstore      string `json:"source_blobstore"`
+	DestinationBlobstore string `json:"dest_blobstore"`
+	Artifact             string `json:"artifact"`
+}
+
+// Job is the state of a job, the DSNs are without their password
+type Job struct {
+	ID          string     `json:"id"`
+	Type        string     `json:"type"`
+	Method      string     `json:"method,omitempty"`
+	Source      string     `json:"source"`
+	Destination string     `json:"destination"`
+	Status      string     `json:"status"`
+	CreatedAt   time.Time  `json:"created_at"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	Events      []Event    `json:"events"`
+}
+
+// Finished reports whether the job will not change anymore
+func (j *Job) Finished() bool {
+	return j.Status == Succeeded || j.Status == Failed || j.Status == Canceled
+}
+
+// Event is the start or the end of a phase of a job
+type Event struct {
+	Phase    string        `json:"phase"`
+	Time     time.Time     `json:"time"`
+	Done     bool          `json:"done"`
+	Duration time.Duration `json:"duration,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// Report is the outcome of a finished job
+type Report struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	// Validation is skipped, passed or failed
+	Validation string  `json:"validation"`
+	Error      string  `json:"error,omitempty"`
+	Phases     []Phase `json:"phases"`
+	// Bytes is the size of the dump, as stored
+	Bytes    int64  `json:"bytes"`
+	Artifact string `json:"artifact,omitempty"`
+	// Tables are the row counts of the source tables, as recorded in the
+	// manifest of the artifact
+	Tables map[string]int `json:"tables,omitempty"`
+}
+
+// Phase is a timed step of a job
+type Phase struct {
+	Name     string        `json:"name"`
+	Duration time.Duration `json:"duration"`
+}
+
+// job is a job of the server, its state is guarded by the mutex of the server
+type job struct {
+	Job
+	migrator migration.Migrator
+	result   *migrator.Result
+	report   *Report
+	// log has the job field, the migrator logs with it
+	log *logging.Logger
+	// changed is closed and replaced when the state changes
+	changed chan struct{}
+}
+
+func newJobID() (string, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%s", time.Now().UTC().Format("20060102T150405Z"), hex.EncodeToString(suffix)), nil
+}
+
+// newJob creates the migrator of a request, the options of the server apply
+// to database jobs
+func (s *Server) newJob(req JobRequest) (*job, error) {
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+	j := &job{
+		Job:     Job{ID: id, Type: req.Type, Status: Queued, CreatedAt: time.Now().UTC(), Events: []Event{}},
+		log:     logging.Default().With("job", id),
+		changed: make(chan struct{}),
+	}
+	if j.Type == "" {
+		j.Type = DatabaseJob
+	}
+	policy, err := s.retryPolicy(req)
+	if err != nil {
+		return nil, err
+	}
+	progress := func(e migrator.Event) {
+		s.addEvent(j, Event{Phase: e.Phase, Time: e.Time, Done: e.Done, Duration: e.Duration, Error: e.Error})
+	}
+
+	switch j.Type {
+	case DatabaseJob:
+		if req.SourceDSN == "" || req.DestinationDSN == "" {
+			return nil, errors.New("source_dsn and dest_dsn are required")
+		}
+		src, err := datatype.ParseDSN(req.SourceDSN, s.CredentialSources...)
+		if err != nil {
+			return nil, err
+		}
+		dest, err := datatype.ParseDSN(req.DestinationDSN, s.CredentialSources...)
+		if err != nil {
+			return nil, err
+		}
+
+		dm := migrator.NewDatabaseMigrator(src, dest)
+		if req.Method != "" {
+			dm.Method = req.Method
+		}
+		dm.Validate = req.Validate
+		dm.Options = database.Options{
+			IncludeTables: req.IncludeTables,
+			ExcludeTables: req.ExcludeTables,
+			Where:         req.Where,
+			RenameTables:  req.RenameTables,
+			Parallelism:   req.Parallelism,
+			Compression:   req.Compression,
+			Charset:       req.Charset,
+			Collation:     req.Collation,
+			Masks:         req.Masks,
+			MaskKey:       s.MaskKey,
+			Encryption:    s.Encryption,
+			Retry:         policy,
+		}
+		if err := dm.Options.Validate(); err != nil {
+			return nil, err
+		}
+		if req.Blobstore != "" {
+			if dm.Blobstore, err = datatype.ParseBlobstore(req.Blobstore); err != nil {
+				return nil, err
+			}
+		}
+		dm.Progress = progress
+		dm.Log = j.log
+
+		j.Method = dm.Method
+		j.Source = redactDatabase(src)
+		j.Destination = redactDatabase(dest)
+		j.migrator = dm
+		j.result = &dm.Result
+	case BlobJob:
+		if req.Artifact == "" || req.SourceBlobstore == "" || req.DestinationBlobstore == "" {
+			return nil, errors.New("artifact, source_blobstore and dest_blobstore are required")
+		}
+		src, err := datatype.ParseBlobstore(req.SourceBlobstore)
+		if err != nil {
+			return nil, err
+		}
+		dest, err := datatype.ParseBlobstore(req.DestinationBlobstore)
+		if err != nil {
+			return nil, err
+		}
+
+		bm := migrator.NewBlobMigrator(src, dest, req.Artifact)
+		bm.Retry = policy
+		bm.Progress = progress
+		bm.Log = j.log
+
+		j.Source = redactBlobstore(src)
+		j.Destination = redactBlobstore(dest)
+		j.migrator = bm
+		j.result = &bm.Result
+	default:
+		return nil, fmt.Errorf("unknown job type: %s", req.Type)
+	}
+	return j, nil
+}
+
+// retryPolicy returns the retry policy of the server overridden by the request
+func (s *Server) retryPolicy(req JobRequest) (retry.Policy, error) {
+	policy := s.Retry
+	if policy == (retry.Policy{}) {
+		policy = retry.DefaultPolicy
+	}
+	if req.RetryAttempts < 0 {
+		return policy, errors.New("retry_attempts must not be negative")
+	}
+	if req.RetryAttempts > 0 {
+		policy.Attempts = req.RetryAttempts
+	}
+	if req.RetryDelay != "" {
+		d, err := time.ParseDuration(req.RetryDelay)
+		if err != nil {
+			return policy, fmt.Errorf("invalid retry_delay: %s", err)
+		}
+		policy.Delay = d
+	}
+	if req.RetryMaxDelay != "" {
+		d, err := time.ParseDuration(req.RetryMaxDelay)
+		if err != nil {
+			return policy, fmt.Errorf("invalid retry_max_delay: %s", err)
+		}
+		policy.MaxDelay = d
+	}
+	return policy, nil
+}
+
+// run runs a queued job, unless it was canceled meanwhile
+func (s *Server) run(j *job) {
+	s.mu.Lock()
+	if j.Status != Queued {
+		s.mu.Unlock()
+		return
+	}
+	started := time.Now().UTC()
+	j.Status = Running
+	j.StartedAt = &started
+	s.notify(j)
+	record := historyJob(j)
+	s.mu.Unlock()
+
+	s.record(j, record)
+
+	j.log.Infof("Running job %s", j.ID)
+	err := migrate(j)
+
+	s.mu.Lock()
+	finished := time.Now().UTC()
+	j.FinishedAt = &finished
+	switch {
+	case err == migrator.ErrCanceled:
+		j.Status = Canceled
+	case err != nil:
+		j.Status = Failed
+		j.Error = redact.String(err.Error())
+	default:
+		j.Status = Succeeded
+	}
+	j.report = newReport(j)
+	metrics.Jobs.Inc(j.Type, j.Status)
+	j.log.Infof("Job %s %s", j.ID, j.Status)
+	s.notify(j)
+	record = historyJob(j)
+	s.evict()
+	s.mu.Unlock()
+
+	s.record(j, record)
+}
+
+// record saves a job in the history of the server, if any. A history which
+// can not be written does not fail the job.
+func (s *Server) record(j *job, record *history.Job) {
+	if s.History == nil || record == nil {
+		return
+	}
+	if err := s.History.Save(record); err != nil {
+		j.log.Warnf("Failed to record job %s: %s", j.ID, err)
+	}
+}
+
+// historyJob returns the record of a job in the history, the mutex must be
+// held
+func historyJob(j *job) *history.Job {
+	h := &history.Job{
+		ID:          j.ID,
+		Command:     "serve-" + j.Type,
+		Source:      j.Source,
+		Destination: j.Destination,
+		Method:      j.Method,
+		Status:      j.Status,
+		StartedAt:   j.CreatedAt,
+		Error:       j.Error,
+	}
+	if j.StartedAt != nil {
+		h.StartedAt = *j.StartedAt
+	}
+	if j.FinishedAt != nil {
+		h.FinishedAt = *j.FinishedAt
+	}
+	if r := j.report; r != nil {
+		for _, p := range r.Phases {
+			h.Phases = append(h.Phases, history.Phase{Name: p.Name, Duration: p.Duration})
+		}
+		h.Bytes = r.Bytes
+		h.Artifact = r.Artifact
+		h.Validation = r.Validation
+	}
+	return h
+}
+
+// migrate runs the migrator of a job, a panic fails the job rather than the
+// server and its other jobs
+func migrate(j *job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			j.log.Errorf("Job %s panicked: %v\n%s", j.ID, r, debug.Stack())
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return j.migrator.Migrate()
+}
+
+// newReport describes the result of a finished job
+func newReport(j *job) *Report {
+	res := j.result
+	r := &Report{
+		ID:         j.ID,
+		Status:     j.Status,
+		Validation: res.Validation(),
+		Error:      j.Error,
+		Phases:     []Phase{},
+	}
+	for _, p := range res.Phases {
+		r.Phases = append(r.Phases, Phase{Name: p.Name, Duration: p.Duration})
+	}
+	if m := res.Artifact; m != nil {
+		r.Artifact = m.ID
+		r.Tables = m.Tables
+		for _, f := range m.Files {
+			r.Bytes += f.Size
+		}
+	}
+	if res.Dump != nil {
+		r.Bytes = res.Dump.Size
+	}
+	return r
+}
+
+func (s *Server) addEvent(j *job, e Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j.Events = append(j.Events, e)
+	s.notify(j)
+}
+
+// notify wakes up the watchers of a job, the mutex must be held
+func (s *Server) notify(j *job) {
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+// redactDatabase returns the DSN of a database without its password
+func redactDatabase(db datatype.Database) string {
+	u, err := db.ToURL()
+	if err != nil {
+		return ""
+	}
+	return redact.URL(u)
+}
+
+// redactBlobstore returns the URL of a blobstore without its password
+func redactBlobstore(store datatype.Blobstore) string {
+	u, err := store.ToURL()
+	if err != nil {
+		return ""
+	}
+	return redact.URL(u)
+}
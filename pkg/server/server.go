@@ -0,0 +1,345 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	migration "github.com/gossion/migration-producer/pkg/apis"
+	"github.com/gossion/migration-producer/pkg/database"
+	"github.com/gossion/migration-producer/pkg/history"
+	"github.com/gossion/migration-producer/pkg/logging"
+	"github.com/gossion/migration-producer/pkg/metrics"
+	"github.com/gossion/migration-producer/pkg/redact"
+	"github.com/gossion/migration-producer/pkg/retry"
+)
+
+// maxQueued is the number of jobs waiting for a worker, more are rejected
+const maxQueued = 100
+
+var errQueueFull = errors.New("too many queued jobs")
+
+// maxFinished is the number of finished jobs kept in memory, the older ones
+// are only in the history
+var maxFinished = 1000
+
+// Server runs the jobs submitted to its REST API, at most Concurrency at once.
+// It keeps the last finished jobs, the older ones are only in the history:
+//
+//	POST /jobs                 submit a JobRequest
+//	GET  /jobs                 list the jobs, the most recent first
+//	GET  /jobs/{id}            get a job
+//	GET  /jobs/{id}/events     stream the events of a job as server-sent events
+//	POST /jobs/{id}/cancel     cancel a job
+//	GET  /jobs/{id}/report     get the report of a finished job
+//	GET  /metrics              expose the metrics to Prometheus
+type Server struct {
+	// Token authenticates the requests as a bearer token when set
+	Token string
+	// Encryption and MaskKey apply to the dumps of all database jobs
+	Encryption database.Encryption
+	MaskKey    string
+	// CredentialSources are the sources of the credentials which the DSNs
+	// of the requests may read, e.g. file. None by default, the requests
+	// could read the files and the secrets of the server otherwise.
+	CredentialSources []string
+	// Retry is the retry policy of the jobs, which requests can override
+	Retry retry.Policy
+	// History records the jobs when set, they outlive the server there
+	History *history.Store
+
+	concurrency int
+	queue       chan *job
+
+	mu    sync.Mutex
+	jobs  map[string]*job
+	order []*job
+}
+
+// NewServer returns a server running concurrency jobs at once
+func NewServer(concurrency int) *Server {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &Server{
+		concurrency: concurrency,
+		queue:       make(chan *job, maxQueued),
+		jobs:        map[string]*job{},
+	}
+}
+
+// Start starts the workers running the queued jobs
+func (s *Server) Start() {
+	for i := 0; i < s.concurrency; i++ {
+		go func() {
+			for j := range s.queue {
+				s.run(j)
+			}
+		}()
+	}
+}
+
+// Submit queues a job
+func (s *Server) Submit(req JobRequest) (*Job, error) {
+	j, err := s.newJob(req)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case s.queue <- j:
+	default:
+		return nil, errQueueFull
+	}
+	s.jobs[j.ID] = j
+	s.order = append(s.order, j)
+	j.log.Infof("Queued %s job %s from %s to %s", j.Type, j.ID, j.Source, j.Destination)
+	return s.snapshot(j), nil
+}
+
+// Cancel cancels a queued job, or stops a running one before its next phase
+func (s *Server) Cancel(id string) (*Job, error) {
+	s.mu.Lock()
+	j, ok := s.jobs[id]
+	if !ok {
+		s.mu.Unlock()
+		return nil, nil
+	}
+	var record *history.Job
+	switch j.Status {
+	case Queued:
+		j.Status = Canceled
+		j.report = newReport(j)
+		metrics.Jobs.Inc(j.Type, j.Status)
+		s.notify(j)
+		record = historyJob(j)
+		s.evict()
+	case Running:
+		if c, ok := j.migrator.(migration.Canceler); ok {
+			c.Cancel()
+		}
+	}
+	j.log.Infof("Canceling job %s", id)
+	c := s.snapshot(j)
+	s.mu.Unlock()
+
+	s.record(j, record)
+	return c, nil
+}
+
+// evict forgets the oldest finished jobs beyond maxFinished, the mutex must
+// be held
+func (s *Server) evict() {
+	finished := 0
+	for _, j := range s.order {
+		if j.Finished() {
+			finished++
+		}
+	}
+	order := s.order[:0]
+	for _, j := range s.order {
+		if finished > maxFinished && j.Finished() {
+			delete(s.jobs, j.ID)
+			finished--
+			continue
+		}
+		order = append(order, j)
+	}
+	s.order = order
+}
+
+// snapshot copies the state of a job, the mutex must be held
+func (s *Server) snapshot(j *job) *Job {
+	c := j.Job
+	c.Events = append([]Event{}, j.Events...)
+	return &c
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.Token != "" {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("invalid token"))
+			return
+		}
+	}
+
+	path := strings.Trim(r.URL.Path, "/")
+	parts := strings.Split(path, "/")
+	switch {
+	case path == "healthz":
+		fmt.Fprintln(w, "ok")
+	case path == "metrics" && r.Method == http.MethodGet:
+		metrics.Default.ServeHTTP(w, r)
+	case path == "jobs":
+		switch r.Method {
+		case http.MethodGet:
+			s.listJobs(w)
+		case http.MethodPost:
+			s.submitJob(w, r)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		}
+	case len(parts) == 2 && parts[0] == "jobs" && r.Method == http.MethodGet:
+		s.getJob(w, parts[1])
+	case len(parts) == 3 && parts[0] == "jobs" && parts[2] == "events" && r.Method == http.MethodGet:
+		s.streamEvents(w, r, parts[1])
+	case len(parts) == 3 && parts[0] == "jobs" && parts[2] == "cancel" && r.Method == http.MethodPost:
+		s.cancelJob(w, parts[1])
+	case len(parts) == 3 && parts[0] == "jobs" && parts[2] == "report" && r.Method == http.MethodGet:
+		s.getReport(w, parts[1])
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("no route for %s %s", r.Method, r.URL.Path))
+	}
+}
+
+func (s *Server) submitJob(w http.ResponseWriter, r *http.Request) {
+	var req JobRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid job request: %s", err))
+		return
+	}
+	j, err := s.Submit(req)
+	switch {
+	case err == errQueueFull:
+		writeError(w, http.StatusServiceUnavailable, err)
+	case err != nil:
+		writeError(w, http.StatusBadRequest, err)
+	default:
+		w.Header().Set("Location", "/jobs/"+j.ID)
+		writeJSON(w, http.StatusAccepted, j)
+	}
+}
+
+func (s *Server) listJobs(w http.ResponseWriter) {
+	s.mu.Lock()
+	jobs := make([]*Job, 0, len(s.order))
+	for i := len(s.order) - 1; i >= 0; i-- {
+		jobs = append(jobs, s.snapshot(s.order[i]))
+	}
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+func (s *Server) getJob(w http.ResponseWriter, id string) {
+	s.mu.Lock()
+	j, ok := s.jobs[id]
+	var c *Job
+	if ok {
+		c = s.snapshot(j)
+	}
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no job %s", id))
+		return
+	}
+	writeJSON(w, http.StatusOK, c)
+}
+
+func (s *Server) cancelJob(w http.ResponseWriter, id string) {
+	j, err := s.Cancel(id)
+	switch {
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+	case j == nil:
+		writeError(w, http.StatusNotFound, fmt.Errorf("no job %s", id))
+	case j.Finished() && j.Status != Canceled:
+		writeError(w, http.StatusConflict, fmt.Errorf("job %s already %s", id, j.Status))
+	default:
+		writeJSON(w, http.StatusAccepted, j)
+	}
+}
+
+func (s *Server) getReport(w http.ResponseWriter, id string) {
+	s.mu.Lock()
+	j, ok := s.jobs[id]
+	var report *Report
+	if ok {
+		report = j.report
+	}
+	s.mu.Unlock()
+	switch {
+	case !ok:
+		writeError(w, http.StatusNotFound, fmt.Errorf("no job %s", id))
+	case report == nil:
+		writeError(w, http.StatusConflict, fmt.Errorf("job %s is not finished", id))
+	default:
+		writeJSON(w, http.StatusOK, report)
+	}
+}
+
+// streamEvents sends the events of a job as server-sent events, then its
+// final state as a status event once it is finished
+func (s *Server) streamEvents(w http.ResponseWriter, r *http.Request, id string) {
+	s.mu.Lock()
+	j, ok := s.jobs[id]
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no job %s", id))
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming is not supported"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	sent := 0
+	for {
+		s.mu.Lock()
+		events := append([]Event{}, j.Events[sent:]...)
+		status := s.snapshot(j)
+		changed := j.changed
+		s.mu.Unlock()
+
+		for _, e := range events {
+			writeEvent(w, "phase", e)
+		}
+		sent += len(events)
+		if status.Finished() {
+			writeEvent(w, "status", status)
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		logging.Default().Errorf("Failed to encode event: %s", err)
+		return
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logging.Default().Warnf("Failed to write response: %s", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": redact.String(err.Error())})
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gossion/migration-producer/pkg/database"
+	"github.com/gossion/migration-producer/pkg/history"
+)
+
+// fakeDriver migrates nothing, its sources are locked on a session like
+// MySQL ones. The host of a source tells how its export ends: ok, fail or
+// panic.
+type fakeDriver struct{}
+
+// fakeLocks counts the sessions holding the lock of each source host
+var fakeLocks = struct {
+	sync.Mutex
+	held  map[string]int
+	taken map[string]int
+}{held: map[string]int{}, taken: map[string]int{}}
+
+func init() {
+	database.RegisterDriver(fakeDriver{}, "fakedb")
+}
+
+func (fakeDriver) CheckDependency() error                          { return nil }
+func (fakeDriver) Ping(*url.URL) error                             { return nil }
+func (fakeDriver) Open(*url.URL) (*sql.DB, error)                  { return nil, errors.New("no connection") }
+func (fakeDriver) Version(*url.URL) (string, error)                { return "1.0", nil }
+func (fakeDriver) Import(*url.URL, string, database.Options) error { return nil }
+func (fakeDriver) Lock(*url.URL) error                             { return errors.New("no session") }
+func (fakeDriver) UnLock(*url.URL) error                           { return errors.New("no session") }
+
+func (fakeDriver) GetSum(*url.URL, database.Options) (map[string]int, error) {
+	return map[string]int{"orders": 3}, nil
+}
+
+func (fakeDriver) Export(u *url.URL, opts database.Options) (*database.Dump, error) {
+	switch u.Hostname() {
+	case "fail":
+		return nil, errors.New("mysqldump: Got error: 2013: Lost connection")
+	case "panic":
+		panic("export panicked")
+	}
+	f, err := ioutil.TempFile("", "fakedb-")
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	return &database.Dump{Path: f.Name()}, nil
+}
+
+func (fakeDriver) LockSession(u *url.URL, opts database.Options) (func() error, error) {
+	fakeLocks.Lock()
+	defer fakeLocks.Unlock()
+	fakeLocks.held[u.Hostname()]++
+	fakeLocks.taken[u.Hostname()]++
+	return func() error {
+		fakeLocks.Lock()
+		defer fakeLocks.Unlock()
+		fakeLocks.held[u.Hostname()]--
+		return nil
+	}, nil
+}
+
+// wait returns the job once finished
+func wait(t *testing.T, s *Server, id string) *Job {
+	timeout := time.After(10 * time.Second)
+	for {
+		s.mu.Lock()
+		j := s.jobs[id]
+		c, changed := s.snapshot(j), j.changed
+		s.mu.Unlock()
+		if c.Finished() {
+			return c
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			t.Fatalf("job %s is still %s", id, c.Status)
+		}
+	}
+}
+
+func TestValidatedJobReleasesLock(t *testing.T) {
+	s := NewServer(1)
+	s.Start()
+
+	tests := []struct {
+		host   string
+		status string
+	}{
+		{"ok", Succeeded},
+		{"fail", Failed},
+		{"panic", Failed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			j, err := s.Submit(JobRequest{
+				SourceDSN:      "fakedb://root@" + tt.host + "/orders",
+				DestinationDSN: "fakedb://root@dst/orders",
+				Validate:       true,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			j = wait(t, s, j.ID)
+			if j.Status != tt.status {
+				t.Errorf("job %s, want %s: %s", j.Status, tt.status, j.Error)
+			}
+
+			fakeLocks.Lock()
+			defer fakeLocks.Unlock()
+			if fakeLocks.taken[tt.host] != 1 {
+				t.Errorf("source locked %d times, want once", fakeLocks.taken[tt.host])
+			}
+			if fakeLocks.held[tt.host] != 0 {
+				t.Errorf("source still locked once the job %s", j.Status)
+			}
+		})
+	}
+}
+
+func TestFinishedJobsRecordedAndEvicted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(n int) { maxFinished = n }(maxFinished)
+	maxFinished = 1
+
+	s := NewServer(1)
+	if s.History, err = history.Open(dir); err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+
+	var ids []string
+	for _, host := range []string{"ok", "fail"} {
+		j, err := s.Submit(JobRequest{SourceDSN: "fakedb://root@" + host + "/orders", DestinationDSN: "fakedb://root@dst/orders"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		wait(t, s, j.ID)
+		ids = append(ids, j.ID)
+	}
+
+	s.mu.Lock()
+	_, first := s.jobs[ids[0]]
+	_, second := s.jobs[ids[1]]
+	kept := len(s.order)
+	s.mu.Unlock()
+	if first || !second || kept != 1 {
+		t.Errorf("kept %d jobs, the first %t and the second %t, want the second only", kept, first, second)
+	}
+
+	for i, status := range []string{history.Succeeded, history.Failed} {
+		h, err := s.History.Get(ids[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Status != status || h.Command != "serve-db" || h.FinishedAt.IsZero() || h.Validation != "skipped" {
+			t.Errorf("recorded %+v, want a finished %s job", h, status)
+		}
+	}
+}
+
+func TestPanickingJobFails(t *testing.T) {
+	s := NewServer(1)
+	s.Start()
+
+	var jobs []*Job
+	for _, host := range []string{"panic", "ok"} {
+		j, err := s.Submit(JobRequest{SourceDSN: "fakedb://root@" + host + "/orders", DestinationDSN: "fakedb://root@dst/orders"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		jobs = append(jobs, wait(t, s, j.ID))
+	}
+	if j := jobs[0]; j.Status != Failed || !strings.Contains(j.Error, "panic: export panicked") {
+		t.Errorf("panicking job %s: %s, want it failed with the panic", j.Status, j.Error)
+	}
+	if j := jobs[1]; j.Status != Succeeded {
+		t.Errorf("job after a panic %s: %s, want it run by the same worker", j.Status, j.Error)
+	}
+}
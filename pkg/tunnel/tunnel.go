@@ -0,0 +1,230 @@
+// Package tunnel reaches databases behind bastion hosts through SSH tunnels,
+// forwarded by the ssh tool.
+package tunnel
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gossion/migration-producer/pkg/datatype"
+	"github.com/gossion/migration-producer/pkg/logging"
+)
+
+// Parameters of the DSNs of the databases reached through a tunnel, e.g.
+// mysql://user@10.0.0.5/db?ssh_host=deploy@bastion:22&ssh_key=/home/deploy/.ssh/id_ed25519
+const (
+	// HostParam is the bastion host as [user@]host[:port]
+	HostParam = "ssh_host"
+	// KeyParam is the private key of the user, the keys of the ssh agent
+	// and the default ones are used otherwise
+	KeyParam = "ssh_key"
+	// KnownHostsParam is the known_hosts file verifying the key of the
+	// bastion host, ~/.ssh/known_hosts otherwise
+	KnownHostsParam = "ssh_known_hosts"
+)
+
+// Timeout is the time to wait for the tunnel to forward connections
+var Timeout = 30 * time.Second
+
+// sshCommand returns the command of the ssh tool with the arguments, tests
+// replace it to forward without a bastion host
+var sshCommand = func(args ...string) (*exec.Cmd, error) {
+	path, err := exec.LookPath("ssh")
+	if err != nil {
+		return nil, err
+	}
+	return exec.Command(path, args...), nil
+}
+
+// defaultPorts are the ports of the drivers, the tunnel needs one
+var defaultPorts = map[string]string{
+	"mysql":      "3306",
+	"postgres":   "5432",
+	"postgresql": "5432",
+}
+
+// Tunnel forwards a local port to a database through a bastion host
+type Tunnel struct {
+	cmd    *exec.Cmd
+	stderr bytes.Buffer
+	exited chan struct{}
+	log    *logging.Logger
+	// Addr is the local address forwarded to the database
+	Addr string
+}
+
+// Enabled reports whether the database is reached through a tunnel
+func Enabled(db datatype.Database) bool {
+	return db.Params.Get(HostParam) != ""
+}
+
+// Open starts the tunnel of the database if it has one. It returns the
+// database reached through the tunnel, on a local port without the tunnel
+// parameters, or the database itself and a nil tunnel. The host of the
+// database is resolved by the bastion host. The bastion host must be known,
+// the ssh tool never prompts.
+//
+// TLS certificates are verified against the local address, use the
+// verify-ca mode rather than verify-full through a tunnel.
+func Open(db datatype.Database, log *logging.Logger) (datatype.Database, *Tunnel, error) {
+	if !Enabled(db) {
+		return db, nil, nil
+	}
+	if db.Socket != "" {
+		return db, nil, errors.New("Unix sockets can not be reached through SSH tunnels, set the host of the database")
+	}
+	port := db.Port
+	if port == "" {
+		if port = defaultPorts[db.Protocal]; port == "" {
+			return db, nil, fmt.Errorf("no default port for %s, set the port of the database", db.Protocal)
+		}
+	}
+	local, err := freePort()
+	if err != nil {
+		return db, nil, err
+	}
+	target := net.JoinHostPort(db.Host, port)
+	args, err := sshArgs(db.Params, local, target)
+	if err != nil {
+		return db, nil, err
+	}
+
+	t := &Tunnel{
+		Addr:   local,
+		exited: make(chan struct{}),
+		log:    log.With("command", "ssh"),
+	}
+	t.log.Debugf("exec ssh %v", args)
+	if t.cmd, err = sshCommand(args...); err != nil {
+		return db, nil, err
+	}
+	t.cmd.Stderr = &t.stderr
+	if err := t.cmd.Start(); err != nil {
+		return db, nil, err
+	}
+	go func() {
+		t.cmd.Wait()
+		close(t.exited)
+	}()
+	if err := t.wait(); err != nil {
+		t.Close()
+		return db, nil, err
+	}
+	t.log.Infof("Opened SSH tunnel to %s through %s on %s", target, db.Params.Get(HostParam), local)
+
+	tunneled := db
+	tunneled.Host, tunneled.Port, _ = net.SplitHostPort(local)
+	tunneled.Params = url.Values{}
+	for key, values := range db.Params {
+		switch key {
+		case HostParam, KeyParam, KnownHostsParam:
+		default:
+			tunneled.Params[key] = values
+		}
+	}
+	return tunneled, t, nil
+}
+
+// wait waits until the local port accepts connections, ssh only listens
+// once it is authenticated by the bastion host
+func (t *Tunnel) wait() error {
+	deadline := time.Now().Add(Timeout)
+	for time.Now().Before(deadline) {
+		select {
+		case <-t.exited:
+			return fmt.Errorf("Failed to open SSH tunnel: %s", t.output())
+		default:
+		}
+		if conn, err := net.DialTimeout("tcp", t.Addr, time.Second); err == nil {
+			conn.Close()
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	// the output is complete once ssh exited
+	t.Close()
+	return fmt.Errorf("Failed to open SSH tunnel in %s: %s", Timeout, t.output())
+}
+
+func (t *Tunnel) output() string {
+	if out := strings.TrimSpace(t.stderr.String()); out != "" {
+		return out
+	}
+	return "ssh exited"
+}
+
+// Close stops the tunnel, a nil tunnel is closed
+func (t *Tunnel) Close() error {
+	if t == nil {
+		return nil
+	}
+	select {
+	case <-t.exited:
+		return nil
+	default:
+	}
+	if err := t.cmd.Process.Kill(); err != nil {
+		return err
+	}
+	<-t.exited
+	t.log.Debugf("Closed SSH tunnel on %s", t.Addr)
+	return nil
+}
+
+// sshArgs returns the arguments of ssh forwarding the local address to the
+// target address through the bastion host of the parameters
+func sshArgs(params url.Values, local, target string) ([]string, error) {
+	bastion := params.Get(HostParam)
+	user := ""
+	if i := strings.LastIndex(bastion, "@"); i >= 0 {
+		user, bastion = bastion[:i], bastion[i+1:]
+	}
+	host, port := bastion, ""
+	if h, p, err := net.SplitHostPort(bastion); err == nil {
+		host, port = h, p
+	} else if strings.HasPrefix(bastion, "[") {
+		host = strings.Trim(bastion, "[]")
+	}
+	if host == "" || strings.HasPrefix(host, "-") || strings.HasPrefix(user, "-") {
+		return nil, fmt.Errorf("invalid %s: %s", HostParam, params.Get(HostParam))
+	}
+
+	args := []string{
+		"-N",
+		"-o", "BatchMode=yes",
+		"-o", "StrictHostKeyChecking=yes",
+		"-o", "ExitOnForwardFailure=yes",
+		"-o", "ServerAliveInterval=30",
+		"-L", local + ":" + target,
+	}
+	if port != "" {
+		args = append(args, "-p", port)
+	}
+	if user != "" {
+		args = append(args, "-l", user)
+	}
+	if key := params.Get(KeyParam); key != "" {
+		args = append(args, "-i", key, "-o", "IdentitiesOnly=yes")
+	}
+	if knownHosts := params.Get(KnownHostsParam); knownHosts != "" {
+		args = append(args, "-o", "UserKnownHostsFile="+knownHosts)
+	}
+	return append(args, host), nil
+}
+
+// freePort returns a local address with a port free for the tunnel
+func freePort() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return "127.0.0.1:" + strconv.Itoa(l.Addr().(*net.TCPAddr).Port), nil
+}
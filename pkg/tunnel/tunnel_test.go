@@ -0,0 +1,505 @@
+package tunnel
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gossion/migration-producer/pkg/datatype"
+	"github.com/gossion/migration-producer/pkg/logging"
+	"golang.org/x/crypto/ssh"
+)
+
+// TestHelperProcess is the fake ssh tool run by fakeSSH: it forwards the
+// local address of -L to its target, like ssh through a bastion host, or
+// fails like ssh when FAKE_SSH_FAIL is set
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	if msg := os.Getenv("FAKE_SSH_FAIL"); msg != "" {
+		fmt.Fprintln(os.Stderr, msg)
+		os.Exit(255)
+	}
+	args := os.Args
+	for len(args) > 0 && args[0] != "--" {
+		args = args[1:]
+	}
+	var forward string
+	for i, arg := range args {
+		if arg == "-L" && i+1 < len(args) {
+			forward = args[i+1]
+		}
+	}
+	// local host and port, then the target
+	parts := strings.SplitN(forward, ":", 3)
+	if len(parts) != 3 {
+		fmt.Fprintf(os.Stderr, "bad forward %q\n", forward)
+		os.Exit(255)
+	}
+	l, err := net.Listen("tcp", parts[0]+":"+parts[1])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(255)
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			os.Exit(255)
+		}
+		go func() {
+			defer conn.Close()
+			target, err := net.Dial("tcp", parts[2])
+			if err != nil {
+				return
+			}
+			defer target.Close()
+			go io.Copy(target, conn)
+			io.Copy(conn, target)
+		}()
+	}
+}
+
+// fakeSSH replaces the ssh tool with TestHelperProcess, recording its
+// arguments
+func fakeSSH(t *testing.T, fail string) *[]string {
+	var recorded []string
+	orig := sshCommand
+	sshCommand = func(args ...string) (*exec.Cmd, error) {
+		recorded = args
+		cmd := exec.Command(os.Args[0], append([]string{"-test.run=TestHelperProcess", "--"}, args...)...)
+		cmd.Env = append(os.Environ(), "GO_WANT_HELPER_PROCESS=1", "FAKE_SSH_FAIL="+fail)
+		return cmd, nil
+	}
+	t.Cleanup(func() { sshCommand = orig })
+	return &recorded
+}
+
+// echoServer is the database behind the bastion host, it echoes lines
+func echoServer(t *testing.T) (host, port string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	host, port, _ = net.SplitHostPort(l.Addr().String())
+	return host, port
+}
+
+func TestOpen(t *testing.T) {
+	args := fakeSSH(t, "")
+	host, port := echoServer(t)
+	db := datatype.Database{
+		Protocal: "mysql",
+		Username: "root",
+		Host:     host,
+		Port:     port,
+		Database: "orders",
+		Params: url.Values{
+			HostParam:       {"deploy@bastion:2222"},
+			KeyParam:        {"/keys/id_ed25519"},
+			KnownHostsParam: {"/keys/known_hosts"},
+			"sslmode":       {"verify-ca"},
+		},
+	}
+
+	tunneled, tun, err := Open(db, logging.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Close()
+
+	if tunneled.Host != "127.0.0.1" || tunneled.Port == port || net.JoinHostPort(tunneled.Host, tunneled.Port) != tun.Addr {
+		t.Errorf("Open() = %s:%s, want the local address %s", tunneled.Host, tunneled.Port, tun.Addr)
+	}
+	if want := (url.Values{"sslmode": {"verify-ca"}}); !reflect.DeepEqual(tunneled.Params, want) {
+		t.Errorf("Params = %v, want %v", tunneled.Params, want)
+	}
+	if db.Params.Get(HostParam) == "" {
+		t.Errorf("Open() changed the parameters of the database")
+	}
+	if forward := tun.Addr + ":" + net.JoinHostPort(host, port); !contains(*args, forward) {
+		t.Errorf("ssh %v does not forward %s", *args, forward)
+	}
+
+	conn, err := net.Dial("tcp", tun.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintln(conn, "SELECT 1")
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	conn.Close()
+	if err != nil || line != "SELECT 1\n" {
+		t.Errorf("read %q, %v through the tunnel, want the echo", line, err)
+	}
+
+	if err := tun.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tun.Close(); err != nil {
+		t.Errorf("second Close() = %v", err)
+	}
+	if conn, err := net.DialTimeout("tcp", tun.Addr, time.Second); err == nil {
+		conn.Close()
+		t.Errorf("the tunnel still listens on %s once closed", tun.Addr)
+	}
+}
+
+func TestOpenFailure(t *testing.T) {
+	fakeSSH(t, "deploy@bastion: Permission denied (publickey).")
+	db := datatype.Database{Protocal: "postgres", Host: "10.0.0.5", Params: url.Values{HostParam: {"deploy@bastion"}}}
+
+	_, tun, err := Open(db, logging.Default())
+	if err == nil || !strings.Contains(err.Error(), "Permission denied (publickey)") {
+		t.Errorf("Open() error = %v, want the error of ssh", err)
+	}
+	if tun != nil {
+		t.Errorf("Open() returned a tunnel on failure")
+	}
+}
+
+func TestOpenWithoutTunnel(t *testing.T) {
+	args := fakeSSH(t, "")
+	db := datatype.Database{Protocal: "mysql", Host: "db", Params: url.Values{"sslmode": {"required"}}}
+
+	got, tun, err := Open(db, logging.Default())
+	if err != nil || tun != nil || !reflect.DeepEqual(got, db) {
+		t.Errorf("Open() = %+v, %v, %v, want the database itself", got, tun, err)
+	}
+	if *args != nil {
+		t.Errorf("Open() ran ssh %v", *args)
+	}
+	if err := tun.Close(); err != nil {
+		t.Errorf("Close() of a nil tunnel = %v", err)
+	}
+
+	db = datatype.Database{Protocal: "mysql", Socket: "/tmp/mysql.sock", Params: url.Values{HostParam: {"bastion"}}}
+	if _, _, err := Open(db, logging.Default()); err == nil {
+		t.Errorf("Open() of a socket succeeded")
+	}
+	db = datatype.Database{Protocal: "sqlite", Host: "db", Params: url.Values{HostParam: {"bastion"}}}
+	if _, _, err := Open(db, logging.Default()); err == nil {
+		t.Errorf("Open() without a port succeeded")
+	}
+}
+
+func TestSSHArgs(t *testing.T) {
+	tests := []struct {
+		name   string
+		params url.Values
+		want   []string
+		err    bool
+	}{
+		{
+			name:   "host",
+			params: url.Values{HostParam: {"bastion"}},
+			want:   []string{"bastion"},
+		},
+		{
+			name:   "user, port, key and known hosts",
+			params: url.Values{HostParam: {"deploy@bastion:2222"}, KeyParam: {"/k"}, KnownHostsParam: {"/kh"}},
+			want:   []string{"-p", "2222", "-l", "deploy", "-i", "/k", "-o", "IdentitiesOnly=yes", "-o", "UserKnownHostsFile=/kh", "bastion"},
+		},
+		{
+			name:   "IPv6",
+			params: url.Values{HostParam: {"deploy@[2001:db8::1]:22"}},
+			want:   []string{"-p", "22", "-l", "deploy", "2001:db8::1"},
+		},
+		{
+			name:   "IPv6 without port",
+			params: url.Values{HostParam: {"[2001:db8::1]"}},
+			want:   []string{"2001:db8::1"},
+		},
+		{name: "option injection", params: url.Values{HostParam: {"-oProxyCommand=sh"}}, err: true},
+		{name: "user option injection", params: url.Values{HostParam: {"-oProxyCommand=sh@bastion"}}, err: true},
+		{name: "no host", params: url.Values{HostParam: {"deploy@"}}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args, err := sshArgs(tt.params, "127.0.0.1:4000", "10.0.0.5:3306")
+			if tt.err {
+				if err == nil {
+					t.Errorf("sshArgs() = %v, want an error", args)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			common := []string{
+				"-N",
+				"-o", "BatchMode=yes",
+				"-o", "StrictHostKeyChecking=yes",
+				"-o", "ExitOnForwardFailure=yes",
+				"-o", "ServerAliveInterval=30",
+				"-L", "127.0.0.1:4000:10.0.0.5:3306",
+			}
+			if want := append(common, tt.want...); !reflect.DeepEqual(args, want) {
+				t.Errorf("sshArgs() = %v, want %v", args, want)
+			}
+		})
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// sshServer is a bastion host served in process to the ssh tool, it
+// authenticates the user key and forwards direct-tcpip channels
+type sshServer struct {
+	addr    string
+	hostKey ssh.Signer
+	userKey ssh.PublicKey
+	dir     string
+}
+
+// newSSHServer starts a bastion host authenticating the user key, the keys
+// are written to a temporary directory
+func newSSHServer(t *testing.T) *sshServer {
+	if _, err := exec.LookPath("ssh"); err != nil {
+		t.Skip("no ssh tool")
+	}
+	dir, err := ioutil.TempDir("", "tunnel-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	s := &sshServer{dir: dir, hostKey: newKey(t, "")}
+	s.userKey = newKey(t, filepath.Join(dir, "id_ed25519")).PublicKey()
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() != "deploy" || string(key.Marshal()) != string(s.userKey.Marshal()) {
+				return nil, fmt.Errorf("unknown key of %s", conn.User())
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(s.hostKey)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	s.addr = l.Addr().String()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn, config)
+		}
+	}()
+	return s
+}
+
+// newKey returns a new ed25519 key, written in the OpenSSH format to path
+// unless empty
+func newKey(t *testing.T, path string) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != "" {
+		block, err := ssh.MarshalPrivateKey(key, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func (s *sshServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	defer conn.Close()
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for ch := range chans {
+		if ch.ChannelType() != "direct-tcpip" {
+			ch.Reject(ssh.UnknownChannelType, "only port forwarding")
+			continue
+		}
+		var target struct {
+			Host     string
+			Port     uint32
+			OrigHost string
+			OrigPort uint32
+		}
+		if err := ssh.Unmarshal(ch.ExtraData(), &target); err != nil {
+			ch.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		dst, err := net.Dial("tcp", net.JoinHostPort(target.Host, fmt.Sprint(target.Port)))
+		if err != nil {
+			ch.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		c, creqs, err := ch.Accept()
+		if err != nil {
+			dst.Close()
+			continue
+		}
+		go ssh.DiscardRequests(creqs)
+		go func() {
+			defer c.Close()
+			defer dst.Close()
+			go io.Copy(dst, c)
+			io.Copy(c, dst)
+		}()
+	}
+}
+
+// knownHosts writes a known_hosts file with the key as the one of the
+// server and returns its path
+func (s *sshServer) knownHosts(t *testing.T, key ssh.PublicKey) string {
+	host, port, _ := net.SplitHostPort(s.addr)
+	path := filepath.Join(s.dir, "known_hosts")
+	line := fmt.Sprintf("[%s]:%s %s", host, port, ssh.MarshalAuthorizedKey(key))
+	if err := ioutil.WriteFile(path, []byte(line), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// database returns the database behind the server, reached with the
+// parameters
+func (s *sshServer) database(t *testing.T, params url.Values) datatype.Database {
+	host, port := echoServer(t)
+	params.Set(HostParam, "deploy@"+s.addr)
+	return datatype.Database{Protocal: "mysql", Host: host, Port: port, Params: params}
+}
+
+// echo checks that a line is echoed through the tunnel
+func echo(t *testing.T, tun *Tunnel) {
+	conn, err := net.Dial("tcp", tun.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintln(conn, "SELECT 1")
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "SELECT 1\n" {
+		t.Errorf("read %q, %v through the tunnel, want the echo", line, err)
+	}
+}
+
+func TestOpenSSHServer(t *testing.T) {
+	s := newSSHServer(t)
+	tests := []struct {
+		name string
+		// agent loads the key in an ssh agent rather than passing it
+		agent      bool
+		key        string
+		knownHosts ssh.PublicKey
+		err        string
+	}{
+		{name: "key", key: filepath.Join(s.dir, "id_ed25519"), knownHosts: s.hostKey.PublicKey()},
+		{name: "agent", agent: true, knownHosts: s.hostKey.PublicKey()},
+		{name: "unknown host key", key: filepath.Join(s.dir, "id_ed25519"), knownHosts: newKey(t, "").PublicKey(), err: "Host key verification failed"},
+		{name: "unknown user key", key: filepath.Join(s.dir, "other_ed25519"), knownHosts: s.hostKey.PublicKey(), err: "Permission denied"},
+	}
+	newKey(t, filepath.Join(s.dir, "other_ed25519"))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := url.Values{KnownHostsParam: {s.knownHosts(t, tt.knownHosts)}}
+			if tt.key != "" {
+				params.Set(KeyParam, tt.key)
+			}
+			if tt.agent {
+				sshAgent(t, filepath.Join(s.dir, "id_ed25519"))
+			} else {
+				// the keys of the agent of the user must not be tried
+				t.Setenv("SSH_AUTH_SOCK", "")
+			}
+
+			_, tun, err := Open(s.database(t, params), logging.Default())
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("Open() error = %v, want %s", err, tt.err)
+				}
+				tun.Close()
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			echo(t, tun)
+			if err := tun.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if conn, err := net.DialTimeout("tcp", tun.Addr, time.Second); err == nil {
+				conn.Close()
+				t.Errorf("the tunnel still listens on %s once closed", tun.Addr)
+			}
+		})
+	}
+}
+
+// sshAgent starts an ssh agent holding the key for the test
+func sshAgent(t *testing.T, key string) {
+	if _, err := exec.LookPath("ssh-agent"); err != nil {
+		t.Skip("no ssh-agent tool")
+	}
+	sock := filepath.Join(filepath.Dir(key), "agent.sock")
+	agent := exec.Command("ssh-agent", "-D", "-a", sock)
+	if err := agent.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		agent.Process.Kill()
+		agent.Wait()
+		os.Remove(sock)
+	})
+	t.Setenv("SSH_AUTH_SOCK", sock)
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		out, err := exec.Command("ssh-add", key).CombinedOutput()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("ssh-add: %v: %s", err, out)
+		}
+	}
+}
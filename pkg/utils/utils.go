@@ -4,16 +4,62 @@ import (
 	"bytes"
 	"errors"
 	"io"
-	"log"
+	"os"
 	"os/exec"
 	"strings"
+	"sync"
+
+	"github.com/gossion/migration-producer/pkg/logging"
 )
 
-// RunCommand runs a command and returns the stdout if successful
+// Runner runs external commands, logging them with the command field
+type Runner struct {
+	// Log is the logger of the commands, the default one when not set
+	Log *logging.Logger
+	// Env is added to the environment of the commands, e.g. to pass secrets
+	// which must not be on their command lines. It is not logged.
+	Env []string
+}
+
+// command logs a command and returns it, with the environment of the runner
+func (r Runner) command(name string, args []string) *exec.Cmd {
+	r.Log.With("command", name).Infof("exec %s %v", name, args)
+	cmd := exec.Command(name, args...)
+	if len(r.Env) > 0 {
+		cmd.Env = append(os.Environ(), r.Env...)
+	}
+	return cmd
+}
+
+// RunCommand runs a command with the default logger
 func RunCommand(name string, args ...string) ([]byte, error) {
-	log.Println("exec", name, args)
+	return Runner{}.RunCommand(name, args...)
+}
+
+// RunCommandOutTOFile runs a command with the default logger
+func RunCommandOutTOFile(name string, o io.Writer, args ...string) ([]byte, error) {
+	return Runner{}.RunCommandOutTOFile(name, o, args...)
+}
+
+// RunCommandWithStdin runs a command with the default logger
+func RunCommandWithStdin(name string, i io.Reader, args ...string) ([]byte, error) {
+	return Runner{}.RunCommandWithStdin(name, i, args...)
+}
+
+// CommandWriter starts a command with the default logger
+func CommandWriter(name string, o io.Writer, args ...string) (io.WriteCloser, error) {
+	return Runner{}.CommandWriter(name, o, args...)
+}
+
+// CommandReader starts a command with the default logger
+func CommandReader(name string, i io.Reader, args ...string) (io.ReadCloser, error) {
+	return Runner{}.CommandReader(name, i, args...)
+}
+
+// RunCommand runs a command and returns the stdout if successful
+func (r Runner) RunCommand(name string, args ...string) ([]byte, error) {
 	var stdout, stderr bytes.Buffer
-	cmd := exec.Command(name, args...)
+	cmd := r.command(name, args)
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 
@@ -34,11 +80,10 @@ func RunCommand(name string, args ...string) ([]byte, error) {
 // TODO: return stderr ?
 // 		 log stderr and only return error ?
 // TODO: o *bufio.Writer -> io.Writer
-func RunCommandOutTOFile(name string, o io.Writer, args ...string) ([]byte, error) {
-	log.Println("exec", name, args)
+func (r Runner) RunCommandOutTOFile(name string, o io.Writer, args ...string) ([]byte, error) {
 
 	var stderr bytes.Buffer
-	cmd := exec.Command(name, args...)
+	cmd := r.command(name, args)
 	cmd.Stdout = o
 	cmd.Stderr = &stderr
 
@@ -57,10 +102,9 @@ func RunCommandOutTOFile(name string, o io.Writer, args ...string) ([]byte, erro
 }
 
 // RunCommand runs a command and returns the stdout if successful
-func RunCommandWithStdin(name string, i io.Reader, args ...string) ([]byte, error) {
-	log.Println("exec", name, args)
+func (r Runner) RunCommandWithStdin(name string, i io.Reader, args ...string) ([]byte, error) {
 	var stdout, stderr bytes.Buffer
-	cmd := exec.Command(name, args...)
+	cmd := r.command(name, args)
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 	cmd.Stdin = i
@@ -78,3 +122,90 @@ func RunCommandWithStdin(name string, i io.Reader, args ...string) ([]byte, erro
 	// return stdout
 	return stdout.Bytes(), nil
 }
+
+// CommandWriter starts a command writing its stdout to o, the returned writer
+// feeds its stdin. Close waits for the command to exit.
+func (r Runner) CommandWriter(name string, o io.Writer, args ...string) (io.WriteCloser, error) {
+	var stderr bytes.Buffer
+	cmd := r.command(name, args)
+	cmd.Stdout = o
+	cmd.Stderr = &stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &commandPipe{Writer: stdin, stdin: stdin, cmd: cmd, stderr: &stderr}, nil
+}
+
+// CommandReader starts a command reading its stdin from i, the returned
+// reader reads its stdout. It fails with the error of the command at the end
+// of its output rather than ending, e.g. on a corrupt input. Close waits for
+// the command to exit.
+func (r Runner) CommandReader(name string, i io.Reader, args ...string) (io.ReadCloser, error) {
+	var stderr bytes.Buffer
+	cmd := r.command(name, args)
+	cmd.Stdin = i
+	cmd.Stderr = &stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &commandPipe{Reader: stdout, stdout: stdout, cmd: cmd, stderr: &stderr}, nil
+}
+
+// commandPipe is either end of a running command
+type commandPipe struct {
+	io.Reader
+	io.Writer
+	stdin  io.Closer
+	stdout io.Closer
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+
+	waited  sync.Once
+	waitErr error
+}
+
+func (p *commandPipe) Read(b []byte) (int, error) {
+	n, err := p.Reader.Read(b)
+	if err == io.EOF {
+		if werr := p.wait(); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+func (p *commandPipe) Close() error {
+	// closing stdout stops a command which is still writing
+	if p.stdin != nil {
+		p.stdin.Close()
+	}
+	if p.stdout != nil {
+		p.stdout.Close()
+	}
+	return p.wait()
+}
+
+// wait waits once for the command to exit
+func (p *commandPipe) wait() error {
+	p.waited.Do(func() {
+		if err := p.cmd.Wait(); err != nil {
+			// return stderr if available
+			if s := strings.TrimSpace(p.stderr.String()); s != "" {
+				p.waitErr = errors.New(s)
+			} else {
+				p.waitErr = err
+			}
+		}
+	})
+	return p.waitErr
+}